@@ -0,0 +1,155 @@
+// Exports of the annotations of a book to Markdown and to the W3C Web
+// Annotation data model.
+
+package annotation
+
+import (
+	"fmt"
+	"nubayrah/api/book"
+	"strings"
+	"time"
+)
+
+// JSON-LD context and media type of the W3C Web Annotation data model
+const (
+	annotationContext   = "http://www.w3.org/ns/anno.jsonld"
+	annotationMediaType = `application/ld+json; profile="http://www.w3.org/ns/anno.jsonld"`
+)
+
+// Specification EPUB CFI fragment selectors conform to
+const cfiSpecification = "http://www.idpf.org/epub/linking/cfi/epub-cfi.html"
+
+// Motivations of the Web Annotation model for each type
+var motivations = map[string]string{
+	TypeHighlight: "highlighting",
+	TypeNote:      "commenting",
+	TypeBookmark:  "bookmarking",
+}
+
+// Writes the annotations of b as a Markdown document in reading order
+func exportMarkdown(b *book.Book, annotations Annotations) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "# %s\n\n", b.Title)
+	if b.Author != "" {
+		fmt.Fprintf(&sb, "*%s*\n\n", b.Author)
+	}
+
+	for _, a := range annotations {
+		sb.WriteString("---\n\n")
+
+		if a.Type == TypeBookmark {
+			sb.WriteString("**Bookmark**\n\n")
+		}
+		if a.Text != "" {
+			for _, line := range strings.Split(strings.TrimSpace(a.Text), "\n") {
+				fmt.Fprintf(&sb, "> %s\n", line)
+			}
+			sb.WriteString("\n")
+		}
+		if a.Note != "" {
+			fmt.Fprintf(&sb, "%s\n\n", strings.TrimSpace(a.Note))
+		}
+		if len(a.Tags) > 0 {
+			tags := make([]string, len(a.Tags))
+			for i, tag := range a.Tags {
+				tags[i] = "`" + tag + "`"
+			}
+			fmt.Fprintf(&sb, "Tags: %s\n\n", strings.Join(tags, ", "))
+		}
+	}
+
+	return sb.String()
+}
+
+// Parts of the W3C Web Annotation data model used by exportWebAnnotations
+type (
+	webAnnotationCollection struct {
+		Context string            `json:"@context"`
+		ID      string            `json:"id"`
+		Type    string            `json:"type"`
+		Label   string            `json:"label"`
+		Total   int               `json:"total"`
+		First   webAnnotationPage `json:"first"`
+	}
+
+	webAnnotationPage struct {
+		Type       string           `json:"type"`
+		StartIndex int              `json:"startIndex"`
+		Items      []*webAnnotation `json:"items"`
+	}
+
+	webAnnotation struct {
+		ID         string         `json:"id"`
+		Type       string         `json:"type"`
+		Motivation string         `json:"motivation"`
+		Created    string         `json:"created"`
+		Modified   string         `json:"modified"`
+		Body       []*textualBody `json:"body,omitempty"`
+		Target     *target        `json:"target"`
+	}
+
+	textualBody struct {
+		Type    string `json:"type"`
+		Value   string `json:"value"`
+		Format  string `json:"format,omitempty"`
+		Purpose string `json:"purpose"`
+	}
+
+	target struct {
+		Source     string      `json:"source"`
+		StyleClass string      `json:"styleClass,omitempty"`
+		Selector   []*selector `json:"selector"`
+	}
+
+	selector struct {
+		Type       string `json:"type"`
+		ConformsTo string `json:"conformsTo,omitempty"`
+		Value      string `json:"value,omitempty"`
+		Exact      string `json:"exact,omitempty"`
+	}
+)
+
+// Returns the annotations of b as a W3C Web Annotation collection identified
+// by id. Books and annotations are identified by urn:uuid: IRIs, targets are
+// selected by their EPUB CFI and the annotated text.
+func exportWebAnnotations(id string, b *book.Book, annotations Annotations) *webAnnotationCollection {
+	items := make([]*webAnnotation, len(annotations))
+	for i, a := range annotations {
+		item := &webAnnotation{
+			ID:         "urn:uuid:" + a.ID.String(),
+			Type:       "Annotation",
+			Motivation: motivations[a.Type],
+			Created:    a.CreatedAt.UTC().Format(time.RFC3339),
+			Modified:   a.UpdatedAt.UTC().Format(time.RFC3339),
+			Target: &target{
+				Source:     "urn:uuid:" + b.ID.String(),
+				StyleClass: a.Color,
+				Selector: []*selector{
+					{Type: "FragmentSelector", ConformsTo: cfiSpecification, Value: a.CFI},
+				},
+			},
+		}
+
+		if a.Text != "" {
+			item.Target.Selector = append(item.Target.Selector, &selector{Type: "TextQuoteSelector", Exact: a.Text})
+		}
+		if a.Note != "" {
+			item.Body = append(item.Body, &textualBody{Type: "TextualBody", Value: a.Note, Format: "text/plain", Purpose: "commenting"})
+		}
+		for _, tag := range a.Tags {
+			item.Body = append(item.Body, &textualBody{Type: "TextualBody", Value: tag, Purpose: "tagging"})
+		}
+
+		items[i] = item
+	}
+
+	return &webAnnotationCollection{
+		Context: annotationContext,
+		ID:      id,
+		Type:    "AnnotationCollection",
+		Label:   b.Title,
+		Total:   len(items),
+		First:   webAnnotationPage{Type: "AnnotationPage", StartIndex: 0, Items: items},
+	}
+}
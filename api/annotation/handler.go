@@ -0,0 +1,413 @@
+// Handles the routes for the highlights, notes and bookmarks of the user
+// making the request.
+
+package annotation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+	"nubayrah/epub"
+	"slices"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Formats of GET /books/{id}/annotations/export
+const (
+	formatMarkdown = "markdown"
+	formatJSONLD   = "jsonld"
+)
+
+// Service represents a service for managing annotations.
+type Service struct {
+	repository *Repository
+	books      *book.Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: NewRepository(db),
+		books:      book.NewRepository(db),
+	}
+}
+
+// Routes under /annotations, across every book
+func (s *Service) RegisterListRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Annotation -> List()
+	r.Get("/", s.HandleGetAllAnnotations)
+}
+
+// Routes under /books/{id}/annotations
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Annotation -> List()
+	r.Get("/", s.HandleGetAnnotations)
+
+	// Annotation -> Create()
+	r.Post("/", s.HandleCreateAnnotation)
+
+	// Annotation -> List() as Markdown or JSON-LD
+	r.Get("/export", s.HandleExportAnnotations)
+
+	r.Route("/{annotationID}", func(r chi.Router) {
+
+		// Annotation -> Read()
+		r.Get("/", s.HandleGetAnnotation)
+
+		// Annotation -> Update()
+		r.Patch("/", s.HandleUpdateAnnotation)
+
+		// Annotation -> Delete()
+		r.Delete("/", s.HandleDeleteAnnotation)
+	})
+}
+
+// Handler for listing annotations of every book at /annotations, most
+// recently updated first
+// Accepts ?book=, ?type=, ?tag= and ?q= like HandleGetAnnotations.
+func (s *Service) HandleGetAllAnnotations(w http.ResponseWriter, r *http.Request) {
+	bookID := uuid.Nil
+	if v := r.URL.Query().Get("book"); v != "" {
+		var err error
+		bookID, err = uuid.Parse(v)
+		if err != nil {
+			log.Printf("error parsing book uuid %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.writeList(w, r, bookID)
+}
+
+// Handler for listing the annotations of a book at /books/{id}/annotations in
+// reading order
+// Accepts ?type= and ?tag=, which may be repeated, full-text search of the
+// annotated text, notes and tags with ?q=, and ?limit= and ?offset= like
+// GET /books.
+func (s *Service) HandleGetAnnotations(w http.ResponseWriter, r *http.Request) {
+	b := s.readBook(w, r)
+	if b == nil {
+		return
+	}
+
+	s.writeList(w, r, b.ID)
+}
+
+func (s *Service) writeList(w http.ResponseWriter, r *http.Request, bookID uuid.UUID) {
+	opts, err := parseListOptions(r, bookID)
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	annotations, total, err := s.repository.List(book.ReaderID(r), s.books.For(r), opts)
+	if err != nil {
+		log.Printf("error reading annotations %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(annotations)
+	if err != nil {
+		log.Printf("error marshalling annotations into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, &book.ListOptions{Limit: opts.Limit, Offset: opts.Offset}, total)
+	w.Write(j)
+}
+
+func parseListOptions(r *http.Request, bookID uuid.UUID) (*listOptions, error) {
+	query := r.URL.Query()
+	pagination, err := book.ParseListOptions(query)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &listOptions{
+		BookID: bookID,
+		Types:  query["type"],
+		Tags:   query["tag"],
+		Limit:  pagination.Limit,
+		Offset: pagination.Offset,
+	}
+	for _, t := range opts.Types {
+		if !slices.Contains(types, t) {
+			return nil, fmt.Errorf("unknown annotation type %q", t)
+		}
+	}
+	if q := query.Get("q"); q != "" {
+		opts.Query, err = book.ParseSearchQuery(q, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return opts, nil
+}
+
+// Handler for annotating a book at /books/{id}/annotations
+// Highlights need a CFI range, notes need a note. The CFI must point into
+// the spine of the book.
+func (s *Service) HandleCreateAnnotation(w http.ResponseWriter, r *http.Request) {
+	b := s.readBook(w, r)
+	if b == nil {
+		return
+	}
+
+	var body struct {
+		Type string `json:"type"`
+		annotationFields
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Printf("error decoding annotation %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	a := &Annotation{ID: uuid.New(), UserID: book.ReaderID(r), BookID: b.ID, Type: body.Type, Tags: []string{}}
+	body.annotationFields.apply(a)
+	if !s.validate(w, a, b) {
+		return
+	}
+
+	a, err := s.repository.Create(a)
+	if err != nil {
+		log.Printf("error creating annotation %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(a)
+	if err != nil {
+		log.Printf("error marshalling annotation into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+}
+
+// Handler for an annotation at /books/{id}/annotations/{annotationID}
+func (s *Service) HandleGetAnnotation(w http.ResponseWriter, r *http.Request) {
+	_, a := s.readAnnotation(w, r)
+	if a == nil {
+		return
+	}
+
+	j, err := json.Marshal(a)
+	if err != nil {
+		log.Printf("error marshalling annotation into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for editing an annotation at /books/{id}/annotations/{annotationID}
+// The body is a partial annotation, its type can't be changed.
+func (s *Service) HandleUpdateAnnotation(w http.ResponseWriter, r *http.Request) {
+	b, a := s.readAnnotation(w, r)
+	if a == nil {
+		return
+	}
+
+	var fields annotationFields
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		log.Printf("error decoding annotation %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	fields.apply(a)
+	if !s.validate(w, a, b) {
+		return
+	}
+
+	if err := s.repository.Update(a); err != nil {
+		log.Printf("error updating annotation %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(a)
+	if err != nil {
+		log.Printf("error marshalling annotation into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for deleting an annotation at /books/{id}/annotations/{annotationID}
+func (s *Service) HandleDeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	_, a := s.readAnnotation(w, r)
+	if a == nil {
+		return
+	}
+
+	if err := s.repository.Delete(a); err != nil {
+		log.Printf("error deleting annotation %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for exporting the annotations of a book at
+// /books/{id}/annotations/export
+// ?format=markdown (the default) returns a Markdown document, ?format=jsonld
+// a W3C Web Annotation collection.
+func (s *Service) HandleExportAnnotations(w http.ResponseWriter, r *http.Request) {
+	b := s.readBook(w, r)
+	if b == nil {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatMarkdown
+	}
+	if format != formatMarkdown && format != formatJSONLD {
+		log.Printf("unknown annotation export format %q", format)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	annotations, _, err := s.repository.List(book.ReaderID(r), s.books.For(r), &listOptions{BookID: b.ID})
+	if err != nil {
+		log.Printf("error reading annotations %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if format == formatMarkdown {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write([]byte(exportMarkdown(b, annotations)))
+		return
+	}
+
+	j, err := json.Marshal(exportWebAnnotations(requestURL(r), b, annotations))
+	if err != nil {
+		log.Printf("error marshalling annotations into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", annotationMediaType)
+	w.Write(j)
+}
+
+// Validates a and resolves its CFI against the spine of b, responding
+// 422 Unprocessable Entity and returning false if either is invalid
+func (s *Service) validate(w http.ResponseWriter, a *Annotation, b *book.Book) bool {
+	if err := a.Validate(); err != nil {
+		log.Printf("invalid annotation %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return false
+	}
+
+	cfi, err := epub.ParseCFI(a.CFI)
+	if err == nil && a.Type == TypeHighlight && !cfi.Range {
+		err = errors.New("highlights need a cfi range")
+	}
+	if err != nil {
+		log.Printf("invalid annotation %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return false
+	}
+
+	e, err := epub.OpenEpub(b.Filepath)
+	if err != nil {
+		log.Printf("error opening epub of book %v: %v", b.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	defer e.Close()
+
+	a.SpineIndex, err = e.ResolveCFI(cfi)
+	if err != nil {
+		log.Printf("cfi %s doesn't point into book %v: %v", a.CFI, b.ID, err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return false
+	}
+
+	return true
+}
+
+// Reads the book in the URL, responding 404 Not Found and returning nil if
+// the user can't see it
+func (s *Service) readBook(w http.ResponseWriter, r *http.Request) *book.Book {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	b, err := s.books.For(r).Read(UUID)
+	if err != nil {
+		log.Printf("error finding book in db: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	return b
+}
+
+// Reads the book and the user's annotation in the URL, responding
+// 404 Not Found and returning nil if either doesn't exist
+func (s *Service) readAnnotation(w http.ResponseWriter, r *http.Request) (*book.Book, *Annotation) {
+	b := s.readBook(w, r)
+	if b == nil {
+		return nil, nil
+	}
+
+	UUID, err := uuid.Parse(chi.URLParam(r, "annotationID"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil
+	}
+
+	a, err := s.repository.Read(book.ReaderID(r), b.ID, UUID)
+	if err != nil {
+		log.Printf("error finding annotation: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil
+	}
+
+	return b, a
+}
+
+// Absolute url the request was made to
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.RequestURI())
+}
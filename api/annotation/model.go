@@ -0,0 +1,103 @@
+// The data Models of annotations and their validation.
+
+package annotation
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of annotations
+const (
+	TypeHighlight = "highlight" // Marks a range of text
+	TypeNote      = "note"      // A note on a range or position
+	TypeBookmark  = "bookmark"  // Marks a position
+)
+
+var types = []string{TypeHighlight, TypeNote, TypeBookmark}
+
+// Named colors accepted besides #rgb and #rrggbb
+var colorNames = []string{"yellow", "green", "blue", "pink", "purple", "orange", "red"}
+
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+type Annotation struct {
+	ID         uuid.UUID `json:"id" gorm:"<-:create"`
+	UserID     uuid.UUID `json:"-" gorm:"index"`
+	BookID     uuid.UUID `json:"bookId" gorm:"index"`
+	Type       string    `json:"type" gorm:"index"`
+	CFI        string    `json:"cfi"`        // EPUB CFI of the annotated range or position
+	SpineIndex int       `json:"spineIndex"` // Spine item the CFI points into
+	Text       string    `json:"text"`       // The annotated text, as sent by the reader
+	Note       string    `json:"note"`
+	Color      string    `json:"color"`
+	Tags       []string  `json:"tags" gorm:"serializer:json"`
+	CreatedAt  time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt  time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+}
+
+type Annotations []*Annotation
+
+// Fields of an annotation that can be set by PATCH
+type annotationFields struct {
+	CFI   *string   `json:"cfi"`
+	Text  *string   `json:"text"`
+	Note  *string   `json:"note"`
+	Color *string   `json:"color"`
+	Tags  *[]string `json:"tags"`
+}
+
+func (f *annotationFields) apply(a *Annotation) {
+	if f.CFI != nil {
+		a.CFI = *f.CFI
+	}
+	if f.Text != nil {
+		a.Text = *f.Text
+	}
+	if f.Note != nil {
+		a.Note = *f.Note
+	}
+	if f.Color != nil {
+		a.Color = *f.Color
+	}
+	if f.Tags != nil {
+		a.Tags = *f.Tags
+	}
+}
+
+// Checks everything but whether the CFI points into the book, which needs
+// its epub
+func (a *Annotation) Validate() error {
+	if !slices.Contains(types, a.Type) {
+		return fmt.Errorf("unknown annotation type %q", a.Type)
+	}
+	if a.CFI == "" {
+		return errors.New("cfi is required")
+	}
+	if a.Type == TypeNote && strings.TrimSpace(a.Note) == "" {
+		return errors.New("notes need a note")
+	}
+	if a.Color != "" && !slices.Contains(colorNames, a.Color) && !hexColor.MatchString(a.Color) {
+		return fmt.Errorf("invalid color %q", a.Color)
+	}
+
+	tags := make([]string, 0, len(a.Tags))
+	for _, tag := range a.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return errors.New("tags must not be empty")
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	a.Tags = tags
+
+	return nil
+}
@@ -0,0 +1,146 @@
+// Contains all logic that needs to be done in order to communicate with the database.
+
+package annotation
+
+import (
+	"nubayrah/api/book"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+// Filters and pagination for Repository.List
+type listOptions struct {
+	BookID uuid.UUID // uuid.Nil lists annotations of every book
+	Types  []string
+	Tags   []string
+	Query  string // Full-text match expression over text, notes and tags
+
+	Limit  int // 0 returns all matching annotations
+	Offset int
+}
+
+// Creates the full-text search table over annotations and the triggers that
+// keep it in sync. Annotations are deleted along with their book when it is
+// purged and along with their user.
+func Migrate(db *gorm.DB) error {
+	statements := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS annotations_fts USING fts5(
+			annotation_id UNINDEXED, text, note, tags,
+			tokenize=unicode61
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS annotations_fts_insert AFTER INSERT ON annotations BEGIN
+			INSERT INTO annotations_fts (annotation_id, text, note, tags)
+				VALUES (new.id, new.text, new.note, new.tags);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS annotations_fts_update AFTER UPDATE OF text, note, tags ON annotations BEGIN
+			UPDATE annotations_fts SET text = new.text, note = new.note, tags = new.tags
+				WHERE annotation_id = new.id;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS annotations_fts_delete AFTER DELETE ON annotations BEGIN
+			DELETE FROM annotations_fts WHERE annotation_id = old.id;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS annotations_book_delete AFTER DELETE ON books BEGIN
+			DELETE FROM annotations WHERE book_id = old.id;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS annotations_user_delete AFTER DELETE ON users BEGIN
+			DELETE FROM annotations WHERE user_id = old.id;
+		END`,
+		// Annotations created before the index existed
+		`INSERT INTO annotations_fts (annotation_id, text, note, tags)
+			SELECT id, text, note, tags FROM annotations
+			WHERE id NOT IN (SELECT annotation_id FROM annotations_fts)`,
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range statements {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns a page of a user's annotations of books visible to books, along
+// with the total number of matching annotations. Annotations of one book are
+// in reading order, annotations of every book most recently updated first.
+func (r *Repository) List(userID uuid.UUID, books *book.Repository, opts *listOptions) (Annotations, int64, error) {
+	query := books.Visible(r.db.Model(&Annotation{}).
+		Joins("JOIN books ON books.id = annotations.book_id AND books.deleted_at IS NULL")).
+		Where("annotations.user_id = ?", userID)
+	if opts.BookID != uuid.Nil {
+		query = query.Where("annotations.book_id = ?", opts.BookID)
+	}
+	if len(opts.Types) > 0 {
+		query = query.Where("annotations.type IN ?", opts.Types)
+	}
+	if len(opts.Tags) > 0 {
+		query = query.Where("EXISTS (SELECT 1 FROM json_each(annotations.tags) WHERE json_each.value COLLATE NOCASE IN ?)", opts.Tags)
+	}
+	if opts.Query != "" {
+		query = query.Where("annotations.id IN (SELECT annotation_id FROM annotations_fts WHERE annotations_fts MATCH ?)", opts.Query)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	annotations := make(Annotations, 0)
+	tx := query.Select("annotations.*")
+	if opts.BookID != uuid.Nil {
+		tx = tx.Order("annotations.spine_index").Order("annotations.created_at")
+	} else {
+		tx = tx.Order("annotations.updated_at DESC")
+	}
+	if opts.Limit > 0 {
+		tx = tx.Limit(opts.Limit)
+	}
+	if err := tx.Offset(opts.Offset).Find(&annotations).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return annotations, total, nil
+}
+
+func (r *Repository) Create(a *Annotation) (*Annotation, error) {
+	if err := r.db.Create(a).Error; err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reads an annotation of a user on a book
+func (r *Repository) Read(userID uuid.UUID, bookID uuid.UUID, id uuid.UUID) (*Annotation, error) {
+	a := &Annotation{}
+	err := r.db.Where("id = ? AND user_id = ? AND book_id = ?", id, userID, bookID).First(a).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Overwrites all editable columns of the row matching a.ID
+func (r *Repository) Update(a *Annotation) error {
+	return r.db.Model(&Annotation{}).
+		Select("cfi", "spine_index", "text", "note", "color", "tags", "updated_at").
+		Where("id = ?", a.ID).
+		Updates(a).Error
+}
+
+func (r *Repository) Delete(a *Annotation) error {
+	return r.db.Where("id = ?", a.ID).Delete(&Annotation{}).Error
+}
@@ -1,21 +1,40 @@
 package api
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"image"
+	_ "image/jpeg"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"nubayrah/api/annotation"
 	"nubayrah/api/book"
+	"nubayrah/api/library"
 	"nubayrah/api/router"
+	"nubayrah/api/trash"
+	"nubayrah/api/user"
+	"nubayrah/api/webhook"
 	"nubayrah/epub"
 	"nubayrah/sqlite"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/spf13/viper"
 	"gorm.io/gorm"
 )
@@ -40,9 +59,11 @@ func makeTestConfig() error {
 	}
 
 	viper.SetDefault("library_path", libraryRoot)
+	viper.SetDefault("scan_path", libraryRoot)
 	viper.SetDefault("config_path", filepath.Join(homeDir, "config.yaml"))
 	viper.SetDefault("host", "localhost")
 	viper.SetDefault("port", 5050)
+	viper.SetDefault("cache_path", filepath.Join(homeDir, "cache"))
 	viper.SetDefault("db_path", filepath.Join(libraryRoot, "nubayrah.db"))
 
 	// tells Viper to look for `dataRoot/config.yaml``
@@ -60,6 +81,8 @@ func startTestServer(t *testing.T) (*gorm.DB, error) {
 		if srv != nil {
 			srv.Shutdown(context.Background())
 		}
+		// Don't reuse keep-alive connections to this server in the next test
+		http.DefaultClient.CloseIdleConnections()
 
 		if DB != nil {
 			db, err := DB.DB()
@@ -72,9 +95,15 @@ func startTestServer(t *testing.T) (*gorm.DB, error) {
 	DB = sqlite.NewDB()
 	addr := fmt.Sprintf("%s:%d", viper.GetString("host"), viper.GetInt("port"))
 
+	// Listen before returning so requests made by the test don't race the server
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
 	srv = &http.Server{Addr: addr, Handler: router.NewRouter(DB)}
 	go func() {
-		srv.ListenAndServe()
+		srv.Serve(ln)
 	}()
 
 	return DB, nil
@@ -108,12 +137,16 @@ func makePOSTBody(path string) (*bytes.Buffer, string, error) {
 }
 
 func uploadFile(path string) (*http.Response, error) {
+	return uploadFileWithQuery(path, "")
+}
+
+func uploadFileWithQuery(path string, query string) (*http.Response, error) {
 	body, ct, err := makePOSTBody(path)
 	if err != nil {
 		return nil, err
 	}
 
-	addr := fmt.Sprintf("http://%s:%d/books", viper.GetString("host"), viper.GetInt("port"))
+	addr := fmt.Sprintf("http://%s:%d/books?%s", viper.GetString("host"), viper.GetInt("port"), query)
 	req, err := http.NewRequest("POST", addr, body)
 	if err != nil {
 		return nil, err
@@ -241,3 +274,3079 @@ func TestGetBooks(t *testing.T) {
 	}
 
 }
+
+func TestUpdateBook(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b book.Book
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books/%s", viper.GetString("host"), viper.GetInt("port"), b.ID)
+	body := bytes.NewBufferString(`{"title": "Moby Dick", "series": "Whales", "seriesNum": 1}`)
+	req, err := http.NewRequest("PATCH", addr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+
+	// Both the database row and the epub on disk should have the new metadata
+	var updated book.Book
+	err = json.NewDecoder(resp.Body).Decode(&updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Title != "Moby Dick" || updated.Author != "Herman Melville" {
+		t.Fatal(fmt.Errorf("Unexpected metadata after update: %s by %s", updated.Title, updated.Author))
+	}
+
+	e, err := epub.OpenEpub(updated.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if e.Metadata.Title != "Moby Dick" || e.Metadata.Series != "Whales" || e.Metadata.SeriesNum != 1 {
+		t.Fatal(fmt.Errorf("Metadata not written to epub: %+v", e.Metadata))
+	}
+
+	// Invalid metadata is rejected without touching the book
+	req, err = http.NewRequest("PATCH", addr, bytes.NewBufferString(`{"title": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 422 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+}
+
+func TestSetBookCover(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b book.Book
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cover, err := os.ReadFile("../test_data/miniCoverImg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books/%s/cover", viper.GetString("host"), viper.GetInt("port"), b.ID)
+	req, err := http.NewRequest("PUT", addr, bytes.NewReader(cover))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "image/png")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 204 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+
+	resp, err = http.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(served) != len(cover) {
+		t.Fatal(fmt.Errorf("Mismatch cover image sizes. Want: %d Have: %d", len(cover), len(served)))
+	}
+
+	// Anything that isn't an image is rejected
+	req, err = http.NewRequest("PUT", addr, bytes.NewBufferString("not an image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 415 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+}
+
+func TestGetBookCover(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFile("../test_data/TheStoneAgeInNorthAmericaVol2.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b book.Book
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books/%s/cover", viper.GetString("host"), viper.GetInt("port"), b.ID)
+	resp, err = http.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Fatal(fmt.Errorf("Unexpected content type. Want: image/jpeg Have: %s", ct))
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("Missing ETag header")
+	}
+
+	// Conditional request with the same etag
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("If-None-Match", etag)
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 304 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+
+	// Thumbnail
+	resp, err = http.Get(addr + "?w=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+
+	cfg, _, err := image.DecodeConfig(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Width != 100 {
+		t.Fatal(fmt.Errorf("Unexpected thumbnail width. Want: 100 Have: %d", cfg.Width))
+	}
+
+	cached, err := filepath.Glob(filepath.Join(viper.GetString("cache_path"), "covers", b.ID.String(), "*_100x0.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cached) != 1 {
+		t.Fatal(fmt.Errorf("Expected 1 cached thumbnail, have %d", len(cached)))
+	}
+}
+
+func TestDownloadBook(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b book.Book
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig, err := os.ReadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books/%s/file", viper.GetString("host"), viper.GetInt("port"), b.ID)
+	resp, err = http.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/epub+zip" {
+		t.Fatal(fmt.Errorf("Unexpected content type. Want: application/epub+zip Have: %s", ct))
+	}
+
+	cd := resp.Header.Get("Content-Disposition")
+	if cd != `attachment; filename="Herman Melville - Moby Dick; Or, The Whale.epub"` {
+		t.Fatal(fmt.Errorf("Unexpected content disposition: %s", cd))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, orig) {
+		t.Fatal("Downloaded epub does not match the uploaded file")
+	}
+
+	// Range request for the magic bytes
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Range", "bytes=0-3")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 206 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, orig[:4]) {
+		t.Fatal(fmt.Errorf("Unexpected range content %v", data))
+	}
+}
+
+func TestGetBooksPaginated(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"../test_data/MobyDick.epub",
+		"../test_data/TheBrothersKaramazov.epub",
+		"../test_data/TheStoneAgeInNorthAmericaVol2.epub",
+	} {
+		resp, err := uploadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 201 {
+			t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+		}
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books", viper.GetString("host"), viper.GetInt("port"))
+
+	// Newest publication first, two per page
+	resp, err := http.Get(addr + "?sort=-pubDate&limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var books []*book.Book
+	err = json.NewDecoder(resp.Body).Decode(&books)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(books) != 2 {
+		t.Fatal(fmt.Errorf("Incorrect number of entries in json. Want: 2 Have: %d", len(books)))
+	}
+
+	if books[0].PubDate != "2024-09-07" || books[1].PubDate != "2009-02-12" {
+		t.Fatal(fmt.Errorf("Incorrect order: %s, %s", books[0].PubDate, books[1].PubDate))
+	}
+
+	if total := resp.Header.Get("X-Total-Count"); total != "3" {
+		t.Fatal(fmt.Errorf("Incorrect X-Total-Count. Want: 3 Have: %s", total))
+	}
+
+	if link := resp.Header.Get("Link"); !strings.Contains(link, `offset=2&sort=-pubDate>; rel="next"`) {
+		t.Fatal(fmt.Errorf("Missing next link: %s", link))
+	}
+
+	// Filter on a subject
+	resp, err = http.Get(addr + "?subject=" + url.QueryEscape("sea stories"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books = nil
+	err = json.NewDecoder(resp.Body).Decode(&books)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(books) != 1 || books[0].Author != "Herman Melville" {
+		t.Fatal(fmt.Errorf("Unexpected result for subject filter: %v", books))
+	}
+
+	// Unknown sort keys are rejected
+	resp, err = http.Get(addr + "?sort=filePath")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 400 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+}
+
+func TestSearchBooks(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"../test_data/MobyDick.epub",
+		"../test_data/TheBrothersKaramazov.epub",
+	} {
+		resp, err := uploadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 201 {
+			t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+		}
+	}
+
+	search := func(query string) []*book.SearchResult {
+		addr := fmt.Sprintf("http://%s:%d/books/search?%s", viper.GetString("host"), viper.GetInt("port"), query)
+		resp, err := http.Get(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+		}
+
+		var results []*book.SearchResult
+		err = json.NewDecoder(resp.Body).Decode(&results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	// Metadata
+	results := search("q=" + url.QueryEscape("whal*"))
+	if len(results) != 1 || results[0].Author != "Herman Melville" {
+		t.Fatal(fmt.Errorf("Unexpected results for metadata search: %v", results))
+	}
+
+	// Content only matches once the indexer ran
+	results = search("q=Pequod&content=true")
+	if len(results) != 0 {
+		t.Fatal(fmt.Errorf("Unexpected results before indexing content: %v", results))
+	}
+
+	_, err = book.NewContentIndexer(DB).IndexPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results = search("q=Pequod&content=true")
+	if len(results) != 1 || results[0].Author != "Herman Melville" {
+		t.Fatal(fmt.Errorf("Unexpected results for content search: %v", results))
+	}
+
+	if !strings.Contains(results[0].Snippet, "<mark>Pequod</mark>") {
+		t.Fatal(fmt.Errorf("Search term not highlighted in snippet: %s", results[0].Snippet))
+	}
+
+	// Metadata searches don't look at the content
+	results = search("q=Pequod")
+	if len(results) != 0 {
+		t.Fatal(fmt.Errorf("Unexpected results for metadata search: %v", results))
+	}
+}
+
+func TestOPDSCatalog(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b book.Book
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) (string, string) {
+		addr := fmt.Sprintf("http://%s:%d%s", viper.GetString("host"), viper.GetInt("port"), path)
+		resp, err := http.Get(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatal(fmt.Errorf("Unexpected status code %d for %s", resp.StatusCode, path))
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	// OPDS 1.2 navigation
+	ct, body := get("/opds")
+	if ct != "application/atom+xml;profile=opds-catalog;kind=navigation" {
+		t.Fatal(fmt.Errorf("Unexpected content type %s", ct))
+	}
+	if !strings.Contains(body, `href="/opds/authors"`) {
+		t.Fatal(fmt.Errorf("Missing authors link in root feed: %s", body))
+	}
+
+	_, body = get("/opds/authors")
+	if !strings.Contains(body, `href="/opds/books?author=Herman+Melville&amp;sort=titleSort"`) {
+		t.Fatal(fmt.Errorf("Missing author entry: %s", body))
+	}
+
+	// OPDS 1.2 acquisition
+	ct, body = get("/opds/books?author=" + url.QueryEscape("Herman Melville"))
+	if ct != "application/atom+xml;profile=opds-catalog;kind=acquisition" {
+		t.Fatal(fmt.Errorf("Unexpected content type %s", ct))
+	}
+	acquisition := fmt.Sprintf(`<link rel="http://opds-spec.org/acquisition" href="/books/%s/file" type="application/epub+zip">`, b.ID)
+	if !strings.Contains(body, acquisition) {
+		t.Fatal(fmt.Errorf("Missing acquisition link: %s", body))
+	}
+
+	_, body = get("/opds/search.xml")
+	if !strings.Contains(body, "/opds/search?q={searchTerms}") {
+		t.Fatal(fmt.Errorf("Missing search template: %s", body))
+	}
+
+	_, body = get("/opds/search?q=moby")
+	if !strings.Contains(body, acquisition) {
+		t.Fatal(fmt.Errorf("Missing search result: %s", body))
+	}
+
+	// OPDS 2.0
+	ct, body = get("/opds/v2/books")
+	if ct != "application/opds+json" {
+		t.Fatal(fmt.Errorf("Unexpected content type %s", ct))
+	}
+
+	var feed struct {
+		Publications []struct {
+			Metadata struct {
+				Title string `json:"title"`
+			} `json:"metadata"`
+			Links []struct {
+				Href string `json:"href"`
+			} `json:"links"`
+		} `json:"publications"`
+	}
+	err = json.Unmarshal([]byte(body), &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(feed.Publications) != 1 || feed.Publications[0].Metadata.Title != "Moby Dick; Or, The Whale" {
+		t.Fatal(fmt.Errorf("Unexpected publications: %s", body))
+	}
+
+	if feed.Publications[0].Links[0].Href != fmt.Sprintf("/books/%s/file", b.ID) {
+		t.Fatal(fmt.Errorf("Unexpected acquisition link: %s", feed.Publications[0].Links[0].Href))
+	}
+}
+
+func TestScanLibrary(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Books copied into the library by hand
+	dir := filepath.Join(viper.GetString("scan_path"), "Manual")
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "moby.epub"), data, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "broken.epub"), []byte("not an epub"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func() *library.ScanResult {
+		addr := fmt.Sprintf("http://%s:%d/library/scan", viper.GetString("host"), viper.GetInt("port"))
+		resp, err := http.Post(addr, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+		}
+
+		var result library.ScanResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &result
+	}
+
+	result := scan()
+	if len(result.Added) != 1 || len(result.Failed) != 1 {
+		t.Fatal(fmt.Errorf("Unexpected scan result. Added: %d Failed: %d", len(result.Added), len(result.Failed)))
+	}
+
+	// Books are registered in place
+	if result.Added[0].Filepath != filepath.Join(dir, "moby.epub") {
+		t.Fatal(fmt.Errorf("Unexpected filepath %s", result.Added[0].Filepath))
+	}
+
+	if result.Failed[0].Path != filepath.Join(dir, "broken.epub") {
+		t.Fatal(fmt.Errorf("Unexpected failed path %s", result.Failed[0].Path))
+	}
+
+	// Scanning again doesn't add the book twice
+	result = scan()
+	if len(result.Added) != 0 || result.Skipped != 1 {
+		t.Fatal(fmt.Errorf("Unexpected rescan result. Added: %d Skipped: %d", len(result.Added), result.Skipped))
+	}
+
+	// Nor does a copy of it elsewhere
+	err = os.WriteFile(filepath.Join(dir, "moby copy.epub"), data, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = scan()
+	if len(result.Added) != 0 || result.Skipped != 2 {
+		t.Fatal(fmt.Errorf("Unexpected result for a duplicate. Added: %d Skipped: %d", len(result.Added), result.Skipped))
+	}
+}
+
+func TestInboxWatcher(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inbox := filepath.Join("./testHome", "inbox")
+	err = os.MkdirAll(inbox, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- library.NewWatcher(DB, inbox, 100*time.Millisecond).Run(ctx)
+	}()
+
+	data, err := os.ReadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(inbox, "moby.epub"), data, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(inbox, "broken.epub"), []byte("not an epub"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := filepath.Join(inbox, "imported", "moby.epub")
+	failed := filepath.Join(inbox, "failed", "broken.epub")
+	for i := 0; ; i++ {
+		_, errImported := os.Stat(imported)
+		_, errFailed := os.Stat(failed + ".log")
+		if errImported == nil && errFailed == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(fmt.Errorf("Inbox files were not processed"))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := os.Stat(failed); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books", viper.GetString("host"), viper.GetInt("port"))
+	resp, err := http.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var books book.Books
+	err = json.NewDecoder(resp.Body).Decode(&books)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(books) != 1 || books[0].Author != "Herman Melville" {
+		t.Fatal(fmt.Errorf("Expected imported book, got %d books", len(books)))
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcileLibrary(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(path string) *book.Book {
+		resp, err := uploadFileWithQuery(path, "duplicate=keep")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var b book.Book
+		err = json.NewDecoder(resp.Body).Decode(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &b
+	}
+
+	// Same book twice, the second copy's file goes missing
+	upload("../test_data/MobyDick.epub")
+	missing := upload("../test_data/MobyDick.epub")
+	err = os.Remove(missing.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Database edited without touching the file
+	karamazov := upload("../test_data/TheBrothersKaramazov.epub")
+	err = DB.Model(&book.Book{}).Where("id = ?", karamazov.ID).Update("title", "Wrong").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// File copied into the library by hand
+	data, err := os.ReadFile("../test_data/TheStonesOfVeniceVol2.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(viper.GetString("library_path"), "venice.epub")
+	err = os.WriteFile(orphan, data, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reconcile := func(dryRun bool) *library.ReconcileReport {
+		addr := fmt.Sprintf("http://%s:%d/library/reconcile?dryRun=%t", viper.GetString("host"), viper.GetInt("port"), dryRun)
+		resp, err := http.Post(addr, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+		}
+
+		var report library.ReconcileReport
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &report
+	}
+
+	check := func(report *library.ReconcileReport) {
+		if len(report.Missing) != 1 || report.Missing[0].ID != missing.ID {
+			t.Fatal(fmt.Errorf("Expected missing book %s, got %d", missing.ID, len(report.Missing)))
+		}
+		if len(report.Orphans) != 1 || report.Orphans[0] != orphan {
+			t.Fatal(fmt.Errorf("Expected orphan %s, got %v", orphan, report.Orphans))
+		}
+		if len(report.Mismatched) != 1 || report.Mismatched[0].Book.ID != karamazov.ID ||
+			strings.Join(report.Mismatched[0].Fields, ",") != "title" {
+			t.Fatal(fmt.Errorf("Expected mismatched title of %s", karamazov.ID))
+		}
+		if len(report.Duplicates) != 1 || report.Duplicates[0].Key != "uid" || len(report.Duplicates[0].Books) != 2 {
+			t.Fatal(fmt.Errorf("Expected one duplicate uid group, got %d", len(report.Duplicates)))
+		}
+	}
+
+	// Dry runs report without changing anything
+	check(reconcile(true))
+	check(reconcile(true))
+
+	check(reconcile(false))
+
+	// Removing the missing copy also resolved the duplicate
+	report := reconcile(true)
+	if len(report.Missing) != 0 || len(report.Orphans) != 0 || len(report.Mismatched) != 0 || len(report.Duplicates) != 0 {
+		t.Fatal(fmt.Errorf("Unexpected differences after reconciling %+v", report))
+	}
+
+	var fixed book.Book
+	err = DB.Where("id = ?", karamazov.ID).First(&fixed).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed.Title == "Wrong" {
+		t.Fatal(fmt.Errorf("Title was not restored from the file"))
+	}
+
+	var count int64
+	DB.Model(&book.Book{}).Count(&count)
+	if count != 3 {
+		t.Fatal(fmt.Errorf("Expected 3 books after reconciling, got %d", count))
+	}
+}
+
+func TestTrash(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b book.Book
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+	do := func(method string, path string) *http.Response {
+		req, err := http.NewRequest(method, base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expect := func(method string, path string, status int) {
+		resp := do(method, path)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("%s %s: expected status %d, got %d", method, path, status, resp.StatusCode))
+		}
+	}
+	trashed := func() book.Books {
+		resp := do("GET", "/trash")
+		defer resp.Body.Close()
+		var books book.Books
+		if err := json.NewDecoder(resp.Body).Decode(&books); err != nil {
+			t.Fatal(err)
+		}
+		return books
+	}
+
+	// Cache a thumbnail to be moved along with the book
+	expect("GET", fmt.Sprintf("/books/%s/cover?w=64", b.ID), http.StatusOK)
+
+	expect("DELETE", fmt.Sprintf("/books/%s", b.ID), http.StatusNoContent)
+	expect("GET", fmt.Sprintf("/books/%s", b.ID), http.StatusNotFound)
+
+	trashDir := filepath.Join(viper.GetString("library_path"), ".trash", b.ID.String())
+	if _, err := os.Stat(b.Filepath); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("Epub was not moved out of the library"))
+	}
+	if _, err := os.Stat(filepath.Join(trashDir, filepath.Base(b.Filepath))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(trashDir, "covers")); err != nil {
+		t.Fatal(err)
+	}
+
+	books := trashed()
+	if len(books) != 1 || books[0].ID != b.ID || !books[0].DeletedAt.Valid {
+		t.Fatal(fmt.Errorf("Expected deleted book in trash, got %d books", len(books)))
+	}
+
+	// Deleted books don't show up in searches
+	resp = do("GET", "/books/search?q=moby")
+	var results []*book.SearchResult
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatal(fmt.Errorf("Deleted book found by search"))
+	}
+
+	expect("POST", fmt.Sprintf("/trash/%s/restore", b.ID), http.StatusOK)
+	expect("GET", fmt.Sprintf("/books/%s", b.ID), http.StatusOK)
+	if _, err := os.Stat(b.Filepath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(trashDir); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("Trash directory was not removed on restore"))
+	}
+	if len(trashed()) != 0 {
+		t.Fatal(fmt.Errorf("Restored book still in trash"))
+	}
+
+	// Purging, which deletes the rows belonging to the book along with it
+	if err := DB.Create(&book.CollectionBook{CollectionID: uuid.New(), BookID: b.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	rows := func() (n int64) {
+		err := DB.Raw(`SELECT (SELECT COUNT(*) FROM collection_books WHERE book_id = ?) +
+			(SELECT COUNT(*) FROM book_authors WHERE book_id = ?)`, b.ID, b.ID).Scan(&n).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if rows() != 2 {
+		t.Fatal(fmt.Errorf("Expected a collection and an author link before purging, got %d rows", rows()))
+	}
+
+	expect("DELETE", fmt.Sprintf("/books/%s", b.ID), http.StatusNoContent)
+	expect("DELETE", fmt.Sprintf("/trash/%s", b.ID), http.StatusNoContent)
+	expect("POST", fmt.Sprintf("/trash/%s/restore", b.ID), http.StatusNotFound)
+	if _, err := os.Stat(trashDir); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("Trash directory was not removed on purge"))
+	}
+	if rows() != 0 {
+		t.Fatal(fmt.Errorf("Rows of the purged book were left behind"))
+	}
+
+	// Retention
+	resp, err = uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect("DELETE", fmt.Sprintf("/books/%s", b.ID), http.StatusNoContent)
+
+	n, err := trash.NewPurger(DB, time.Hour).PurgeExpired()
+	if err != nil || n != 0 {
+		t.Fatal(fmt.Errorf("Purged %d books deleted within the retention period: %v", n, err))
+	}
+
+	n, err = trash.NewPurger(DB, 0).PurgeExpired()
+	if err != nil || n != 1 {
+		t.Fatal(fmt.Errorf("Expected 1 expired book to be purged, got %d: %v", n, err))
+	}
+	if len(trashed()) != 0 {
+		t.Fatal(fmt.Errorf("Expired book still in trash"))
+	}
+}
+
+func TestRelocateOnUpdate(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("library_layout", "{authorSort}/{series}/{seriesNum:02} - {title}.epub")
+	t.Cleanup(func() { viper.Set("library_layout", "") })
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b book.Book
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	libraryRoot := viper.GetString("library_path")
+	want := filepath.Join(libraryRoot, "Melville, Herman", "Moby Dick; Or, The Whale.epub")
+	if b.Filepath != want {
+		t.Fatal(fmt.Errorf("Expected import at %s, got %s", want, b.Filepath))
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books/%s", viper.GetString("host"), viper.GetInt("port"), b.ID)
+	body := bytes.NewBufferString(`{"authorSort": "Melville, H.", "series": "Whales", "seriesNum": 3}`)
+	req, err := http.NewRequest("PATCH", addr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var updated book.Book
+	err = json.NewDecoder(resp.Body).Decode(&updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = filepath.Join(libraryRoot, "Melville, H", "Whales", "03 - Moby Dick; Or, The Whale.epub")
+	if updated.Filepath != want {
+		t.Fatal(fmt.Errorf("Expected book moved to %s, got %s", want, updated.Filepath))
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old author directory was left empty
+	if _, err := os.Stat(filepath.Join(libraryRoot, "Melville, Herman")); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("Empty author directory was not removed"))
+	}
+
+	// The new path is stored
+	resp, err = http.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var read book.Book
+	err = json.NewDecoder(resp.Body).Decode(&read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Filepath != want {
+		t.Fatal(fmt.Errorf("Filepath not updated in database: %s", read.Filepath))
+	}
+}
+
+func TestImportDuplicateBook(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(query string, status int) *book.Book {
+		resp, err := uploadFileWithQuery("../test_data/MobyDick.epub", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("Upload with %q: expected status %d, got %d", query, status, resp.StatusCode))
+		}
+		if status >= 400 && status != http.StatusConflict {
+			return nil
+		}
+
+		var b book.Book
+		err = json.NewDecoder(resp.Body).Decode(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("Location") != fmt.Sprintf("/books/%s", b.ID) {
+			t.Fatal(fmt.Errorf("Unexpected Location %s", resp.Header.Get("Location")))
+		}
+		return &b
+	}
+
+	original := upload("", http.StatusCreated)
+	if len(original.Sha256) != 64 {
+		t.Fatal(fmt.Errorf("Expected sha256 of the epub, got %q", original.Sha256))
+	}
+
+	// The existing book is returned
+	conflict := upload("", http.StatusConflict)
+	if conflict.ID != original.ID {
+		t.Fatal(fmt.Errorf("Expected conflict with %s, got %s", original.ID, conflict.ID))
+	}
+
+	upload("duplicate=nope", http.StatusBadRequest)
+
+	kept := upload("duplicate=keep", http.StatusCreated)
+	if kept.ID == original.ID || kept.Filepath == original.Filepath {
+		t.Fatal(fmt.Errorf("Expected a separate book"))
+	}
+
+	base := fmt.Sprintf("http://%s:%d/books", viper.GetString("host"), viper.GetInt("port"))
+	resp, err := http.Get(base + "/duplicates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []*book.DuplicateGroup
+	err = json.NewDecoder(resp.Body).Decode(&groups)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, len(groups))
+	for i, g := range groups {
+		keys[i] = g.Key
+		if len(g.Books) != 2 {
+			t.Fatal(fmt.Errorf("Expected 2 books grouped by %s, got %d", g.Key, len(g.Books)))
+		}
+	}
+	if strings.Join(keys, ",") != "sha256,uid,titleAuthor" {
+		t.Fatal(fmt.Errorf("Unexpected duplicate groups %v", keys))
+	}
+
+	// Merging fills in metadata removed from the original
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/%s", base, original.ID), bytes.NewBufferString(`{"publisher": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	merged := upload("duplicate=merge", http.StatusOK)
+	if merged.ID != original.ID || merged.Publisher != original.Publisher {
+		t.Fatal(fmt.Errorf("Expected publisher %q merged into %s, got %q", original.Publisher, original.ID, merged.Publisher))
+	}
+
+	// Replacing keeps the ID of the oldest match
+	replaced := upload("duplicate=replace", http.StatusOK)
+	if replaced.ID != original.ID || replaced.Filepath != original.Filepath {
+		t.Fatal(fmt.Errorf("Expected %s replaced in place, got %s at %s", original.ID, replaced.ID, replaced.Filepath))
+	}
+
+	e, err := epub.OpenEpub(replaced.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	sum, err := e.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != original.Sha256 {
+		t.Fatal(fmt.Errorf("Epub was not replaced with the upload"))
+	}
+}
+
+func TestImportTooLarge(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("max_upload_mb", 1)
+	t.Cleanup(func() { viper.Set("max_upload_mb", 0) })
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Starts like an epub so only the size is wrong
+	path := filepath.Join("./testHome", "large.epub")
+	data := append([]byte{0x50, 0x4B, 0x03, 0x04}, make([]byte, 2<<20)...)
+	err = os.WriteFile(path, data, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal(fmt.Errorf("Expected status 413, got %d", resp.StatusCode))
+	}
+
+	// Books under the limit are still accepted
+	resp, err = uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(fmt.Errorf("Expected status 201, got %d", resp.StatusCode))
+	}
+
+	// No partial uploads are left behind
+	matches, err := filepath.Glob(filepath.Join(viper.GetString("library_path"), ".import-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Fatal(fmt.Errorf("Temp files left in library: %v", matches))
+	}
+}
+
+func TestImportBatch(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	addFile := func(name string, data []byte) {
+		part, err := writer.CreateFormFile("epub", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readFile := func(path string) []byte {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	addFile("MobyDick.epub", readFile("../test_data/MobyDick.epub"))
+	addFile("TheBrothersKaramazov.epub", readFile("../test_data/TheBrothersKaramazov.epub"))
+	addFile("broken.epub", []byte("not an epub"))
+
+	// Archive holding two new books and a duplicate
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	for _, name := range []string{"TheStoneAgeInNorthAmericaVol2.epub", "TheStonesOfVeniceVol2.epub", "MobyDick.epub"} {
+		f, err := zw.Create("books/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(readFile(filepath.Join("../test_data", name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	addFile("collection.zip", archive.Bytes())
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books/batch", viper.GetString("host"), viper.GetInt("port"))
+	resp, err := http.Post(addr, writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatal(fmt.Errorf("Unexpected status code %d", resp.StatusCode))
+	}
+
+	var results []*book.BatchResult
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make([]string, len(results))
+	outcomes := make(map[string]int)
+	for i, result := range results {
+		files[i] = result.File
+		outcomes[result.Outcome]++
+
+		if result.Outcome != "failed" && result.Book == nil {
+			t.Fatal(fmt.Errorf("No book in result for %s", result.File))
+		}
+	}
+
+	want := "MobyDick.epub,TheBrothersKaramazov.epub,broken.epub," +
+		"collection.zip/books/TheStoneAgeInNorthAmericaVol2.epub," +
+		"collection.zip/books/TheStonesOfVeniceVol2.epub," +
+		"collection.zip/books/MobyDick.epub"
+	if strings.Join(files, ",") != want {
+		t.Fatal(fmt.Errorf("Unexpected result order %v", files))
+	}
+
+	// Either copy of Moby Dick may be imported first
+	if outcomes["created"] != 4 || outcomes["duplicate"] != 1 || outcomes["failed"] != 1 {
+		t.Fatal(fmt.Errorf("Unexpected outcomes %v", outcomes))
+	}
+	if results[2].Outcome != "failed" || results[2].Error == "" {
+		t.Fatal(fmt.Errorf("Expected broken.epub to fail with a reason"))
+	}
+
+	// Nothing is left spooled in the library
+	matches, err := filepath.Glob(filepath.Join(viper.GetString("library_path"), ".batch-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Fatal(fmt.Errorf("Spool directories left in library: %v", matches))
+	}
+}
+
+func TestImportJobs(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+
+	readJob := func(resp *http.Response) *book.Job {
+		defer resp.Body.Close()
+		job := &book.Job{}
+		if err := json.NewDecoder(resp.Body).Decode(job); err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	queue := func(path string) *book.Job {
+		resp, err := uploadFileWithQuery(path, "async=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatal(fmt.Errorf("Expected status 202, got %d", resp.StatusCode))
+		}
+		job := readJob(resp)
+		if resp.Header.Get("Location") != "/jobs/"+job.ID.String() {
+			t.Fatal(fmt.Errorf("Unexpected Location %q", resp.Header.Get("Location")))
+		}
+		return job
+	}
+	waitForJob := func(id string) *book.Job {
+		for range 100 {
+			resp, err := http.Get(base + "/jobs/" + id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job := readJob(resp)
+			if job.State == book.JobSucceeded || job.State == book.JobFailed {
+				return job
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal(fmt.Errorf("Job %s did not finish", id))
+		return nil
+	}
+
+	broken := filepath.Join("./testHome", "broken.epub")
+	if err := os.WriteFile(broken, []byte("not an epub"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs queued before the runner starts are kept until it does, like
+	// after a restart
+	moby := queue("../test_data/MobyDick.epub")
+	failing := queue(broken)
+	if moby.State != book.JobQueued {
+		t.Fatal(fmt.Errorf("Expected queued job, got %s", moby.State))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go book.NewJobRunner(DB).Run(ctx)
+
+	moby = waitForJob(moby.ID.String())
+	if moby.State != book.JobSucceeded || moby.Done != 1 || moby.Total != 1 {
+		t.Fatal(fmt.Errorf("Unexpected job %+v", moby))
+	}
+	if len(moby.Results) != 1 || moby.Results[0].Outcome != "created" || moby.Results[0].Book == nil {
+		t.Fatal(fmt.Errorf("Unexpected job results %+v", moby.Results))
+	}
+
+	jobsDir := filepath.Join(viper.GetString("library_path"), ".jobs")
+	if _, err := os.Stat(filepath.Join(jobsDir, moby.ID.String())); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("Files of succeeded job were not removed"))
+	}
+
+	failing = waitForJob(failing.ID.String())
+	if failing.State != book.JobFailed || failing.Error == "" || failing.Results[0].Error == "" {
+		t.Fatal(fmt.Errorf("Expected job to fail with a reason, got %+v", failing))
+	}
+
+	resp, err := http.Get(base + "/jobs?state=failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs []*book.Job
+	err = json.NewDecoder(resp.Body).Decode(&jobs)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != failing.ID || resp.Header.Get("X-Total-Count") != "1" {
+		t.Fatal(fmt.Errorf("Expected only the failed job, got %d jobs", len(jobs)))
+	}
+
+	// Only failed jobs can be retried
+	resp, err = http.Post(base+"/jobs/"+moby.ID.String()+"/retry", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatal(fmt.Errorf("Expected status 409, got %d", resp.StatusCode))
+	}
+
+	resp, err = http.Post(base+"/jobs/"+failing.ID.String()+"/retry", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatal(fmt.Errorf("Expected status 202, got %d", resp.StatusCode))
+	}
+	readJob(resp)
+
+	failing = waitForJob(failing.ID.String())
+	if failing.State != book.JobFailed {
+		t.Fatal(fmt.Errorf("Expected retried job to fail again, got %s", failing.State))
+	}
+
+	req, err := http.NewRequest("DELETE", base+"/jobs/"+failing.ID.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal(fmt.Errorf("Expected status 204, got %d", resp.StatusCode))
+	}
+	if _, err := os.Stat(filepath.Join(jobsDir, failing.ID.String())); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("Files of deleted job were not removed"))
+	}
+
+	resp, err = http.Get(base + "/jobs/" + failing.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal(fmt.Errorf("Expected status 404, got %d", resp.StatusCode))
+	}
+}
+
+func TestResumeImportJob(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One epub at a time, so the job stops at the second one
+	viper.Set("import_workers", 1)
+	t.Cleanup(func() { viper.Set("import_workers", 0) })
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, name := range []string{"MobyDick.epub", "TheBrothersKaramazov.epub"} {
+		data, err := os.ReadFile(filepath.Join("../test_data", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := writer.CreateFormFile("epub", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	writer.Close()
+
+	// Duplicates are kept, so importing an epub twice would add a second book
+	resp, err := http.Post(base+"/books/batch?async=true&duplicate=keep", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &book.Job{}
+	err = json.NewDecoder(resp.Body).Decode(job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	getJob := func() *book.Job {
+		resp, err := http.Get(base + "/jobs/" + job.ID.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		j := &book.Job{}
+		if err := json.NewDecoder(resp.Body).Decode(j); err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	// Opening a fifo blocks until it is written to, which stands in for the
+	// server stopping in the middle of the job
+	spooled := filepath.Join(viper.GetString("library_path"), ".jobs", job.ID.String(), "1")
+	if err := os.Rename(spooled, spooled+".epub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(spooled, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go book.NewJobRunner(DB).Run(ctx)
+
+	interrupted := getJob()
+	for i := 0; interrupted.Done < 1 && i < 100; i++ {
+		time.Sleep(50 * time.Millisecond)
+		interrupted = getJob()
+	}
+	if interrupted.State != book.JobRunning || interrupted.Done != 1 || len(interrupted.Results) != 2 {
+		t.Fatal(fmt.Errorf("Expected the progress of the running job to be saved, got %+v", interrupted))
+	}
+	if interrupted.Results[0].Outcome != "created" || interrupted.Results[1].Outcome != "" {
+		t.Fatal(fmt.Errorf("Expected the result of the first epub only, got %+v %+v",
+			interrupted.Results[0], interrupted.Results[1]))
+	}
+	cancel()
+
+	// A restarted runner resumes the job without importing the first epub
+	// again. The blocked runner is left waiting on the removed fifo.
+	if err := os.Remove(spooled); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(spooled+".epub", spooled); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go book.NewJobRunner(DB).Run(ctx)
+
+	resumed := getJob()
+	for i := 0; resumed.State != book.JobSucceeded && resumed.State != book.JobFailed && i < 100; i++ {
+		time.Sleep(50 * time.Millisecond)
+		resumed = getJob()
+	}
+	if resumed.State != book.JobSucceeded || resumed.Done != 2 {
+		t.Fatal(fmt.Errorf("Expected the resumed job to succeed, got %+v", resumed))
+	}
+	if resumed.Results[0].Book.ID != interrupted.Results[0].Book.ID || resumed.Results[1].Outcome != "created" {
+		t.Fatal(fmt.Errorf("Unexpected results of the resumed job %+v %+v", resumed.Results[0], resumed.Results[1]))
+	}
+
+	var count int64
+	if err := DB.Model(&book.Book{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatal(fmt.Errorf("Expected each epub to be imported once, got %d books", count))
+	}
+}
+
+type streamEvent struct {
+	id   string
+	typ  string
+	data string
+}
+
+// Opens GET /events and returns a channel of the events received
+func openEventStream(t *testing.T, lastEventID string) <-chan *streamEvent {
+	return openEventStreamAs(t, lastEventID, nil)
+}
+
+// Opens GET /events with credentials added by setAuth, if not nil
+func openEventStreamAs(t *testing.T, lastEventID string, setAuth func(req *http.Request)) <-chan *streamEvent {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	addr := fmt.Sprintf("http://%s:%d/events", viper.GetString("host"), viper.GetInt("port"))
+	req, err := http.NewRequestWithContext(ctx, "GET", addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	if setAuth != nil {
+		setAuth(req)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal(fmt.Errorf("Unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type")))
+	}
+
+	events := make(chan *streamEvent)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+
+		scanner := bufio.NewScanner(resp.Body)
+		e := &streamEvent{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if e.typ != "" {
+					select {
+					case events <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+				e = &streamEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.typ = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan *streamEvent) *streamEvent {
+	e, ok := <-events
+	if !ok {
+		t.Fatal(fmt.Errorf("Event stream ended"))
+	}
+	return e
+}
+
+func TestEventStream(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := openEventStream(t, "")
+
+	resp, err := uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &book.Book{}
+	err = json.NewDecoder(resp.Body).Decode(b)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := nextEvent(t, events)
+	if created.typ != "book.created" || !strings.Contains(created.data, b.ID.String()) {
+		t.Fatal(fmt.Errorf("Expected book.created event for %s, got %+v", b.ID, created))
+	}
+
+	addr := fmt.Sprintf("http://%s:%d/books/%s", viper.GetString("host"), viper.GetInt("port"), b.ID)
+	req, err := http.NewRequest("DELETE", addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	deleted := nextEvent(t, events)
+	if deleted.typ != "book.deleted" || deleted.data != fmt.Sprintf(`{"id":"%s"}`, b.ID) {
+		t.Fatal(fmt.Errorf("Expected book.deleted event for %s, got %+v", b.ID, deleted))
+	}
+
+	// Reconnecting resumes after the last event received
+	resumed := nextEvent(t, openEventStream(t, created.id))
+	if resumed.id != deleted.id || resumed.typ != "book.deleted" {
+		t.Fatal(fmt.Errorf("Expected to resume with %s, got %+v", deleted.id, resumed))
+	}
+
+	// Events from before the server started can't be resumed
+	reset := nextEvent(t, openEventStream(t, "1"))
+	if reset.typ != "reset" {
+		t.Fatal(fmt.Errorf("Expected reset event, got %+v", reset))
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan *received, 10)
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- &received{header: r.Header, body: body}
+
+		// Fail the first delivery so it is retried later
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go webhook.NewDispatcher(DB).Run(ctx)
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+
+	resp, err := http.Post(base+"/webhooks", "application/json", strings.NewReader(`{"url": "ftp://example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal(fmt.Errorf("Expected status 422 for invalid url, got %d", resp.StatusCode))
+	}
+
+	body := fmt.Sprintf(`{"url": "%s", "secret": "s3cret"}`, receiver.URL)
+	resp, err = http.Post(base+"/webhooks", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID     string   `json:"id"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || created.Secret != "s3cret" {
+		t.Fatal(fmt.Errorf("Unexpected response %d %+v", resp.StatusCode, created))
+	}
+
+	nextDelivery := func() *received {
+		select {
+		case d := <-deliveries:
+			return d
+		case <-time.After(10 * time.Second):
+			t.Fatal(fmt.Errorf("No webhook delivery received"))
+			return nil
+		}
+	}
+	readDeliveries := func() []*webhook.Delivery {
+		resp, err := http.Get(base + "/webhooks/" + created.ID + "/deliveries")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var log []*webhook.Delivery
+		if err := json.NewDecoder(resp.Body).Decode(&log); err != nil {
+			t.Fatal(err)
+		}
+		return log
+	}
+	// The outcome is recorded after the response is received
+	waitForDeliveries := func(done func(log []*webhook.Delivery) bool) []*webhook.Delivery {
+		for range 100 {
+			if log := readDeliveries(); done(log) {
+				return log
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatal(fmt.Errorf("Unexpected delivery log %+v", readDeliveries()))
+		return nil
+	}
+
+	resp, err = uploadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b book.Book
+	err = json.NewDecoder(resp.Body).Decode(&b)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := nextDelivery()
+	if d.header.Get(webhook.EventHeader) != "book.created" {
+		t.Fatal(fmt.Errorf("Expected book.created delivery, got %s", d.header.Get(webhook.EventHeader)))
+	}
+	if d.header.Get(webhook.SignatureHeader) != webhook.Sign("s3cret", d.body) {
+		t.Fatal(fmt.Errorf("Invalid signature %s", d.header.Get(webhook.SignatureHeader)))
+	}
+	if !strings.Contains(string(d.body), b.ID.String()) {
+		t.Fatal(fmt.Errorf("Payload doesn't hold the book: %s", d.body))
+	}
+
+	waitForDeliveries(func(log []*webhook.Delivery) bool {
+		return len(log) == 1 && log[0].Attempts == 1 && log[0].StatusCode == 500 &&
+			log[0].State == webhook.DeliveryPending && log[0].NextAttempt.After(time.Now())
+	})
+
+	addr := fmt.Sprintf("%s/books/%s", base, b.ID)
+	req, err := http.NewRequest("PATCH", addr, strings.NewReader(`{"title": "Moby Dick"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	d = nextDelivery()
+	if d.header.Get(webhook.EventHeader) != "book.updated" {
+		t.Fatal(fmt.Errorf("Expected book.updated delivery, got %s", d.header.Get(webhook.EventHeader)))
+	}
+
+	waitForDeliveries(func(log []*webhook.Delivery) bool {
+		return len(log) == 2 && log[0].Event == "book.updated" && log[0].State == webhook.DeliverySucceeded
+	})
+
+	// Only subscribed events are delivered
+	req, err = http.NewRequest("PATCH", base+"/webhooks/"+created.ID, strings.NewReader(`{"events": ["book.deleted"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Errorf("Expected status 200, got %d", resp.StatusCode))
+	}
+
+	req, err = http.NewRequest("PATCH", addr, strings.NewReader(`{"title": "Moby-Dick"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req, err = http.NewRequest("DELETE", addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	d = nextDelivery()
+	if d.header.Get(webhook.EventHeader) != "book.deleted" {
+		t.Fatal(fmt.Errorf("Expected book.deleted delivery, got %s", d.header.Get(webhook.EventHeader)))
+	}
+
+	req, err = http.NewRequest("DELETE", base+"/webhooks/"+created.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal(fmt.Errorf("Expected status 204, got %d", resp.StatusCode))
+	}
+
+	resp, err = http.Get(base + "/webhooks/" + created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal(fmt.Errorf("Expected status 404, got %d", resp.StatusCode))
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("auth_required", true)
+	t.Cleanup(func() { viper.Set("auth_required", false) })
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+
+	// Sends a request with optional credentials and returns the status
+	do := func(method string, path string, body string, setAuth func(req *http.Request)) *http.Response {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if setAuth != nil {
+			setAuth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expectStatus := func(resp *http.Response, status int) {
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("Expected status %d for %s %s, got %d",
+				status, resp.Request.Method, resp.Request.URL.Path, resp.StatusCode))
+		}
+	}
+
+	expectStatus(do("GET", "/books", "", nil), http.StatusUnauthorized)
+
+	resp := do("GET", "/opds", "", nil)
+	expectStatus(resp, http.StatusUnauthorized)
+	if !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Fatal(fmt.Errorf("Expected a Basic challenge from OPDS"))
+	}
+
+	// The first user can be created without logging in, later ones can't
+	account := `{"username": "reader", "password": "correct horse"}`
+	expectStatus(do("POST", "/users", `{"username": "reader", "password": "short"}`, nil), http.StatusUnprocessableEntity)
+	expectStatus(do("POST", "/users", account, nil), http.StatusCreated)
+	expectStatus(do("POST", "/users", `{"username": "other", "password": "correct horse"}`, nil), http.StatusUnauthorized)
+
+	expectStatus(do("POST", "/auth/login", `{"username": "reader", "password": "wrong password"}`, nil), http.StatusUnauthorized)
+
+	resp = do("POST", "/auth/login", account, nil)
+	expectStatus(resp, http.StatusOK)
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == user.SessionCookie {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly {
+		t.Fatal(fmt.Errorf("Expected an HttpOnly session cookie"))
+	}
+	withCookie := func(req *http.Request) { req.AddCookie(session) }
+
+	expectStatus(do("GET", "/books", "", withCookie), http.StatusOK)
+
+	resp = do("POST", "/auth/tokens", `{"name": "script"}`, withCookie)
+	var token struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	expectStatus(resp, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withBearer := func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token.Token) }
+	expectStatus(do("GET", "/books", "", withBearer), http.StatusOK)
+
+	// OPDS readers can log in with the password or a token
+	expectStatus(do("GET", "/opds", "", func(req *http.Request) { req.SetBasicAuth("reader", "correct horse") }), http.StatusOK)
+	expectStatus(do("GET", "/opds", "", func(req *http.Request) { req.SetBasicAuth("reader", token.Token) }), http.StatusOK)
+	expectStatus(do("GET", "/opds", "", func(req *http.Request) { req.SetBasicAuth("reader", "wrong password") }), http.StatusUnauthorized)
+
+	expectStatus(do("DELETE", "/auth/tokens/"+token.ID, "", withCookie), http.StatusNoContent)
+	expectStatus(do("GET", "/books", "", withBearer), http.StatusUnauthorized)
+
+	expectStatus(do("POST", "/auth/logout", "", withCookie), http.StatusNoContent)
+	expectStatus(do("GET", "/books", "", withCookie), http.StatusUnauthorized)
+
+	// A stale cookie doesn't hide other credentials
+	expectStatus(do("GET", "/opds", "", func(req *http.Request) {
+		withCookie(req)
+		req.SetBasicAuth("reader", "correct horse")
+	}), http.StatusOK)
+
+	// Changing your own password takes the current one
+	resp = do("POST", "/auth/login", account, nil)
+	var reader user.User
+	err = json.NewDecoder(resp.Body).Decode(&reader)
+	expectStatus(resp, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withPassword := func(password string) func(req *http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth("reader", password) }
+	}
+	path := "/users/" + reader.ID.String() + "/password"
+	expectStatus(do("PUT", path, `{"password": "battery staple"}`, withPassword("correct horse")), http.StatusForbidden)
+	expectStatus(do("PUT", path, `{"password": "battery staple", "currentPassword": "wrong password"}`, withPassword("correct horse")), http.StatusForbidden)
+	expectStatus(do("PUT", path, `{"password": "battery staple", "currentPassword": "correct horse"}`, withPassword("correct horse")), http.StatusNoContent)
+	expectStatus(do("GET", "/books", "", withPassword("battery staple")), http.StatusOK)
+
+	// Nobody can change passwords anonymously, even without required logins
+	viper.Set("auth_required", false)
+	expectStatus(do("PUT", path, `{"password": "correct horse"}`, nil), http.StatusUnauthorized)
+	expectStatus(do("GET", "/books", "", withPassword("battery staple")), http.StatusOK)
+}
+
+func TestRolesAndVisibility(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("auth_required", true)
+	t.Cleanup(func() { viper.Set("auth_required", false) })
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+	const password = "correct horse"
+
+	// Sends a request as username and returns the response
+	do := func(username string, method string, path string, body io.Reader, contentType string) *http.Response {
+		req, err := http.NewRequest(method, base+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expectStatus := func(resp *http.Response, status int) {
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("Expected status %d for %s %s, got %d",
+				status, resp.Request.Method, resp.Request.URL.Path, resp.StatusCode))
+		}
+	}
+	createUser := func(as string, body string) string {
+		resp := do(as, "POST", "/users", strings.NewReader(body), "application/json")
+		var u user.User
+		err := json.NewDecoder(resp.Body).Decode(&u)
+		expectStatus(resp, http.StatusCreated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.ID.String()
+	}
+	upload := func(as string, path string) *http.Response {
+		body, ct, err := makePOSTBody(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return do(as, "POST", "/books", body, ct)
+	}
+	readBook := func(resp *http.Response) *book.Book {
+		b := &book.Book{}
+		err := json.NewDecoder(resp.Body).Decode(b)
+		expectStatus(resp, http.StatusCreated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// The first user is an admin whatever it asks for
+	adminID := createUser("", `{"username": "admin", "password": "correct horse", "role": "reader"}`)
+	createUser("admin", `{"username": "editor", "password": "correct horse", "role": "editor"}`)
+	kidID := createUser("admin", `{"username": "kid", "password": "correct horse"}`)
+
+	expectStatus(upload("kid", "../test_data/MobyDick.epub"), http.StatusForbidden)
+	moby := readBook(upload("editor", "../test_data/MobyDick.epub"))
+	karamazov := readBook(upload("editor", "../test_data/TheBrothersKaramazov.epub"))
+	if len(moby.Subjects) == 0 {
+		t.Fatal(fmt.Errorf("Test book has no subjects"))
+	}
+
+	// Readers can read but not change books
+	expectStatus(do("kid", "GET", "/books/"+karamazov.ID.String()+"/file", nil, ""), http.StatusOK)
+	expectStatus(do("kid", "PATCH", "/books/"+moby.ID.String(), strings.NewReader(`{"title": "Moby Dick"}`), "application/json"), http.StatusForbidden)
+	expectStatus(do("kid", "DELETE", "/books/"+moby.ID.String(), nil, ""), http.StatusForbidden)
+	expectStatus(do("editor", "PATCH", "/books/"+moby.ID.String(), strings.NewReader(`{"title": "Moby Dick"}`), "application/json"), http.StatusOK)
+
+	// Only admins manage users, webhooks and the library
+	expectStatus(do("editor", "GET", "/webhooks", nil, ""), http.StatusForbidden)
+	expectStatus(do("editor", "POST", "/users", strings.NewReader(`{"username": "x", "password": "correct horse"}`), "application/json"), http.StatusForbidden)
+	expectStatus(do("admin", "GET", "/webhooks", nil, ""), http.StatusOK)
+
+	// Limit the kid to the shelf of the first book
+	tags := fmt.Sprintf(`{"allowedTags": [%q]}`, moby.Subjects[0])
+	expectStatus(do("admin", "PATCH", "/users/"+kidID, strings.NewReader(tags), "application/json"), http.StatusOK)
+
+	// Events about hidden books aren't streamed
+	events := openEventStreamAs(t, "", func(req *http.Request) { req.SetBasicAuth("kid", password) })
+	expectStatus(do("editor", "PATCH", "/books/"+karamazov.ID.String(), strings.NewReader(`{"title": "Karamazov"}`), "application/json"), http.StatusOK)
+	expectStatus(do("editor", "PATCH", "/books/"+moby.ID.String(), strings.NewReader(`{"title": "Moby-Dick"}`), "application/json"), http.StatusOK)
+	if e := nextEvent(t, events); e.typ != "book.updated" || !strings.Contains(e.data, moby.ID.String()) {
+		t.Fatal(fmt.Errorf("Expected only the update of the allowed book, got %+v", e))
+	}
+
+	resp := do("kid", "GET", "/books", nil, "")
+	var books []*book.Book
+	err = json.NewDecoder(resp.Body).Decode(&books)
+	expectStatus(resp, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].ID != moby.ID {
+		t.Fatal(fmt.Errorf("Expected only the allowed book, got %d books", len(books)))
+	}
+
+	expectStatus(do("kid", "GET", "/books/"+karamazov.ID.String(), nil, ""), http.StatusNotFound)
+	expectStatus(do("kid", "GET", "/books/"+karamazov.ID.String()+"/file", nil, ""), http.StatusNotFound)
+	expectStatus(do("kid", "GET", "/books/"+karamazov.ID.String()+"/cover", nil, ""), http.StatusNotFound)
+
+	resp = do("kid", "GET", "/opds/books", nil, "")
+	feed, _ := io.ReadAll(resp.Body)
+	expectStatus(resp, http.StatusOK)
+	if !strings.Contains(string(feed), moby.ID.String()) || strings.Contains(string(feed), karamazov.ID.String()) {
+		t.Fatal(fmt.Errorf("OPDS feed shows books outside the allowed tags"))
+	}
+
+	// Uploads duplicating a hidden book are rejected without revealing it,
+	// also when imported in the background
+	createUser("admin", fmt.Sprintf(`{"username": "intern", "password": "correct horse", "role": "editor", "allowedTags": [%q]}`, moby.Subjects[0]))
+	body, ct, err := makePOSTBody("../test_data/TheBrothersKaramazov.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = do("intern", "POST", "/books?duplicate=replace", body, ct)
+	hidden, _ := io.ReadAll(resp.Body)
+	expectStatus(resp, http.StatusConflict)
+	if len(hidden) != 0 || resp.Header.Get("Location") != "" {
+		t.Fatal(fmt.Errorf("Conflict reveals the hidden book: %s", hidden))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go book.NewJobRunner(DB).Run(ctx)
+
+	body, ct, err = makePOSTBody("../test_data/TheBrothersKaramazov.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = do("intern", "POST", "/books?duplicate=merge&async=true", body, ct)
+	job := &book.Job{}
+	err = json.NewDecoder(resp.Body).Decode(job)
+	expectStatus(resp, http.StatusAccepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 100 {
+		if job.State == book.JobSucceeded || job.State == book.JobFailed {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+		resp = do("admin", "GET", "/jobs/"+job.ID.String(), nil, "")
+		err = json.NewDecoder(resp.Body).Decode(job)
+		expectStatus(resp, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(job.Results) != 1 || job.Results[0].Outcome != "duplicate" || job.Results[0].Book != nil {
+		t.Fatal(fmt.Errorf("Expected a duplicate without the hidden book, got %+v", job))
+	}
+
+	// The last admin can't be demoted
+	expectStatus(do("admin", "PATCH", "/users/"+adminID, strings.NewReader(`{"role": "editor"}`), "application/json"), http.StatusConflict)
+	expectStatus(do("admin", "PATCH", "/users/"+kidID, strings.NewReader(`{"role": "owner"}`), "application/json"), http.StatusUnprocessableEntity)
+
+	// Everything belonging to a deleted user goes with it
+	kid := uuid.MustParse(kidID)
+	collection := &book.Collection{ID: uuid.New(), UserID: kid, Name: "Favourites"}
+	rows := []any{
+		&book.ReadingState{UserID: kid, BookID: moby.ID, Status: book.StatusReading},
+		&book.ReadingEntry{ID: uuid.New(), UserID: kid, BookID: moby.ID, Status: book.StatusReading},
+		&book.SyncProgress{UserID: kid, Document: "document", BookID: &moby.ID},
+		&annotation.Annotation{ID: uuid.New(), UserID: kid, BookID: moby.ID, Type: annotation.TypeBookmark},
+		collection,
+		&book.CollectionBook{CollectionID: collection.ID, BookID: moby.ID},
+	}
+	for _, row := range rows {
+		if err := DB.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectStatus(do("admin", "DELETE", "/users/"+kidID, nil, ""), http.StatusNoContent)
+	for _, row := range rows {
+		var n int64
+		if err := DB.Model(row).Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Fatal(fmt.Errorf("Expected the %T rows of the deleted user to be deleted, found %d", row, n))
+		}
+	}
+}
+
+func TestKOReaderSync(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err := startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+	const password = "correct horse"
+	key := fmt.Sprintf("%x", md5.Sum([]byte(password)))
+
+	// Sends a request as KOReader does, with the username and key headers
+	sync := func(method string, path string, body string, key string) *http.Response {
+		req, err := http.NewRequest(method, base+"/kosync"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/vnd.koreader.v1+json")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-User", "reader")
+		req.Header.Set("X-Auth-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expectStatus := func(resp *http.Response, status int) {
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("Expected status %d for %s %s, got %d",
+				status, resp.Request.Method, resp.Request.URL.Path, resp.StatusCode))
+		}
+	}
+	getBook := func(id string) *book.Book {
+		req, err := http.NewRequest("GET", base+"/books/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("reader", password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &book.Book{}
+		err = json.NewDecoder(resp.Body).Decode(b)
+		expectStatus(resp, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	resp, err := http.Post(base+"/users", "application/json", strings.NewReader(`{"username": "reader", "password": "correct horse"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(resp, http.StatusCreated)
+
+	expectStatus(sync("GET", "/users/auth", "", "wrong"), http.StatusUnauthorized)
+	expectStatus(sync("GET", "/users/auth", "", key), http.StatusOK)
+	expectStatus(sync("POST", "/users/create", `{"username": "reader", "password": "`+key+`"}`, ""), http.StatusPaymentRequired)
+
+	body, ct, err := makePOSTBody("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Post(base+"/books", ct, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := &book.Book{}
+	err = json.NewDecoder(resp.Body).Decode(uploaded)
+	expectStatus(resp, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The document hash KOReader computes for the downloaded file
+	e, err := epub.OpenEpub(uploaded.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	document, err := e.PartialMD5()
+	e.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.PartialMD5 != document {
+		t.Fatal(fmt.Errorf("Expected document hash %s, got %s", document, uploaded.PartialMD5))
+	}
+
+	// Books imported before the hash was stored are hashed on startup
+	if err := DB.Model(&book.Book{}).Where("id = ?", uploaded.ID).Update("partial_md5", "").Error; err != nil {
+		t.Fatal(err)
+	}
+	gone := &book.Book{ID: uuid.New(), Filepath: filepath.Join("./testHome", "gone.epub")}
+	if err := DB.Create(gone).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := book.BackfillPartialMD5(context.Background(), DB); err != nil {
+		t.Fatal(err)
+	}
+	migrated := &book.Book{}
+	if err := DB.Where("id = ?", uploaded.ID).First(migrated).Error; err != nil {
+		t.Fatal(err)
+	}
+	if migrated.PartialMD5 != document {
+		t.Fatal(fmt.Errorf("Expected the missing hash to be backfilled as %s, got %q", document, migrated.PartialMD5))
+	}
+
+	// Books whose epub is missing aren't retried on the next start
+	if err := DB.Where("id = ?", gone.ID).First(gone).Error; err != nil {
+		t.Fatal(err)
+	}
+	if gone.PartialMD5 == "" {
+		t.Fatal(fmt.Errorf("Expected the book with a missing epub to be marked"))
+	}
+	if err := DB.Delete(gone).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	resp = sync("GET", "/syncs/progress/"+document, "", key)
+	got, _ := io.ReadAll(resp.Body)
+	expectStatus(resp, http.StatusOK)
+	if strings.TrimSpace(string(got)) != "{}" {
+		t.Fatal(fmt.Errorf("Expected no progress, got %s", got))
+	}
+
+	expectStatus(sync("PUT", "/syncs/progress", `{"progress": "/body/DocFragment[3]", "percentage": 0.25, "device": "Kobo"}`, key), http.StatusForbidden)
+	push := fmt.Sprintf(`{"document": %q, "progress": "/body/DocFragment[3]/body/p[2]/text().0", "percentage": 0.25, "device": "Kobo", "device_id": "ABC"}`, document)
+	expectStatus(sync("PUT", "/syncs/progress", push, "wrong"), http.StatusUnauthorized)
+	expectStatus(sync("PUT", "/syncs/progress", push, key), http.StatusOK)
+
+	resp = sync("GET", "/syncs/progress/"+document, "", key)
+	var progress book.SyncProgress
+	err = json.NewDecoder(resp.Body).Decode(&progress)
+	expectStatus(resp, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Percentage != 0.25 || progress.Device != "Kobo" || progress.DeviceID != "ABC" || progress.Timestamp == 0 {
+		t.Fatal(fmt.Errorf("Unexpected progress %+v", progress))
+	}
+
+	b := getBook(uploaded.ID.String())
+	if b.Progress == nil || b.Progress.Percentage != 0.25 || b.Progress.Document != document {
+		t.Fatal(fmt.Errorf("Expected the synced progress on the book, got %+v", b.Progress))
+	}
+
+	// Editing the metadata rewrites the epub, devices holding the old file
+	// still sync to the book
+	req, err := http.NewRequest("PATCH", base+"/books/"+uploaded.ID.String(), strings.NewReader(`{"title": "Moby Dick"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(resp, http.StatusOK)
+
+	b = getBook(uploaded.ID.String())
+	if b.PartialMD5 == "" || b.PartialMD5 == document {
+		t.Fatal(fmt.Errorf("Expected a new document hash after rewriting the epub"))
+	}
+
+	push = strings.Replace(push, "0.25", "0.5", 1)
+	expectStatus(sync("PUT", "/syncs/progress", push, key), http.StatusOK)
+	b = getBook(uploaded.ID.String())
+	if b.Progress == nil || b.Progress.Percentage != 0.5 {
+		t.Fatal(fmt.Errorf("Expected the old document's progress on the book, got %+v", b.Progress))
+	}
+}
+
+func TestReadingState(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+
+	do := func(method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	// Decodes the json body of resp into v after checking its status
+	decode := func(resp *http.Response, status int, v any) {
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("Expected status %d for %s %s, got %d",
+				status, resp.Request.Method, resp.Request.URL, resp.StatusCode))
+		}
+		if v == nil {
+			return
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload := func(path string) *book.Book {
+		body, ct, err := makePOSTBody(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(base+"/books", ct, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &book.Book{}
+		decode(resp, http.StatusCreated, b)
+		return b
+	}
+	// Returns the IDs of the books listed at path
+	listIDs := func(path string) []uuid.UUID {
+		var books []*book.Book
+		decode(do("GET", path, ""), http.StatusOK, &books)
+		ids := make([]uuid.UUID, len(books))
+		for i, b := range books {
+			ids[i] = b.ID
+		}
+		return ids
+	}
+
+	moby := upload("../test_data/MobyDick.epub")
+	karamazov := upload("../test_data/TheBrothersKaramazov.epub")
+
+	state := &book.ReadingState{}
+	decode(do("GET", "/reading/"+moby.ID.String(), ""), http.StatusOK, state)
+	if state.Status != book.StatusUnread {
+		t.Fatal(fmt.Errorf("Expected a new book to be unread, got %q", state.Status))
+	}
+
+	decode(do("PATCH", "/reading/"+moby.ID.String(), `{"status": "skimming"}`), http.StatusUnprocessableEntity, nil)
+	decode(do("PATCH", "/reading/"+moby.ID.String(), `{"cfi": "/6/4!/4/2"}`), http.StatusUnprocessableEntity, nil)
+	decode(do("PATCH", "/reading/"+moby.ID.String(), `{"percentage": 1.5}`), http.StatusUnprocessableEntity, nil)
+	decode(do("PATCH", "/reading/"+moby.ID.String(), `{"spineIndex": 100000}`), http.StatusUnprocessableEntity, nil)
+	decode(do("PATCH", "/reading/"+uuid.New().String(), `{"percentage": 0.5}`), http.StatusNotFound, nil)
+
+	// Moving into an unread book starts reading it
+	decode(do("PATCH", "/reading/"+moby.ID.String(), `{"spineIndex": 2, "percentage": 0.3}`), http.StatusOK, state)
+	if state.Status != book.StatusReading || state.StartedAt == nil || state.SpineIndex == nil || *state.SpineIndex != 2 {
+		t.Fatal(fmt.Errorf("Expected the book to be read from spine item 2, got %+v", state))
+	}
+
+	if ids := listIDs("/books?status=reading"); len(ids) != 1 || ids[0] != moby.ID {
+		t.Fatal(fmt.Errorf("Expected only the book being read, got %v", ids))
+	}
+	if ids := listIDs("/books?status=unread"); len(ids) != 1 || ids[0] != karamazov.ID {
+		t.Fatal(fmt.Errorf("Expected only the unread book, got %v", ids))
+	}
+	decode(do("GET", "/books?status=skimming", ""), http.StatusBadRequest, nil)
+
+	decode(do("PATCH", "/reading/"+moby.ID.String(), `{"status": "finished"}`), http.StatusOK, state)
+	if state.Percentage != 1 || state.FinishedAt == nil {
+		t.Fatal(fmt.Errorf("Expected a finished book at the end, got %+v", state))
+	}
+
+	var states []*book.ReadingState
+	decode(do("GET", "/reading?status=finished", ""), http.StatusOK, &states)
+	if len(states) != 1 || states[0].BookID != moby.ID {
+		t.Fatal(fmt.Errorf("Expected one finished book, got %d", len(states)))
+	}
+
+	var history []*book.ReadingEntry
+	decode(do("GET", "/reading/history?book="+moby.ID.String(), ""), http.StatusOK, &history)
+	if len(history) != 2 || history[0].Status != book.StatusFinished || history[1].Status != book.StatusReading {
+		t.Fatal(fmt.Errorf("Expected the history of reading and finishing the book, got %d entries", len(history)))
+	}
+
+	b := &book.Book{}
+	decode(do("GET", "/books/"+moby.ID.String(), ""), http.StatusOK, b)
+	if b.Reading == nil || b.Reading.Status != book.StatusFinished {
+		t.Fatal(fmt.Errorf("Expected the reading state on the book, got %+v", b.Reading))
+	}
+
+	// Marking it unread forgets the position
+	state = &book.ReadingState{}
+	decode(do("PATCH", "/reading/"+moby.ID.String(), `{"status": "unread"}`), http.StatusOK, state)
+	if state.Percentage != 0 || state.StartedAt != nil || state.SpineIndex != nil {
+		t.Fatal(fmt.Errorf("Expected an unread book without a position, got %+v", state))
+	}
+	if ids := listIDs("/books?status=unread"); len(ids) != 2 {
+		t.Fatal(fmt.Errorf("Expected both books to be unread, got %v", ids))
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("auth_required", true)
+	t.Cleanup(func() { viper.Set("auth_required", false) })
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+
+	// Sends a request as username and returns the response
+	do := func(username string, method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(username, "correct horse")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	// Checks the status of resp and decodes its json body into v
+	decode := func(resp *http.Response, status int, v any) {
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("Expected status %d for %s %s, got %d",
+				status, resp.Request.Method, resp.Request.URL, resp.StatusCode))
+		}
+		if v == nil {
+			return
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Post(base+"/users", "application/json", strings.NewReader(`{"username": "admin", "password": "correct horse"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(resp, http.StatusCreated, nil)
+	decode(do("admin", "POST", "/users", `{"username": "reader", "password": "correct horse"}`), http.StatusCreated, nil)
+
+	body, ct, err := makePOSTBody("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", base+"/books", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", ct)
+	req.SetBasicAuth("admin", "correct horse")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moby := &book.Book{}
+	decode(resp, http.StatusCreated, moby)
+	path := "/books/" + moby.ID.String() + "/annotations"
+
+	// Readers annotate their own copy
+	invalid := []string{
+		`{"type": "scribble", "cfi": "epubcfi(/6/6!/4/2/1:5)"}`,
+		`{"type": "bookmark"}`,
+		`{"type": "bookmark", "cfi": "/6/6!/4/2/1:5"}`,
+		`{"type": "bookmark", "cfi": "epubcfi(/6/10000!/4/2/1:5)"}`,
+		`{"type": "highlight", "cfi": "epubcfi(/6/6!/4/2/1:5)"}`,
+		`{"type": "note", "cfi": "epubcfi(/6/6!/4/2/1:5)"}`,
+		`{"type": "highlight", "cfi": "epubcfi(/6/6!/4/2,/1:0,/1:20)", "color": "chartreuse"}`,
+	}
+	for _, a := range invalid {
+		decode(do("reader", "POST", path, a), http.StatusUnprocessableEntity, nil)
+	}
+
+	highlight := &annotation.Annotation{}
+	decode(do("reader", "POST", path, `{"type": "highlight", "cfi": "epubcfi(/6/6!/4/2,/1:0,/1:20)",
+		"text": "Call me Ishmael.", "note": "The narrator introduces himself", "color": "yellow", "tags": ["openings", " openings "]}`),
+		http.StatusCreated, highlight)
+	if highlight.SpineIndex != 2 || len(highlight.Tags) != 1 {
+		t.Fatal(fmt.Errorf("Expected a highlight in spine item 2 with one tag, got %+v", highlight))
+	}
+	bookmark := &annotation.Annotation{}
+	decode(do("reader", "POST", path, `{"type": "bookmark", "cfi": "epubcfi(/6/4!/4/2/1:0)"}`), http.StatusCreated, bookmark)
+	decode(do("admin", "POST", path, `{"type": "note", "cfi": "epubcfi(/6/6!/4/2/1:5)", "note": "Whales everywhere"}`), http.StatusCreated, nil)
+
+	// Each user only sees their own annotations, in reading order
+	var annotations []*annotation.Annotation
+	decode(do("reader", "GET", path, ""), http.StatusOK, &annotations)
+	if len(annotations) != 2 || annotations[0].ID != bookmark.ID || annotations[1].ID != highlight.ID {
+		t.Fatal(fmt.Errorf("Expected the reader's bookmark and highlight, got %d annotations", len(annotations)))
+	}
+	decode(do("admin", "GET", path+"/"+highlight.ID.String(), ""), http.StatusNotFound, nil)
+
+	decode(do("reader", "GET", "/annotations?q=narrator", ""), http.StatusOK, &annotations)
+	if len(annotations) != 1 || annotations[0].ID != highlight.ID {
+		t.Fatal(fmt.Errorf("Expected the note to match, got %d annotations", len(annotations)))
+	}
+	decode(do("reader", "GET", "/annotations?q=whales", ""), http.StatusOK, &annotations)
+	if len(annotations) != 0 {
+		t.Fatal(fmt.Errorf("Expected no match among the reader's notes, got %d", len(annotations)))
+	}
+	decode(do("reader", "GET", path+"?type=bookmark", ""), http.StatusOK, &annotations)
+	if len(annotations) != 1 || annotations[0].ID != bookmark.ID {
+		t.Fatal(fmt.Errorf("Expected only the bookmark, got %d annotations", len(annotations)))
+	}
+
+	decode(do("reader", "PATCH", path+"/"+highlight.ID.String(), `{"note": "Ishmael speaks", "tags": ["narration"]}`), http.StatusOK, highlight)
+	decode(do("reader", "GET", "/annotations?q=narrator", ""), http.StatusOK, &annotations)
+	if len(annotations) != 0 {
+		t.Fatal(fmt.Errorf("Expected the edited note to no longer match"))
+	}
+	decode(do("reader", "GET", path+"?tag=narration", ""), http.StatusOK, &annotations)
+	if len(annotations) != 1 {
+		t.Fatal(fmt.Errorf("Expected the retagged highlight, got %d annotations", len(annotations)))
+	}
+
+	// Rewriting the metadata keeps the anchors valid
+	decode(do("admin", "PATCH", "/books/"+moby.ID.String(), `{"title": "Moby Dick"}`), http.StatusOK, nil)
+	decode(do("reader", "PATCH", path+"/"+highlight.ID.String(), `{"color": "#ffcc00"}`), http.StatusOK, highlight)
+	if highlight.SpineIndex != 2 {
+		t.Fatal(fmt.Errorf("Expected the highlight to stay in spine item 2, got %d", highlight.SpineIndex))
+	}
+
+	resp = do("reader", "GET", path+"/export", "")
+	markdown, _ := io.ReadAll(resp.Body)
+	decode(resp, http.StatusOK, nil)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/markdown") ||
+		!strings.Contains(string(markdown), "> Call me Ishmael.") || !strings.Contains(string(markdown), "Ishmael speaks") {
+		t.Fatal(fmt.Errorf("Unexpected markdown export %s", markdown))
+	}
+
+	resp = do("reader", "GET", path+"/export?format=jsonld", "")
+	var collection struct {
+		Context string `json:"@context"`
+		Type    string `json:"type"`
+		Total   int    `json:"total"`
+		First   struct {
+			Items []struct {
+				Motivation string `json:"motivation"`
+				Target     struct {
+					Selector []struct {
+						Type  string `json:"type"`
+						Value string `json:"value"`
+					} `json:"selector"`
+				} `json:"target"`
+			} `json:"items"`
+		} `json:"first"`
+	}
+	decode(resp, http.StatusOK, &collection)
+	if collection.Context != "http://www.w3.org/ns/anno.jsonld" || collection.Type != "AnnotationCollection" || collection.Total != 2 {
+		t.Fatal(fmt.Errorf("Unexpected web annotation collection %+v", collection))
+	}
+	item := collection.First.Items[1]
+	if item.Motivation != "highlighting" || item.Target.Selector[0].Value != highlight.CFI {
+		t.Fatal(fmt.Errorf("Expected the highlight selected by its cfi, got %+v", item))
+	}
+
+	decode(do("reader", "DELETE", path+"/"+bookmark.ID.String(), ""), http.StatusNoContent, nil)
+	decode(do("reader", "GET", path+"/"+bookmark.ID.String(), ""), http.StatusNotFound, nil)
+}
+
+func TestCollections(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+
+	do := func(method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	// Checks the status of resp and decodes its json body into v
+	decode := func(resp *http.Response, status int, v any) {
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("Expected status %d for %s %s, got %d",
+				status, resp.Request.Method, resp.Request.URL, resp.StatusCode))
+		}
+		if v == nil {
+			return
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload := func(path string) *book.Book {
+		body, ct, err := makePOSTBody(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(base+"/books", ct, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &book.Book{}
+		decode(resp, http.StatusCreated, b)
+		return b
+	}
+	// Returns the IDs of the books listed at path
+	listIDs := func(path string) []uuid.UUID {
+		var books []*book.Book
+		decode(do("GET", path, ""), http.StatusOK, &books)
+		ids := make([]uuid.UUID, len(books))
+		for i, b := range books {
+			ids[i] = b.ID
+		}
+		return ids
+	}
+
+	moby := upload("../test_data/MobyDick.epub")
+	karamazov := upload("../test_data/TheBrothersKaramazov.epub")
+	venice := upload("../test_data/TheStonesOfVeniceVol2.epub")
+
+	invalid := []string{
+		`{"name": " "}`,
+		`{"name": "Smart", "rules": {"field": "filePath", "op": "eq", "value": "x"}}`,
+		`{"name": "Smart", "rules": {"field": "subject", "op": "lt", "value": "x"}}`,
+		`{"name": "Smart", "rules": {"field": "seriesNum", "op": "gt", "value": "first"}}`,
+		`{"name": "Smart", "rules": {"all": []}}`,
+	}
+	for _, c := range invalid {
+		decode(do("POST", "/collections", c), http.StatusUnprocessableEntity, nil)
+	}
+
+	// Manual collections keep the order books are added in
+	manual := &book.Collection{}
+	decode(do("POST", "/collections", `{"name": "Favourites"}`), http.StatusCreated, manual)
+	path := "/collections/" + manual.ID.String()
+
+	decode(do("POST", path+"/books", fmt.Sprintf(`{"bookIds": [%q, %q]}`, karamazov.ID, moby.ID)), http.StatusOK, manual)
+	decode(do("POST", path+"/books", fmt.Sprintf(`{"bookIds": [%q], "position": 0}`, venice.ID)), http.StatusOK, manual)
+	if ids := listIDs(path + "/books"); manual.BookCount != 3 || len(ids) != 3 ||
+		ids[0] != venice.ID || ids[1] != karamazov.ID || ids[2] != moby.ID {
+		t.Fatal(fmt.Errorf("Expected the books in the order they were added, got %v", ids))
+	}
+	decode(do("POST", path+"/books", fmt.Sprintf(`{"bookIds": [%q]}`, uuid.New())), http.StatusUnprocessableEntity, nil)
+
+	decode(do("PUT", path+"/books", fmt.Sprintf(`{"bookIds": [%q, %q]}`, moby.ID, venice.ID)), http.StatusOK, manual)
+	if ids := listIDs(path + "/books"); len(ids) != 2 || ids[0] != moby.ID || ids[1] != venice.ID {
+		t.Fatal(fmt.Errorf("Expected the reordered books, got %v", ids))
+	}
+	decode(do("DELETE", path+"/books/"+venice.ID.String(), ""), http.StatusNoContent, nil)
+	if ids := listIDs("/books?collection=" + manual.ID.String()); len(ids) != 1 || ids[0] != moby.ID {
+		t.Fatal(fmt.Errorf("Expected only the remaining book, got %v", ids))
+	}
+	decode(do("PATCH", path, `{"rules": {"field": "title", "op": "contains", "value": "Venice"}}`), http.StatusUnprocessableEntity, nil)
+
+	// Smart collections hold the books matching their rules
+	smart := &book.Collection{}
+	decode(do("POST", "/collections", `{"name": "English fiction", "rules": {"all": [
+		{"field": "language", "op": "eq", "value": "EN"},
+		{"field": "subject", "op": "contains", "value": "fiction"}]}}`), http.StatusCreated, smart)
+	if smart.BookCount != 2 {
+		t.Fatal(fmt.Errorf("Expected two english novels, got %d", smart.BookCount))
+	}
+	if ids := listIDs("/collections/" + smart.ID.String() + "/books?sort=author"); len(ids) != 2 || ids[0] != karamazov.ID || ids[1] != moby.ID {
+		t.Fatal(fmt.Errorf("Expected the novels by author, got %v", ids))
+	}
+	decode(do("POST", "/collections/"+smart.ID.String()+"/books", fmt.Sprintf(`{"bookIds": [%q]}`, venice.ID)), http.StatusConflict, nil)
+
+	decode(do("PATCH", "/collections/"+smart.ID.String(), `{"rules": {"any": [
+		{"field": "author", "op": "startsWith", "value": "john"},
+		{"field": "subject", "op": "eq", "value": "sea stories"}]}}`), http.StatusOK, smart)
+	if ids := listIDs("/books?collection=" + smart.ID.String() + "&sort=title"); len(ids) != 2 || ids[0] != moby.ID || ids[1] != venice.ID {
+		t.Fatal(fmt.Errorf("Expected the books matching the new rules, got %v", ids))
+	}
+	if ids := listIDs("/books?collection=" + smart.ID.String() + "&collection=" + manual.ID.String()); len(ids) != 2 {
+		t.Fatal(fmt.Errorf("Expected the books in either collection, got %v", ids))
+	}
+	if ids := listIDs("/books?collection=" + uuid.New().String()); len(ids) != 0 {
+		t.Fatal(fmt.Errorf("Expected no books in an unknown collection, got %v", ids))
+	}
+
+	var collections []*book.Collection
+	decode(do("GET", "/collections", ""), http.StatusOK, &collections)
+	if len(collections) != 2 || collections[0].ID != smart.ID || collections[1].ID != manual.ID {
+		t.Fatal(fmt.Errorf("Expected both collections by name, got %d", len(collections)))
+	}
+
+	resp := do("GET", "/opds/collections", "")
+	feed, _ := io.ReadAll(resp.Body)
+	decode(resp, http.StatusOK, nil)
+	if !strings.Contains(string(feed), fmt.Sprintf(`href="/opds/books?collection=%s"`, manual.ID)) {
+		t.Fatal(fmt.Errorf("Missing collection entry: %s", feed))
+	}
+
+	decode(do("DELETE", path, ""), http.StatusNoContent, nil)
+	decode(do("GET", path, ""), http.StatusNotFound, nil)
+	if ids := listIDs("/books"); len(ids) != 3 {
+		t.Fatal(fmt.Errorf("Expected the books to stay in the library, got %v", ids))
+	}
+}
+
+func TestAuthors(t *testing.T) {
+	err := makeTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = startTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+
+	do := func(method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	// Checks the status of resp and decodes its json body into v
+	decode := func(resp *http.Response, status int, v any) {
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(fmt.Errorf("Expected status %d for %s %s, got %d",
+				status, resp.Request.Method, resp.Request.URL, resp.StatusCode))
+		}
+		if v == nil {
+			return
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload := func(path string) *book.Book {
+		body, ct, err := makePOSTBody(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(base+"/books", ct, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &book.Book{}
+		decode(resp, http.StatusCreated, b)
+		return b
+	}
+	// Returns the names of the authors listed at path
+	listNames := func(path string) []string {
+		var authors book.Authors
+		decode(do("GET", path, ""), http.StatusOK, &authors)
+		names := make([]string, len(authors))
+		for i, a := range authors {
+			names[i] = a.Name
+		}
+		return names
+	}
+	// Returns the author named name
+	find := func(name string) *book.Author {
+		var authors book.Authors
+		decode(do("GET", "/authors?q="+url.QueryEscape(name), ""), http.StatusOK, &authors)
+		for _, a := range authors {
+			if a.Name == name {
+				return a
+			}
+		}
+		t.Fatal(fmt.Errorf("Expected an author named %q, got %v", name, authors))
+		return nil
+	}
+
+	moby := upload("../test_data/MobyDick.epub")
+	karamazov := upload("../test_data/TheBrothersKaramazov.epub")
+	upload("../test_data/TheStonesOfVeniceVol2.epub")
+
+	// Translators are authors too, listed by sort name
+	names := listNames("/authors")
+	expected := []string{"Fyodor Dostoyevsky", "Constance Garnett", "Herman Melville", "John Ruskin"}
+	if !slices.Equal(names, expected) {
+		t.Fatal(fmt.Errorf("Expected authors %v, got %v", expected, names))
+	}
+	if names := listNames("/authors?role=trl"); !slices.Equal(names, []string{"Constance Garnett"}) {
+		t.Fatal(fmt.Errorf("Expected only the translator, got %v", names))
+	}
+	if garnett := find("Constance Garnett"); garnett.SortName != "Garnett, Constance" || garnett.BookCount != 1 {
+		t.Fatal(fmt.Errorf("Expected a guessed sort name and one book, got %+v", garnett))
+	}
+
+	// Every creator of a book is linked, in order
+	updated := &book.Book{}
+	body := `{"creators": [{"name": "Herman Melville", "fileAs": "Melville, Herman", "role": "aut"},
+		{"name": "Fyodor Dostoevsky", "fileAs": "Dostoevsky, Fyodor", "role": "aut"}]}`
+	decode(do("PATCH", "/books/"+moby.ID.String(), body), http.StatusOK, updated)
+	if updated.Author != "Herman Melville" || len(updated.Creators) != 2 {
+		t.Fatal(fmt.Errorf("Expected two creators, got %+v", updated.Creators))
+	}
+	misspelt := find("Fyodor Dostoevsky")
+	dostoyevsky := find("Fyodor Dostoyevsky")
+
+	decode(do("POST", "/authors/"+dostoyevsky.ID.String()+"/merge", `{"authorIds": []}`), http.StatusUnprocessableEntity, nil)
+	decode(do("POST", "/authors/"+dostoyevsky.ID.String()+"/merge",
+		fmt.Sprintf(`{"authorIds": [%q]}`, dostoyevsky.ID)), http.StatusUnprocessableEntity, nil)
+	decode(do("POST", "/authors/"+dostoyevsky.ID.String()+"/merge",
+		fmt.Sprintf(`{"authorIds": [%q]}`, uuid.New())), http.StatusUnprocessableEntity, nil)
+
+	merged := &book.Author{}
+	decode(do("POST", "/authors/"+dostoyevsky.ID.String()+"/merge",
+		fmt.Sprintf(`{"authorIds": [%q]}`, misspelt.ID)), http.StatusOK, merged)
+	if merged.BookCount != 2 || !slices.Equal(merged.Aliases, []string{"Fyodor Dostoevsky"}) {
+		t.Fatal(fmt.Errorf("Expected the misspelling as an alias, got %+v", merged))
+	}
+	decode(do("GET", "/authors/"+misspelt.ID.String(), ""), http.StatusNotFound, nil)
+
+	// The merge rewrote the epub of the book crediting the misspelling
+	decode(do("GET", "/books/"+moby.ID.String(), ""), http.StatusOK, updated)
+	if c := updated.Creators[1]; c.Name != "Fyodor Dostoyevsky" || c.FileAs != "Dostoyevsky, Fyodor" {
+		t.Fatal(fmt.Errorf("Expected the merged author to be credited, got %+v", c))
+	}
+	e, err := epub.OpenEpub(updated.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creators := e.ExtractMetadata().Creators
+	e.Close()
+	if len(creators) != 2 || creators[1].Name != "Fyodor Dostoyevsky" {
+		t.Fatal(fmt.Errorf("Expected the epub to credit the merged author, got %+v", creators))
+	}
+
+	var books []*book.Book
+	decode(do("GET", "/authors/"+dostoyevsky.ID.String()+"/books?sort=title", ""), http.StatusOK, &books)
+	if len(books) != 2 || books[0].ID != moby.ID || books[1].ID != karamazov.ID {
+		t.Fatal(fmt.Errorf("Expected both books of the author, got %v", books))
+	}
+
+	// Aliases link to the author they were merged into
+	body = `{"creators": [{"name": "Fyodor Dostoevsky", "role": "aut"}]}`
+	decode(do("PATCH", "/books/"+moby.ID.String(), body), http.StatusOK, updated)
+	if names := listNames("/authors?q=Fyodor"); !slices.Equal(names, []string{"Fyodor Dostoyevsky"}) {
+		t.Fatal(fmt.Errorf("Expected the alias to link to the merged author, got %v", names))
+	}
+
+	// Renaming keeps the old name as an alias and rewrites contributors
+	garnett := find("Constance Garnett")
+	decode(do("PATCH", "/authors/"+garnett.ID.String(), `{"name": "Herman Melville"}`), http.StatusConflict, nil)
+	decode(do("PATCH", "/authors/"+garnett.ID.String(), `{"name": " "}`), http.StatusUnprocessableEntity, nil)
+	renamed := &book.Author{}
+	decode(do("PATCH", "/authors/"+garnett.ID.String(), `{"name": "Constance Clara Garnett"}`), http.StatusOK, renamed)
+	if renamed.SortName != "Garnett, Constance" || !slices.Equal(renamed.Aliases, []string{"Constance Garnett"}) {
+		t.Fatal(fmt.Errorf("Expected the old name as an alias, got %+v", renamed))
+	}
+	decode(do("GET", "/books/"+karamazov.ID.String(), ""), http.StatusOK, updated)
+	if len(updated.Contributors) != 1 || updated.Contributors[0].Name != "Constance Clara Garnett" {
+		t.Fatal(fmt.Errorf("Expected the renamed translator, got %+v", updated.Contributors))
+	}
+}
@@ -0,0 +1,264 @@
+// Handles the routes for listing, renaming and merging the authors of books.
+
+package author
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Service represents a service for managing authors.
+type Service struct {
+	repository *book.Repository
+	books      *book.BookService
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: book.NewRepository(db),
+		books:      book.NewBookService(db),
+	}
+}
+
+// An author along with the books whose epub couldn't be rewritten
+type authorResult struct {
+	*book.Author
+	FailedBooks []uuid.UUID `json:"failedBooks,omitempty"`
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Book -> ListAuthors()
+	r.Get("/", s.HandleGetAuthors)
+
+	r.Route("/{id}", func(r chi.Router) {
+
+		// Book -> ReadAuthor()
+		r.Get("/", s.HandleGetAuthor)
+
+		// Book -> UpdateAuthor()
+		r.Patch("/", s.HandleUpdateAuthor)
+
+		// Book -> List() of the author
+		r.Get("/books", s.HandleGetAuthorBooks)
+
+		// Book -> MergeAuthors()
+		r.Post("/merge", s.HandleMergeAuthors)
+	})
+}
+
+// Handler for listing authors at /authors, by sort name
+// Accepts ?role= to list only e.g. translators (trl), ?q= to match part of
+// a name or alias, and ?limit= and ?offset= like GET /books.
+func (s *Service) HandleGetAuthors(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts, err := book.ParseListOptions(query)
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	authors, total, err := s.repository.For(r).ListAuthors(query.Get("role"), query.Get("q"), opts.Limit, opts.Offset)
+	if err != nil {
+		log.Printf("error reading authors %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(authors)
+	if err != nil {
+		log.Printf("error marshalling authors into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Handler for an author at /authors/{id}
+func (s *Service) HandleGetAuthor(w http.ResponseWriter, r *http.Request) {
+	author := s.readAuthor(w, r)
+	if author == nil {
+		return
+	}
+
+	j, err := json.Marshal(author)
+	if err != nil {
+		log.Printf("error marshalling author into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for renaming an author at /authors/{id} from a partial json body
+// with its name and sortName. The old name becomes an alias and the epubs
+// of its books are rewritten with the new one.
+func (s *Service) HandleUpdateAuthor(w http.ResponseWriter, r *http.Request) {
+	author := s.readAuthor(w, r)
+	if author == nil {
+		return
+	}
+
+	update := &book.AuthorUpdate{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(update); err != nil {
+		log.Printf("error decoding author from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	bookIDs, err := s.repository.For(r).UpdateAuthor(author, update)
+	if errors.Is(err, book.ErrAuthorExists) {
+		log.Printf("error updating author %v", err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if errors.Is(err, book.ErrAuthorNoName) {
+		log.Printf("error updating author %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("error updating author %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeAuthor(w, author, s.books.RewriteAuthor(author, bookIDs))
+}
+
+// Handler for the books of an author at /authors/{id}/books
+// Accepts the same filters, sorting and pagination as GET /books.
+func (s *Service) HandleGetAuthorBooks(w http.ResponseWriter, r *http.Request) {
+	author := s.readAuthor(w, r)
+	if author == nil {
+		return
+	}
+
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	opts.Reader = book.ReaderID(r)
+	opts.AuthorIDs = []uuid.UUID{author.ID}
+
+	books, total, err := s.repository.For(r).List(opts)
+	if err != nil {
+		log.Printf("error reading rows %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(books)
+	if err != nil {
+		log.Printf("error marshalling books into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Handler for merging authors into the author at /authors/{id}/merge
+// Accepts json with the authorIds to merge, e.g. pen names or misspellings.
+// Their names become aliases and the epubs of their books are rewritten to
+// credit the author.
+func (s *Service) HandleMergeAuthors(w http.ResponseWriter, r *http.Request) {
+	target := s.readAuthor(w, r)
+	if target == nil {
+		return
+	}
+
+	var body struct {
+		AuthorIDs []uuid.UUID `json:"authorIds"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		log.Printf("error decoding authors from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body.AuthorIDs) == 0 {
+		log.Printf("no authors to merge into %v", target.ID)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	repo := s.repository.For(r)
+	sources := make(book.Authors, 0, len(body.AuthorIDs))
+	for _, id := range body.AuthorIDs {
+		source, err := repo.ReadAuthor(id)
+		if err != nil {
+			log.Printf("error finding author %v to merge: %v", id, err)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		sources = append(sources, source)
+	}
+
+	bookIDs, err := repo.MergeAuthors(target, sources)
+	if errors.Is(err, book.ErrMergeIntoSelf) {
+		log.Printf("error merging authors %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("error merging authors %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeAuthor(w, target, s.books.RewriteAuthor(target, bookIDs))
+}
+
+// Responds with author and the books that failed to be rewritten
+func (s *Service) writeAuthor(w http.ResponseWriter, author *book.Author, failed []uuid.UUID) {
+	j, err := json.Marshal(&authorResult{Author: author, FailedBooks: failed})
+	if err != nil {
+		log.Printf("error marshalling author into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Reads the author in the URL, responding 404 Not Found and returning nil
+// if there is none the user may see
+func (s *Service) readAuthor(w http.ResponseWriter, r *http.Request) *book.Author {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	author, err := s.repository.For(r).ReadAuthor(UUID)
+	if err != nil {
+		log.Printf("error finding author: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	return author
+}
@@ -0,0 +1,421 @@
+// Authors of books, linked from the creators and contributors of their
+// metadata. Authors are matched by normalized name, and merged authors keep
+// their names as aliases so later imports link to the merged author.
+
+package book
+
+import (
+	"errors"
+	"log"
+	"nubayrah/epub"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrMergeIntoSelf = errors.New("an author can't be merged into itself")
+	ErrAuthorExists  = errors.New("another author has this name")
+	ErrAuthorNoName  = errors.New("author name must not be empty")
+)
+
+const (
+	RoleAuthor   = "aut" // Role of creators whose metadata doesn't give one
+	roleProducer = "bkp" // Software that produced the epub, such as calibre
+)
+
+type Author struct {
+	ID        uuid.UUID `json:"id" gorm:"<-:create"`
+	Name      string    `json:"name"`
+	SortName  string    `json:"sortName" gorm:"index"`
+	Aliases   []string  `json:"aliases" gorm:"-"`   // Other names linking to the author
+	BookCount int64     `json:"bookCount" gorm:"-"` // Books the user may see
+	CreatedAt time.Time `json:"createdAt" gorm:"autoCreateTime"`
+}
+
+type Authors []*Author
+
+// A name an author is known by, including its own
+type AuthorName struct {
+	Normalized string    `gorm:"primaryKey"` // See normalizeName
+	AuthorID   uuid.UUID `gorm:"index"`
+	Name       string
+}
+
+// Links a book to one of its creators or contributors
+type BookAuthor struct {
+	BookID   uuid.UUID `gorm:"primaryKey"`
+	Position int       `gorm:"primaryKey"` // Creators first, in the order of the metadata
+	AuthorID uuid.UUID `gorm:"index"`
+	Role     string    `gorm:"index"`
+}
+
+// Fields of an author that can be set by PATCH /authors/{id}
+type AuthorUpdate struct {
+	Name     *string `json:"name"`
+	SortName *string `json:"sortName"`
+}
+
+// Links the books added before authors were to their authors
+func MigrateAuthors(db *gorm.DB) error {
+	books := make(Books, 0)
+	err := db.Unscoped().Where("id NOT IN (SELECT book_id FROM book_authors)").Find(&books).Error
+	if err != nil {
+		return err
+	}
+
+	r := NewRepository(db)
+	for _, b := range books {
+		if err := r.linkAuthors(b); err != nil {
+			return err
+		}
+	}
+
+	if len(books) > 0 {
+		log.Printf("linked %d books to their authors", len(books))
+	}
+	return nil
+}
+
+// Guesses `Last, First` from a name without a file-as
+func sortName(name string) string {
+	name = strings.TrimSpace(name)
+	i := strings.LastIndex(name, " ")
+	if i < 0 || strings.Contains(name, ",") {
+		return name
+	}
+	return name[i+1:] + ", " + name[:i]
+}
+
+// Returns the author known by name, creating it with fileAs as its sort name
+// if there is none
+func (r *Repository) findOrCreateAuthor(name string, fileAs string) (*Author, error) {
+	key := normalizeName(name)
+
+	names := make([]*AuthorName, 0, 1)
+	if err := r.db.Where("normalized = ?", key).Limit(1).Find(&names).Error; err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		author := &Author{}
+		return author, r.db.Where("id = ?", names[0].AuthorID).First(author).Error
+	}
+
+	if fileAs == "" {
+		fileAs = sortName(name)
+	}
+	author := &Author{ID: uuid.New(), Name: strings.TrimSpace(name), SortName: fileAs}
+	if err := r.db.Create(author).Error; err != nil {
+		return nil, err
+	}
+	return author, r.db.Create(&AuthorName{Normalized: key, AuthorID: author.ID, Name: author.Name}).Error
+}
+
+// Replaces the links of b with its creators and contributors
+func (r *Repository) linkAuthors(b *Book) error {
+	if err := r.db.Where("book_id = ?", b.ID).Delete(&BookAuthor{}).Error; err != nil {
+		return err
+	}
+
+	type credit struct{ name, fileAs, role string }
+	credits := make([]credit, 0)
+	for _, c := range b.AllCreators() {
+		role := c.Role
+		if role == "" {
+			role = RoleAuthor
+		}
+		credits = append(credits, credit{c.Name, c.FileAs, role})
+	}
+	for _, c := range b.Contributors {
+		if c.Role == roleProducer {
+			continue
+		}
+		credits = append(credits, credit{c.Name, "", c.Role})
+	}
+
+	links := make([]*BookAuthor, 0, len(credits))
+	for _, c := range credits {
+		if normalizeName(c.name) == "" {
+			continue
+		}
+		author, err := r.findOrCreateAuthor(c.name, c.fileAs)
+		if err != nil {
+			return err
+		}
+		links = append(links, &BookAuthor{BookID: b.ID, Position: len(links), AuthorID: author.ID, Role: c.role})
+	}
+
+	if len(links) == 0 {
+		return nil
+	}
+	return r.db.Create(&links).Error
+}
+
+// Limits tx to authors credited on a book the repository may read, in role
+// unless it is empty
+func (r *Repository) creditedAuthors(tx *gorm.DB, role string) *gorm.DB {
+	books := r.visible(r.db.Model(&Book{}).
+		Select("1").
+		Joins("JOIN book_authors ON book_authors.book_id = books.id").
+		Where("book_authors.author_id = authors.id"))
+	if role != "" {
+		books = books.Where("book_authors.role = ?", role)
+	}
+	return tx.Where("EXISTS (?)", books)
+}
+
+// Returns a page of the authors credited on books the repository may read,
+// by sort name, along with the total number of authors. Role limits the
+// authors to those credited in that role, query to those with a name or
+// alias containing it.
+func (r *Repository) ListAuthors(role string, query string, limit int, offset int) (Authors, int64, error) {
+	tx := r.creditedAuthors(r.db.Model(&Author{}), role)
+	if query != "" {
+		like := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query) + "%"
+		tx = tx.Where(`EXISTS (SELECT 1 FROM author_names WHERE author_names.author_id = authors.id AND author_names.name LIKE ? ESCAPE '\')`, like)
+	}
+
+	var total int64
+	if err := tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	authors := make(Authors, 0)
+	tx = tx.Order("sort_name COLLATE NOCASE").Order("id")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	if err := tx.Offset(offset).Find(&authors).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return authors, total, r.loadAuthorDetails(authors)
+}
+
+// Reads an author credited on a book the repository may read
+func (r *Repository) ReadAuthor(id uuid.UUID) (*Author, error) {
+	author := &Author{}
+	if err := r.creditedAuthors(r.db, "").Where("id = ?", id).First(author).Error; err != nil {
+		return nil, err
+	}
+
+	return author, r.loadAuthorDetails(Authors{author})
+}
+
+// Sets the aliases and number of books of authors
+func (r *Repository) loadAuthorDetails(authors Authors) error {
+	if len(authors) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(authors))
+	for i, a := range authors {
+		ids[i] = a.ID
+	}
+
+	names := make([]*AuthorName, 0)
+	if err := r.db.Where("author_id IN ?", ids).Order("name").Find(&names).Error; err != nil {
+		return err
+	}
+
+	counts := make([]*struct {
+		AuthorID uuid.UUID
+		Count    int64
+	}, 0)
+	err := r.visible(r.db.Model(&Book{}).
+		Select("book_authors.author_id, COUNT(DISTINCT books.id) AS count").
+		Joins("JOIN book_authors ON book_authors.book_id = books.id").
+		Where("book_authors.author_id IN ?", ids).
+		Group("book_authors.author_id")).
+		Scan(&counts).Error
+	if err != nil {
+		return err
+	}
+
+	for _, a := range authors {
+		a.Aliases = make([]string, 0)
+		for _, n := range names {
+			if n.AuthorID == a.ID && n.Name != a.Name {
+				a.Aliases = append(a.Aliases, n.Name)
+			}
+		}
+		for _, c := range counts {
+			if c.AuthorID == a.ID {
+				a.BookCount = c.Count
+			}
+		}
+	}
+
+	return nil
+}
+
+// Renames an author and records the new name, the old one stays an alias.
+// Names of other authors are rejected, those are merged instead. Returns
+// the books crediting the author to rewrite.
+func (r *Repository) UpdateAuthor(author *Author, update *AuthorUpdate) ([]uuid.UUID, error) {
+	if update.Name != nil {
+		author.Name = strings.TrimSpace(*update.Name)
+	}
+	if update.SortName != nil {
+		author.SortName = strings.TrimSpace(*update.SortName)
+	}
+	if normalizeName(author.Name) == "" {
+		return nil, ErrAuthorNoName
+	}
+	if author.SortName == "" {
+		author.SortName = sortName(author.Name)
+	}
+
+	var bookIDs []uuid.UUID
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		repo := &Repository{db: tx}
+		var taken int64
+		err := tx.Model(&AuthorName{}).
+			Where("normalized = ? AND author_id != ?", normalizeName(author.Name), author.ID).
+			Count(&taken).Error
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrAuthorExists
+		}
+
+		bookIDs, err = repo.authorBookIDs([]uuid.UUID{author.ID})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&Author{}).Select("name", "sort_name").Where("id = ?", author.ID).Updates(author).Error
+		if err != nil {
+			return err
+		}
+		return repo.addAuthorName(author.ID, author.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bookIDs, r.loadAuthorDetails(Authors{author})
+}
+
+// Merges sources into target. The books crediting them credit target, and
+// their names become aliases of target. Returns the books to rewrite.
+func (r *Repository) MergeAuthors(target *Author, sources Authors) ([]uuid.UUID, error) {
+	ids := make([]uuid.UUID, len(sources))
+	for i, s := range sources {
+		if s.ID == target.ID {
+			return nil, ErrMergeIntoSelf
+		}
+		ids[i] = s.ID
+	}
+
+	var bookIDs []uuid.UUID
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		repo := &Repository{db: tx}
+		var err error
+		bookIDs, err = repo.authorBookIDs(ids)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(&BookAuthor{}).Where("author_id IN ?", ids).Update("author_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&AuthorName{}).Where("author_id IN ?", ids).Update("author_id", target.ID).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&Author{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bookIDs, r.loadAuthorDetails(Authors{target})
+}
+
+// Returns the books, including those in the trash, crediting any of authors
+func (r *Repository) authorBookIDs(authors []uuid.UUID) ([]uuid.UUID, error) {
+	ids := make([]uuid.UUID, 0)
+	err := r.db.Model(&BookAuthor{}).Distinct("book_id").Where("author_id IN ?", authors).Pluck("book_id", &ids).Error
+	return ids, err
+}
+
+// Makes name link to an author
+func (r *Repository) addAuthorName(authorID uuid.UUID, name string) error {
+	return r.db.Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&AuthorName{Normalized: normalizeName(name), AuthorID: authorID, Name: name}).Error
+}
+
+// Replaces the names of the creators and contributors of b linked to author
+// with the author's name. Returns whether b changed.
+func (r *Repository) creditAuthor(b *Book, author *Author) (bool, error) {
+	names := make([]string, 0)
+	err := r.db.Model(&AuthorName{}).Where("author_id = ?", author.ID).Pluck("normalized", &names).Error
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	creators := make([]epub.Creator, 0)
+	for _, c := range b.AllCreators() {
+		if slices.Contains(names, normalizeName(c.Name)) {
+			changed = changed || c.Name != author.Name || c.FileAs != author.SortName
+			c.Name, c.FileAs = author.Name, author.SortName
+		}
+		// Merged authors may now appear twice
+		if slices.ContainsFunc(creators, func(o epub.Creator) bool { return o.Name == c.Name && o.Role == c.Role }) {
+			changed = true
+			continue
+		}
+		creators = append(creators, c)
+	}
+	for i, c := range b.Contributors {
+		if slices.Contains(names, normalizeName(c.Name)) && c.Name != author.Name {
+			b.Contributors[i].Name = author.Name
+			changed = true
+		}
+	}
+
+	b.Creators = creators
+	b.Author, b.AuthorSort = creators[0].Name, creators[0].FileAs
+	return changed, nil
+}
+
+// Rewrites the metadata of books to credit author under its current name,
+// in both their rows and their epubs. Books that fail are logged and
+// returned.
+func (a *BookService) RewriteAuthor(author *Author, bookIDs []uuid.UUID) []uuid.UUID {
+	failed := make([]uuid.UUID, 0)
+	for _, id := range bookIDs {
+		err := a.rewriteAuthor(author, id)
+		if err != nil {
+			log.Printf("error rewriting author of book %v: %v", id, err)
+			failed = append(failed, id)
+		}
+	}
+
+	return failed
+}
+
+func (a *BookService) rewriteAuthor(author *Author, id uuid.UUID) error {
+	b, err := a.repository.Read(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Books in the trash keep their epub as it is, the name they credit
+		// still links to the author
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	changed, err := a.repository.creditAuthor(b, author)
+	if err != nil || !changed {
+		return err
+	}
+
+	return a.writeMetadata(b)
+}
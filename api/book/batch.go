@@ -0,0 +1,281 @@
+// Imports many epubs from a single request at /books/batch.
+
+package book
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"nubayrah/epub"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	config "github.com/spf13/viper"
+)
+
+// Result of importing one file of a batch
+type BatchResult struct {
+	File    string `json:"file"`
+	Outcome string `json:"outcome"`        // created, duplicate, replaced, merged or failed
+	Book    *Book  `json:"book,omitempty"` // The existing book for duplicates, unless it is hidden
+	Error   string `json:"error,omitempty"`
+}
+
+// An epub in a batch upload waiting to be imported
+type batchItem struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+// Number of epubs imported at the same time from config.import_workers
+func importWorkers() int {
+	return max(1, config.GetInt("import_workers"))
+}
+
+// Handler for importing many epubs at /books/batch
+// Accepts any number of files in a multipart form, files ending in .zip are
+// archives of epubs. Duplicates are handled according to ?duplicate= like
+// single imports. Responds with a result for every epub in upload order, or
+// with ?async=true, 202 Accepted and the job importing them.
+func (a *BookService) HandleImportBatch(w http.ResponseWriter, r *http.Request) {
+	onDuplicate := r.URL.Query().Get("duplicate")
+	if onDuplicate == "" {
+		onDuplicate = duplicateReject
+	}
+	if !slices.Contains(duplicatePolicies, onDuplicate) {
+		log.Printf("unknown duplicate policy %q", onDuplicate)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		log.Printf("error reading batch upload %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		a.queueBatch(w, r, reader, onDuplicate)
+		return
+	}
+
+	// Parts can only be read in order, so they are spooled to disk to be
+	// imported concurrently
+	spool, err := os.MkdirTemp(config.GetString("library_path"), ".batch-*")
+	if err != nil {
+		log.Printf("error creating batch spool directory %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(spool)
+
+	files, err := spoolParts(reader, spool)
+	if err != nil {
+		log.Printf("error reading batch upload %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	items, results, closeArchives := spooledItems(spool, files, true)
+	defer closeArchives()
+
+	a.importBatch(a.repository.For(r), items, results, onDuplicate, nil)
+
+	j, err := json.Marshal(results)
+	if err != nil {
+		log.Printf("error marshalling batch results into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Copies the file parts of a batch upload into dir as 0, 1, ... in upload
+// order. Files that can't be spooled are listed with their error.
+func spoolParts(reader *multipart.Reader, dir string) ([]*JobFile, error) {
+	files := make([]*JobFile, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FileName() == "" {
+			continue
+		}
+
+		file := &JobFile{Name: part.FileName()}
+		err = spoolPart(part, filepath.Join(dir, strconv.Itoa(len(files))))
+		if err != nil {
+			file.Error = err.Error()
+		}
+		files = append(files, file)
+	}
+}
+
+// Returned when a file is larger than config.max_upload_mb
+type tooLargeError struct {
+	limit int64
+}
+
+func (e *tooLargeError) Error() string {
+	return fmt.Sprintf("larger than %d bytes", e.limit)
+}
+
+// Copies a part of a batch upload to dst, enforcing config.max_upload_mb
+func spoolPart(part io.Reader, dst string) error {
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	limit := maxUploadSize()
+	if limit > 0 {
+		// Read one byte more than allowed to tell if the part is too large
+		part = io.LimitReader(part, limit+1)
+	}
+
+	n, err := io.Copy(file, part)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && n > limit {
+		return &tooLargeError{limit: limit}
+	}
+
+	return file.Close()
+}
+
+// Lists the epubs to import from files spooled into dir by spoolParts, with
+// an empty result for each. Files ending in .zip are opened as archives of
+// epubs when archives is set. Files that can't be imported get a nil item
+// and a failed result. The returned function closes the opened archives.
+func spooledItems(dir string, files []*JobFile, archives bool) ([]*batchItem, []*BatchResult, func()) {
+	items := make([]*batchItem, 0)
+	results := make([]*BatchResult, 0)
+	opened := make([]io.Closer, 0)
+	fail := func(name string, err error) {
+		results = append(results, &BatchResult{File: name, Outcome: outcomeFailed, Error: err.Error()})
+		items = append(items, nil)
+	}
+
+	for i, file := range files {
+		if file.Error != "" {
+			fail(file.Name, errors.New(file.Error))
+			continue
+		}
+
+		spooled := filepath.Join(dir, strconv.Itoa(i))
+		if !archives || !strings.EqualFold(path.Ext(file.Name), ".zip") {
+			items = append(items, &batchItem{name: file.Name, open: func() (io.ReadCloser, error) {
+				return os.Open(spooled)
+			}})
+			results = append(results, &BatchResult{File: file.Name})
+			continue
+		}
+
+		archive, err := zip.OpenReader(spooled)
+		if err != nil {
+			fail(file.Name, err)
+			continue
+		}
+		opened = append(opened, archive)
+
+		for _, f := range archive.File {
+			if f.FileInfo().IsDir() || !strings.EqualFold(path.Ext(f.Name), ".epub") {
+				continue
+			}
+
+			entry := file.Name + "/" + f.Name
+			if limit := maxUploadSize(); limit > 0 && f.UncompressedSize64 > uint64(limit) {
+				fail(entry, &tooLargeError{limit: limit})
+				continue
+			}
+
+			items = append(items, &batchItem{name: entry, open: f.Open})
+			results = append(results, &BatchResult{File: entry})
+		}
+	}
+
+	return items, results, func() {
+		for _, c := range opened {
+			c.Close()
+		}
+	}
+}
+
+// Imports items through repo with a pool of importWorkers goroutines,
+// replacing the result at the same index. Nil items already failed. onDone, if not nil, is
+// called with the index of each item once its result is set. Results are set
+// and onDone called one item at a time, so onDone may read every result.
+func (a *BookService) importBatch(repo *Repository, items []*batchItem, results []*BatchResult, onDuplicate string, onDone func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for range min(importWorkers(), max(1, len(items))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result := &BatchResult{File: items[i].name}
+				book, outcome, err := a.importItem(repo, items[i], onDuplicate)
+				if err != nil {
+					log.Printf("error importing %s: %v", items[i].name, err)
+					result.Outcome = outcomeFailed
+					result.Error = err.Error()
+				} else {
+					result.Outcome = outcome
+					result.Book = book
+				}
+
+				mu.Lock()
+				results[i] = result
+				if onDone != nil {
+					onDone(i)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i, item := range items {
+		if item != nil {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (a *BookService) importItem(repo *Repository, item *batchItem, onDuplicate string) (*Book, string, error) {
+	file, err := item.open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	e, err := epub.Parse(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("not a valid epub: %w", err)
+	}
+	defer e.Close()
+
+	return a.importEpub(repo, e, onDuplicate, saveEpub)
+}
@@ -0,0 +1,405 @@
+// User-defined collections of books. Manual collections hold the books added
+// to them in the order the user gives, smart collections every book matching
+// their rules.
+
+package book
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSmartCollection = errors.New("books of smart collections can't be changed by hand")
+	ErrUnknownBooks    = errors.New("some books don't exist")
+)
+
+// Deepest nesting of rule groups accepted in a smart collection
+const maxRuleDepth = 5
+
+type Collection struct {
+	ID          uuid.UUID `json:"id" gorm:"<-:create"`
+	UserID      uuid.UUID `json:"-" gorm:"index"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Rules       *Rule     `json:"rules" gorm:"serializer:json"` // nil for manual collections
+	BookCount   int64     `json:"bookCount" gorm:"-"`           // Books the user may see
+	CreatedAt   time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt   time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+}
+
+type Collections []*Collection
+
+// A book in a manual collection
+type CollectionBook struct {
+	CollectionID uuid.UUID `gorm:"primaryKey"`
+	BookID       uuid.UUID `gorm:"primaryKey;index"`
+	Position     int
+}
+
+// A rule of a smart collection, either a condition on a field of the books
+// or a group of rules of which all or any must match
+//
+//	{"all": [{"field": "language", "op": "eq", "value": "fr"},
+//	         {"field": "subject", "op": "contains", "value": "History"}]}
+type Rule struct {
+	Field string `json:"field,omitempty"`
+	Op    string `json:"op,omitempty"`
+	Value string `json:"value,omitempty"`
+
+	All []*Rule `json:"all,omitempty"`
+	Any []*Rule `json:"any,omitempty"`
+}
+
+// Operators of rule conditions
+const (
+	OpEquals     = "eq"
+	OpNotEquals  = "ne"
+	OpContains   = "contains"
+	OpStartsWith = "startsWith"
+	OpLess       = "lt"
+	OpGreater    = "gt"
+)
+
+// How the values of a field are compared
+type ruleKind int
+
+const (
+	kindText ruleKind = iota
+	kindList          // A json array of text
+	kindDate          // iso8601 text, compared in order
+	kindNumber
+)
+
+var ruleOps = map[ruleKind][]string{
+	kindText:   {OpEquals, OpNotEquals, OpContains, OpStartsWith},
+	kindList:   {OpEquals, OpNotEquals, OpContains},
+	kindDate:   {OpEquals, OpNotEquals, OpStartsWith, OpLess, OpGreater},
+	kindNumber: {OpEquals, OpNotEquals, OpLess, OpGreater},
+}
+
+// Fields rules can match and their columns
+var ruleFields = map[string]struct {
+	column string
+	kind   ruleKind
+}{
+	"title":       {"books.title", kindText},
+	"author":      {"books.author", kindText},
+	"series":      {"books.series", kindText},
+	"language":    {"books.language", kindText},
+	"publisher":   {"books.publisher", kindText},
+	"isbn":        {"books.isbn", kindText},
+	"description": {"books.description", kindText},
+	"subject":     {"books.subjects", kindList},
+	"pubDate":     {"books.pub_date", kindDate},
+	"importedAt":  {"books.imported_at", kindDate},
+	"seriesNum":   {"books.series_num", kindNumber},
+}
+
+var isoDate = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+func (c *Collection) Validate() error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return errors.New("name must not be empty")
+	}
+	if c.Rules != nil {
+		return c.Rules.validate(1)
+	}
+	return nil
+}
+
+func (rule *Rule) validate(depth int) error {
+	if depth > maxRuleDepth {
+		return fmt.Errorf("rules must not be nested more than %d groups deep", maxRuleDepth)
+	}
+
+	group := rule.All
+	if rule.Any != nil {
+		group = rule.Any
+	}
+	if rule.All != nil || rule.Any != nil {
+		if (rule.All != nil && rule.Any != nil) || rule.Field != "" {
+			return errors.New("rules must be a condition or one group of rules")
+		}
+		if len(group) == 0 {
+			return errors.New("rule groups must not be empty")
+		}
+		for _, r := range group {
+			if r == nil {
+				return errors.New("rules must not be null")
+			}
+			if err := r.validate(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	field, ok := ruleFields[rule.Field]
+	if !ok {
+		return fmt.Errorf("unknown rule field %q", rule.Field)
+	}
+	if !slices.Contains(ruleOps[field.kind], rule.Op) {
+		return fmt.Errorf("field %q can't be compared with %q", rule.Field, rule.Op)
+	}
+
+	switch {
+	case field.kind == kindNumber:
+		if _, err := strconv.ParseFloat(rule.Value, 64); err != nil {
+			return fmt.Errorf("%s needs a number, got %q", rule.Field, rule.Value)
+		}
+	case field.kind == kindDate && (rule.Op == OpLess || rule.Op == OpGreater):
+		if !isoDate.MatchString(rule.Value) {
+			return fmt.Errorf("%s needs an iso8601 date, got %q", rule.Field, rule.Value)
+		}
+	}
+
+	return nil
+}
+
+// Returns the where clause matching the books selected by a valid rule
+func (rule *Rule) where() (string, []any) {
+	if rule.All != nil || rule.Any != nil {
+		group, sep := rule.All, " AND "
+		if rule.Any != nil {
+			group, sep = rule.Any, " OR "
+		}
+
+		clauses := make([]string, len(group))
+		args := make([]any, 0)
+		for i, r := range group {
+			clause, a := r.where()
+			clauses[i] = "(" + clause + ")"
+			args = append(args, a...)
+		}
+		return strings.Join(clauses, sep), args
+	}
+
+	field := ruleFields[rule.Field]
+	column := field.column
+
+	// LIKE is case insensitive, its wildcards in the value are escaped
+	like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(rule.Value)
+
+	if field.kind == kindList {
+		const subject = "SELECT 1 FROM json_each(books.subjects) AS subject WHERE "
+		switch rule.Op {
+		case OpNotEquals:
+			return "NOT EXISTS (" + subject + "subject.value COLLATE NOCASE = ?)", []any{rule.Value}
+		case OpContains:
+			return "EXISTS (" + subject + `subject.value LIKE ? ESCAPE '\')`, []any{"%" + like + "%"}
+		default:
+			return "EXISTS (" + subject + "subject.value COLLATE NOCASE = ?)", []any{rule.Value}
+		}
+	}
+
+	var value any = rule.Value
+	if field.kind == kindNumber {
+		value, _ = strconv.ParseFloat(rule.Value, 64)
+	}
+
+	switch rule.Op {
+	case OpNotEquals:
+		return column + " COLLATE NOCASE != ?", []any{value}
+	case OpContains:
+		return column + ` LIKE ? ESCAPE '\'`, []any{"%" + like + "%"}
+	case OpStartsWith:
+		return column + ` LIKE ? ESCAPE '\'`, []any{like + "%"}
+	case OpLess:
+		return column + " < ?", []any{value}
+	case OpGreater:
+		return column + " > ?", []any{value}
+	default:
+		return column + " COLLATE NOCASE = ?", []any{value}
+	}
+}
+
+// Returns the where clause matching the books in any of collections
+func collectionsWhere(collections Collections) (string, []any) {
+	if len(collections) == 0 {
+		return "1 = 0", nil
+	}
+
+	clauses := make([]string, len(collections))
+	args := make([]any, 0)
+	for i, c := range collections {
+		if c.Rules == nil {
+			clauses[i] = "books.id IN (SELECT book_id FROM collection_books WHERE collection_id = ?)"
+			args = append(args, c.ID)
+			continue
+		}
+		clause, a := c.Rules.where()
+		clauses[i] = "(" + clause + ")"
+		args = append(args, a...)
+	}
+
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// Loads the collections of opts.Reader that opts filters by. Collections of
+// other users match no books.
+func (r *Repository) loadCollections(opts *ListOptions) error {
+	if len(opts.Collections) == 0 {
+		return nil
+	}
+
+	opts.collections = make(Collections, 0)
+	return r.db.Where("id IN ? AND user_id = ?", opts.Collections, opts.Reader).Find(&opts.collections).Error
+}
+
+// Returns the collections of a user ordered by name, with the number of
+// books in each the repository may read
+func (r *Repository) ListCollections(userID uuid.UUID) (Collections, error) {
+	collections := make(Collections, 0)
+	err := r.db.Where("user_id = ?", userID).Order("name COLLATE NOCASE").Order("id").Find(&collections).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range collections {
+		if err := r.countCollection(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return collections, nil
+}
+
+func (r *Repository) CreateCollection(c *Collection) (*Collection, error) {
+	if err := r.db.Create(c).Error; err != nil {
+		return nil, err
+	}
+
+	return c, r.countCollection(c)
+}
+
+// Reads a collection of a user along with its number of books
+func (r *Repository) ReadCollection(userID uuid.UUID, id uuid.UUID) (*Collection, error) {
+	c := &Collection{}
+	if err := r.db.Where("id = ? AND user_id = ?", id, userID).First(c).Error; err != nil {
+		return nil, err
+	}
+
+	return c, r.countCollection(c)
+}
+
+// Overwrites all editable columns of the row matching c.ID
+func (r *Repository) UpdateCollection(c *Collection) error {
+	err := r.db.Model(&Collection{}).
+		Select("name", "description", "rules", "updated_at").
+		Where("id = ?", c.ID).
+		Updates(c).Error
+	if err != nil {
+		return err
+	}
+
+	return r.countCollection(c)
+}
+
+// Deletes a collection, the books in it stay in the library
+func (r *Repository) DeleteCollection(c *Collection) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("collection_id = ?", c.ID).Delete(&CollectionBook{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", c.ID).Delete(&Collection{}).Error
+	})
+}
+
+// Replaces the books of a manual collection with bookIDs, in that order.
+// Every book must exist and be visible to the repository.
+func (r *Repository) SetCollectionBooks(c *Collection, bookIDs []uuid.UUID) error {
+	if c.Rules != nil {
+		return ErrSmartCollection
+	}
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return r.setCollectionBooks(tx, c, bookIDs)
+	})
+}
+
+// Adds books to a manual collection before the book at position, or at the
+// end if position is negative or past the end. Books already in the
+// collection are moved.
+func (r *Repository) AddCollectionBooks(c *Collection, bookIDs []uuid.UUID, position int) error {
+	if c.Rules != nil {
+		return ErrSmartCollection
+	}
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		current := make([]uuid.UUID, 0)
+		err := tx.Model(&CollectionBook{}).
+			Where("collection_id = ?", c.ID).
+			Order("position").
+			Pluck("book_id", &current).Error
+		if err != nil {
+			return err
+		}
+
+		current = slices.DeleteFunc(current, func(id uuid.UUID) bool {
+			return slices.Contains(bookIDs, id)
+		})
+		if position < 0 || position > len(current) {
+			position = len(current)
+		}
+
+		return r.setCollectionBooks(tx, c, slices.Insert(current, position, bookIDs...))
+	})
+}
+
+func (r *Repository) setCollectionBooks(tx *gorm.DB, c *Collection, bookIDs []uuid.UUID) error {
+	members := make([]*CollectionBook, 0, len(bookIDs))
+	for _, id := range bookIDs {
+		if !slices.ContainsFunc(members, func(m *CollectionBook) bool { return m.BookID == id }) {
+			members = append(members, &CollectionBook{CollectionID: c.ID, BookID: id, Position: len(members)})
+		}
+	}
+
+	// Books that are in the trash can't be added either
+	if len(members) > 0 {
+		var found int64
+		err := r.visible(tx.Model(&Book{})).Where("id IN ?", bookIDs).Count(&found).Error
+		if err != nil {
+			return err
+		}
+		if found != int64(len(members)) {
+			return ErrUnknownBooks
+		}
+	}
+
+	if err := tx.Where("collection_id = ?", c.ID).Delete(&CollectionBook{}).Error; err != nil {
+		return err
+	}
+	if len(members) > 0 {
+		if err := tx.Create(&members).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&Collection{}).Where("id = ?", c.ID).Update("updated_at", time.Now()).Error
+}
+
+// Removes a book from a manual collection
+func (r *Repository) RemoveCollectionBook(c *Collection, bookID uuid.UUID) (int64, error) {
+	if c.Rules != nil {
+		return 0, ErrSmartCollection
+	}
+
+	result := r.db.Where("collection_id = ? AND book_id = ?", c.ID, bookID).Delete(&CollectionBook{})
+	return result.RowsAffected, result.Error
+}
+
+// Sets the number of books in c the repository may read
+func (r *Repository) countCollection(c *Collection) error {
+	opts := &ListOptions{Collections: []uuid.UUID{c.ID}, Reader: c.UserID, collections: Collections{c}}
+	return opts.filter(r.visible(r.db.Model(&Book{}))).Count(&c.BookCount).Error
+}
@@ -0,0 +1,156 @@
+// Cover image helpers for serving covers and caching resized thumbnails on disk.
+
+package book
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	config "github.com/spf13/viper"
+	"golang.org/x/image/draw"
+)
+
+// Largest width or height that can be requested for a thumbnail
+const maxThumbnailSize = 2048
+
+// Quality used when encoding thumbnails as jpeg
+const thumbnailQuality = 85
+
+// Reads the requested thumbnail bounds from the ?w= and ?h= query parameters.
+// Both are 0 when the full size image is requested.
+func parseThumbnailSize(query url.Values) (width int, height int, err error) {
+	parse := func(key string) (int, error) {
+		v := query.Get(key)
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxThumbnailSize {
+			return 0, fmt.Errorf("invalid %s %q, must be between 1 and %d", key, v, maxThumbnailSize)
+		}
+		return n, nil
+	}
+
+	if width, err = parse("w"); err != nil {
+		return
+	}
+	height, err = parse("h")
+	return
+}
+
+// Directory holding the cached thumbnails of a book
+func coverCacheDir(id uuid.UUID) string {
+	return filepath.Join(config.GetString("cache_path"), "covers", id.String())
+}
+
+// Removes all cached thumbnails of a book
+func ClearCoverCache(id uuid.UUID) error {
+	return os.RemoveAll(coverCacheDir(id))
+}
+
+// Returns the path to a thumbnail of the cover fitting in width x height,
+// generating it from cover if it is not cached yet. The crc of the cover
+// is part of the name so a changed cover never serves a stale thumbnail.
+func cachedThumbnail(id uuid.UUID, crc uint32, cover []byte, width int, height int) (string, error) {
+	dir := coverCacheDir(id)
+	path := filepath.Join(dir, fmt.Sprintf("%08x_%dx%d.jpg", crc, width, height))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	thumb, err := makeThumbnail(cover, width, height)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first so concurrent requests never read a
+	// partially written thumbnail
+	tmp, err := os.CreateTemp(dir, ".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(thumb)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// Scales the image down to fit in width x height while preserving its aspect
+// ratio and encodes it as jpeg. A zero width or height is unbounded.
+// Images that already fit are only re-encoded.
+func makeThumbnail(cover []byte, width int, height int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(cover))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil, errors.New("cover image is empty")
+	}
+
+	scale := 1.0
+	if width > 0 && width < bounds.Dx() {
+		scale = float64(width) / float64(bounds.Dx())
+	}
+	if height > 0 && float64(height) < float64(bounds.Dy())*scale {
+		scale = float64(height) / float64(bounds.Dy())
+	}
+
+	dstWidth := max(1, int(float64(bounds.Dx())*scale+0.5))
+	dstHeight := max(1, int(float64(bounds.Dy())*scale+0.5))
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	// Jpeg has no alpha channel, so transparent covers are drawn onto white
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var b bytes.Buffer
+	err = jpeg.Encode(&b, dst, &jpeg.Options{Quality: thumbnailQuality})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Reports whether the If-None-Match header of the request matches etag.
+// Lets handlers answer conditional requests before doing any expensive work.
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,158 @@
+// Detects books that are likely copies of each other.
+
+package book
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Books that have the same value for Key
+type DuplicateGroup struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Books Books  `json:"books"`
+}
+
+// Values books can be grouped by with GroupDuplicates, books with an empty
+// value are never grouped
+var duplicateKeys = map[string]func(b *Book) string{
+	"sha256": func(b *Book) string { return b.Sha256 },
+	"uid":    func(b *Book) string { return b.Uid },
+	"isbn":   func(b *Book) string { return normalizeIsbn(b.Isbn) },
+	"titleAuthor": func(b *Book) string {
+		title, author := normalizeTitle(b.Title), normalizeName(b.Author)
+		if title == "" {
+			return ""
+		}
+		return title + " / " + author
+	},
+	"filePath": func(b *Book) string {
+		if abs, err := filepath.Abs(b.Filepath); err == nil {
+			return abs
+		}
+		return filepath.Clean(b.Filepath)
+	},
+}
+
+// Keys reported by GET /books/duplicates
+var DuplicateReportKeys = []string{"sha256", "uid", "isbn", "titleAuthor"}
+
+// Groups books sharing a value for each of keys. Groups are ordered by key,
+// in the order given, then by value.
+func GroupDuplicates(books Books, keys ...string) []*DuplicateGroup {
+	groups := make([]*DuplicateGroup, 0)
+
+	for _, key := range keys {
+		valueOf := duplicateKeys[key]
+
+		byValue := make(map[string]Books)
+		for _, b := range books {
+			if v := valueOf(b); v != "" {
+				byValue[v] = append(byValue[v], b)
+			}
+		}
+
+		values := make([]string, 0)
+		for v, group := range byValue {
+			if len(group) > 1 {
+				values = append(values, v)
+			}
+		}
+		sort.Strings(values)
+
+		for _, v := range values {
+			groups = append(groups, &DuplicateGroup{Key: key, Value: v, Books: byValue[v]})
+		}
+	}
+
+	return groups
+}
+
+// Returned by FindDuplicate when the duplicate is hidden from the repository
+var ErrHiddenDuplicate = errors.New("duplicate of a hidden book")
+
+// Returns a book with the same archive hash, uid or isbn as b, in that order
+// of preference, or nil if there is none. Books hidden from the repository
+// are matched too, but only reported with ErrHiddenDuplicate.
+func (r *Repository) FindDuplicate(b *Book) (*Book, error) {
+	matches := []struct {
+		query string
+		value string
+	}{
+		{"sha256 = ?", b.Sha256},
+		{"uid = ?", b.Uid},
+		{"REPLACE(REPLACE(UPPER(isbn), '-', ''), ' ', '') = ?", normalizeIsbn(b.Isbn)},
+	}
+
+	for _, match := range matches {
+		if match.value == "" {
+			continue
+		}
+
+		existing := make(Books, 0, 1)
+		err := r.db.Where(match.query, match.value).
+			Where("id != ?", b.ID).
+			Order("imported_at").
+			Limit(1).
+			Find(&existing).Error
+		if err != nil {
+			return nil, err
+		}
+
+		if len(existing) == 0 {
+			continue
+		}
+		if r.visibleSubjects != nil {
+			var visible int64
+			err := r.visible(r.db.Model(&Book{})).Where("id = ?", existing[0].ID).Count(&visible).Error
+			if err != nil {
+				return nil, err
+			}
+			if visible == 0 {
+				return nil, ErrHiddenDuplicate
+			}
+		}
+		return existing[0], nil
+	}
+
+	return nil, nil
+}
+
+// Strips the separators from an isbn
+func normalizeIsbn(isbn string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+}
+
+// Lowercases a title and drops its subtitle, leading article and punctuation
+// so different editions of a book compare equal
+func normalizeTitle(title string) string {
+	if i := strings.IndexAny(title, ":;("); i > 0 {
+		title = title[:i]
+	}
+
+	words := strings.Fields(normalizeName(title))
+	if len(words) > 1 {
+		switch words[0] {
+		case "the", "a", "an":
+			words = words[1:]
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Lowercases s and replaces punctuation with spaces
+func normalizeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, s)
+
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -4,18 +4,30 @@
 package book
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"nubayrah/api/event"
 	"nubayrah/api/router/middleware"
 	"nubayrah/epub"
+	"os"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+// Largest cover image accepted by HandleSetBookCover
+const maxCoverSize = 32 << 20
+
 // BookService represents a service for managing book objects.
 type BookService struct {
 	repository *Repository
@@ -34,25 +46,40 @@ func (s *BookService) RegisterRoutes(r chi.Router) {
 	// Book -> Create()
 	r.Post("/", s.HandleImportBook)
 
+	// Book -> Create() for many epubs
+	r.Post("/batch", s.HandleImportBatch)
+
 	// Book -> List()
 	r.Get("/", s.HandleGetBooks)
 
+	// Book -> Search()
+	r.Get("/search", s.HandleSearchBooks)
+
+	// Book -> GroupDuplicates()
+	r.Get("/duplicates", s.HandleGetDuplicates)
+
 	// Book with object key
 	r.Route("/{id}", func(r chi.Router) {
 
 		//  Book -> Read()
 		r.Get("/", s.HandleGetBook)
 
+		// Book -> Update()
+		r.Patch("/", s.HandleUpdateBook)
+
 		// Book -> Delete()
 		r.Delete("/", s.HandleDeleteBook)
 
-		r.Route("/cover", func(r chi.Router) {
+		//  Book -> Download()
+		r.Get("/file", s.HandleDownloadBook)
 
-			// GetCoverImage() returns type PNG
-			r.Use(middleware.ContentTypePNG)
+		r.Route("/cover", func(r chi.Router) {
 
 			//  Book -> GetCoverImage()
 			r.Get("/", s.HandleGetBookCover)
+
+			//  Book -> SetCoverImage()
+			r.Put("/", s.HandleSetBookCover)
 		})
 
 	})
@@ -60,32 +87,63 @@ func (s *BookService) RegisterRoutes(r chi.Router) {
 }
 
 // Handler for importing an epub
+// Uploads of a book already in the library, matched by archive hash, uid or
+// isbn, are rejected with 409 Conflict unless ?duplicate= says otherwise.
+// With ?async=true the upload is imported in the background and the response
+// is 202 Accepted with the import job.
 func (a *BookService) HandleImportBook(w http.ResponseWriter, r *http.Request) {
-	// Read file contents from request
-	file, _, err := r.FormFile("epub")
+	onDuplicate := r.URL.Query().Get("duplicate")
+	if onDuplicate == "" {
+		onDuplicate = duplicateReject
+	}
+	if !slices.Contains(duplicatePolicies, onDuplicate) {
+		log.Printf("unknown duplicate policy %q", onDuplicate)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if limit := maxUploadSize(); limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	// Stream the file from the request instead of buffering it
+	file, err := formFilePart(r, "epub")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("error reading file from post request %v", err)
 		return
 	}
-	defer file.Close()
 
-	epubObj, err := epub.Import(file)
+	if r.URL.Query().Get("async") == "true" {
+		a.queueImport(w, r, file, onDuplicate)
+		return
+	}
+
+	epubObj, err := epub.Parse(file)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		log.Printf("rejecting upload larger than %d bytes", maxBytesErr.Limit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		log.Printf("error opening epub archive %v", err)
+		return
 	}
+	defer epubObj.Close()
 
-	book, err := a.repository.Create(&Book{
-		Metadata: *epubObj.ExtractMetadata(),
-		ID:       uuid.New(),
-		Filepath: epubObj.FilePath,
-	})
+	book, outcome, err := a.importEpub(a.repository.For(r), epubObj, onDuplicate, saveEpub)
 	if err != nil {
-		log.Printf("error writing books into database %v", err)
+		log.Printf("error importing epub %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if book == nil {
+		// Duplicate of a book hidden from the user
+		w.WriteHeader(importStatus[outcome])
+		return
+	}
 
 	j, err := json.Marshal(book)
 	if err != nil {
@@ -94,14 +152,45 @@ func (a *BookService) HandleImportBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("Location", fmt.Sprintf("/books/%s", book.ID))
+	w.WriteHeader(importStatus[outcome])
+	w.Write(j)
+}
+
+// Handler for listing likely duplicates at /books/duplicates
+// Books are grouped by archive hash, uid, isbn and normalized title and
+// author.
+func (a *BookService) HandleGetDuplicates(w http.ResponseWriter, r *http.Request) {
+	books, _, err := a.repository.For(r).List(&ListOptions{})
+	if err != nil {
+		log.Printf("error reading rows %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(GroupDuplicates(books, DuplicateReportKeys...))
+	if err != nil {
+		log.Printf("error marshalling duplicates into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	w.Write(j)
 }
 
 // Handler for root link /books
-func (a *BookService) HandleGetBooks(w http.ResponseWriter, _ *http.Request) {
+// Supports filtering, sorting and pagination, see ParseListOptions.
+func (a *BookService) HandleGetBooks(w http.ResponseWriter, r *http.Request) {
+
+	opts, err := ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	opts.Reader = ReaderID(r)
 
-	books, err := a.repository.List()
+	books, total, err := a.repository.For(r).List(opts)
 
 	if err != nil {
 		log.Printf("error reading rows %v", err)
@@ -116,6 +205,45 @@ func (a *BookService) HandleGetBooks(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 
+	SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Handler for full-text search at /books/search?q=
+// Matches metadata only unless ?content=true is set. Accepts the same filters
+// and pagination as HandleGetBooks, results are ordered by rank.
+func (a *BookService) HandleSearchBooks(w http.ResponseWriter, r *http.Request) {
+	opts, err := ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	opts.Reader = ReaderID(r)
+
+	content, _ := strconv.ParseBool(r.URL.Query().Get("content"))
+	query, err := ParseSearchQuery(r.URL.Query().Get("q"), content)
+	if err != nil {
+		log.Printf("error parsing search query %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results, total, err := a.repository.For(r).Search(query, opts)
+	if err != nil {
+		log.Printf("error searching books %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(results)
+	if err != nil {
+		log.Printf("error marshalling books into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	SetPaginationHeaders(w, r, opts, total)
 	w.Write(j)
 }
 
@@ -128,12 +256,29 @@ func (a *BookService) HandleGetBook(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	book, err := a.repository.Read(UUID)
+	book, err := a.repository.For(r).Read(UUID)
 	if err != nil {
 		log.Printf("error finding book in db: %v", err)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+
+	book.Reading, err = a.repository.ReadReadingState(ReaderID(r), book.ID)
+	if err != nil {
+		log.Printf("error reading reading state of book %v: %v", book.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if user := middleware.CurrentUser(r); user != nil {
+		book.Progress, err = a.repository.ReadBookSyncProgress(user.UserID(), book.ID)
+		if err != nil {
+			log.Printf("error reading progress of book %v: %v", book.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	j, err := json.Marshal(book)
 	if err != nil {
 		log.Printf("error marshalling books into json %v", err)
@@ -144,7 +289,113 @@ func (a *BookService) HandleGetBook(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
-// Handler for getting a specific book at /books/{bookID}
+// Handler for editing the metadata of a specific book at /books/{bookID}
+// The body is a partial epub.Metadata document, fields missing from it are
+// left unchanged. The row is only committed once the epub has been rewritten.
+func (a *BookService) HandleUpdateBook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	UUID, err := uuid.Parse(id)
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	book, err := a.repository.For(r).Read(UUID)
+	if err != nil {
+		log.Printf("error finding book in db: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Decode on top of the current metadata so only provided fields change.
+	// The creators are copied as decoding would overwrite them in place.
+	mdata := book.Metadata
+	mdata.Creators = slices.Clone(book.Creators)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&mdata); err != nil {
+		log.Printf("error decoding metadata from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	mdata.SyncCreators(&book.Metadata)
+
+	if mdata.Uid != book.Uid {
+		log.Printf("rejecting update of uid for book %v", book.ID)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := mdata.Validate(); err != nil {
+		log.Printf("invalid metadata for book %v: %v", book.ID, err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	book.Metadata = mdata
+	if err := a.writeMetadata(book); err != nil {
+		log.Printf("error updating book %v: %v", book.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(book)
+	if err != nil {
+		log.Printf("error marshalling books into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for downloading the epub of a specific book at /books/{bookID}/file
+// Supports range requests and conditional GETs through http.ServeContent.
+func (a *BookService) HandleDownloadBook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	UUID, err := uuid.Parse(id)
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	book, err := a.repository.For(r).Read(UUID)
+	if err != nil {
+		log.Printf("error finding book in db: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(book.Filepath)
+	if err != nil {
+		log.Printf("error opening epub for book %v: %v", book.ID, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("error reading file info for book %v: %v", book.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Size and modification time change whenever the epub is rewritten
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	w.Header().Set(middleware.HeaderKeyContentType, middleware.HeaderValueContentTypeEpub)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": downloadFileName(book),
+	}))
+
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// Handler for getting the cover image of a specific book at /books/{bookID}/cover
+// Serves the image with its media type from the manifest. The optional ?w= and
+// ?h= parameters return a cached jpeg thumbnail fitting in those bounds.
 func (a *BookService) HandleGetBookCover(w http.ResponseWriter, r *http.Request) {
 
 	// Grab UUID from url
@@ -156,8 +407,15 @@ func (a *BookService) HandleGetBookCover(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	width, height, err := parseThumbnailSize(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing thumbnail size: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	// Read item from database
-	book, err := a.repository.Read(UUID)
+	book, err := a.repository.For(r).Read(UUID)
 	if err != nil {
 		log.Printf("error finding book in db: %v", err)
 		w.WriteHeader(http.StatusNotFound)
@@ -171,15 +429,46 @@ func (a *BookService) HandleGetBookCover(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	defer e.Close()
 
 	// Get CoverFile file object
 	file, err := e.GetCoverFile()
+	if errors.Is(err, epub.ErrNoCover) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Printf("error creating file object for item %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	mediaType, err := e.GetCoverMediaType()
+	if err != nil {
+		log.Printf("error reading cover media type for item %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The crc of the archive entry changes whenever the cover is replaced
+	etag := fmt.Sprintf(`"%08x"`, file.CRC32)
+	if width != 0 || height != 0 {
+		etag = fmt.Sprintf(`"%08x-%dx%d"`, file.CRC32, width, height)
+		mediaType = "image/jpeg"
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var modTime time.Time
+	if info, err := os.Stat(book.Filepath); err == nil {
+		modTime = info.ModTime()
+	}
+
 	// Open a io.Reader for the object
 	fileReader, err := file.Open()
 	if err != nil {
@@ -187,15 +476,113 @@ func (a *BookService) HandleGetBookCover(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	defer fileReader.Close()
+
+	cover, err := io.ReadAll(fileReader)
+	if err != nil {
+		log.Printf("error reading cover image %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	// Copies content of the file to the response writer
-	_, err = io.Copy(w, fileReader)
+	w.Header().Set(middleware.HeaderKeyContentType, mediaType)
+
+	if width == 0 && height == 0 {
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(cover))
+		return
+	}
+
+	thumbPath, err := cachedThumbnail(book.ID, file.CRC32, cover, width, height)
+	if err != nil {
+		log.Printf("error creating thumbnail for book %v: %v", book.ID, err)
+		w.Header().Del("ETag")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	thumb, err := os.Open(thumbPath)
+	if err != nil {
+		log.Printf("error opening thumbnail for book %v: %v", book.ID, err)
+		w.Header().Del("ETag")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer thumb.Close()
+
+	http.ServeContent(w, r, "", modTime, thumb)
+}
+
+// Handler for replacing the cover image of a specific book at /books/{bookID}/cover
+// Accepts either a multipart form with a `cover` field or the raw image as body.
+func (a *BookService) HandleSetBookCover(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	UUID, err := uuid.Parse(id)
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	book, err := a.repository.For(r).Read(UUID)
+	if err != nil {
+		log.Printf("error finding book in db: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCoverSize)
+
+	var cover []byte
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(middleware.HeaderKeyContentType))
+	if mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("cover")
+		if err != nil {
+			log.Printf("error reading cover from request %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		cover, err = io.ReadAll(file)
+	} else {
+		cover, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		log.Printf("error reading cover from request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	e, err := epub.OpenEpub(book.Filepath)
+	if err != nil {
+		log.Printf("error opening epub for book %v: %v", book.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer e.Close()
+
+	err = e.SetCoverImage(cover)
 	if err != nil {
-		log.Printf("error copying content to response %v", err)
+		log.Printf("error setting cover image for book %v: %v", book.ID, err)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	err = e.WriteChanges()
+	if err != nil {
+		log.Printf("error writing cover image for book %v: %v", book.ID, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	a.rehash(book, e)
+
+	// Thumbnails of the old cover are never served again
+	if err := ClearCoverCache(book.ID); err != nil {
+		log.Printf("error clearing cover cache for book %v: %v", book.ID, err)
+	}
+
+	a.repository.publishAbout(event.CoverChanged, &bookRef{ID: book.ID}, book)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Handler for Deleting a specific book.
@@ -209,13 +596,19 @@ func (a *BookService) HandleDeleteBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	count, err := a.repository.Delete(UUID)
+	book, err := a.repository.For(r).Read(UUID)
+	if err != nil {
+		log.Printf("error reading book from DB: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = a.repository.Trash(book)
 	if err != nil {
-		log.Printf("error when deleting UUID from DB: %v", err)
+		log.Printf("error moving book to trash: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Count deleted: %v", count)
 
 	w.WriteHeader(http.StatusNoContent)
 }
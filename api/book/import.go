@@ -0,0 +1,167 @@
+// Adds epubs to the library, for single, batch and inbox imports and scans.
+
+package book
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"nubayrah/epub"
+	"os"
+	"sync"
+)
+
+// How uploads of a book that is already in the library are handled, chosen
+// with ?duplicate=
+const (
+	duplicateReject  = "reject"  // Respond 409 Conflict with the existing book
+	duplicateKeep    = "keep"    // Import the upload as a separate book
+	duplicateReplace = "replace" // Replace the existing book's epub and metadata
+	duplicateMerge   = "merge"   // Fill in metadata missing from the existing book
+)
+
+var duplicatePolicies = []string{duplicateReject, duplicateKeep, duplicateReplace, duplicateMerge}
+
+// What happened to an imported epub
+const (
+	outcomeCreated   = "created"
+	outcomeDuplicate = "duplicate" // Rejected as a duplicate of an existing book
+	outcomeReplaced  = "replaced"
+	outcomeMerged    = "merged"
+	outcomeFailed    = "failed"
+)
+
+// Response status of HandleImportBook for each outcome
+var importStatus = map[string]int{
+	outcomeCreated:   http.StatusCreated,
+	outcomeDuplicate: http.StatusConflict,
+	outcomeReplaced:  http.StatusOK,
+	outcomeMerged:    http.StatusOK,
+}
+
+// Returned by Import for epubs of a book that is already in the library
+var ErrDuplicate = errors.New("duplicate of a book in the library")
+
+// Serializes looking up duplicates and adding books, so concurrent imports
+// of the same book can't both be created
+var importMu sync.Mutex
+
+// Puts the epub of a new book where the library keeps it. Returns how to
+// undo that if the book can't be created.
+type placeFunc func(e *epub.Epub) (undo func(), err error)
+
+// Moves an epub read by epub.Parse into the library
+func saveEpub(e *epub.Epub) (func(), error) {
+	if err := e.Save(); err != nil {
+		return nil, err
+	}
+
+	// Don't leave a copy in the library without a database row
+	path := e.FilePath
+	return func() { os.Remove(path) }, nil
+}
+
+// Keeps an epub opened with epub.OpenEpub where it is, or moves it into the
+// library if move is set
+func keepEpub(move bool) placeFunc {
+	return func(e *epub.Epub) (func(), error) {
+		if !move {
+			return func() {}, nil
+		}
+
+		oldPath := e.FilePath
+		if err := e.MoveToLibrary(); err != nil {
+			return nil, err
+		}
+		path := e.FilePath
+		return func() { os.Rename(path, oldPath) }, nil
+	}
+}
+
+// Adds the epub e to the library through repo, putting it in place with
+// place. Duplicates of books in the library are handled according to
+// onDuplicate, replacing and merging need an epub read by epub.Parse.
+// Duplicates of books hidden from repo are always rejected. Returns the
+// resulting book, which is the existing book for rejected duplicates or nil
+// if it is hidden, and the outcome.
+func (a *BookService) importEpub(repo *Repository, e *epub.Epub, onDuplicate string, place placeFunc) (*Book, string, error) {
+	importMu.Lock()
+	defer importMu.Unlock()
+
+	book := NewBook(e)
+
+	existing, err := repo.FindDuplicate(book)
+	hidden := errors.Is(err, ErrHiddenDuplicate)
+	if err != nil && !hidden {
+		return nil, "", err
+	}
+
+	switch {
+	case existing == nil && !hidden || onDuplicate == duplicateKeep:
+		undo, err := place(e)
+		if err != nil {
+			return nil, "", err
+		}
+
+		book.Filepath = e.FilePath
+		book, err = repo.Create(book)
+		if err != nil {
+			undo()
+			return nil, "", err
+		}
+		return book, outcomeCreated, nil
+
+	case hidden:
+		log.Printf("rejecting duplicate of a hidden book")
+		return nil, outcomeDuplicate, nil
+
+	case onDuplicate == duplicateReplace:
+		book, err = a.replaceBook(repo, existing, e)
+		if err != nil {
+			return nil, "", err
+		}
+		return book, outcomeReplaced, nil
+
+	case onDuplicate == duplicateMerge:
+		book, err = a.mergeBook(existing, e)
+		if err != nil {
+			return nil, "", err
+		}
+		return book, outcomeMerged, nil
+
+	default:
+		log.Printf("rejecting duplicate of book %v", existing.ID)
+		return existing, outcomeDuplicate, nil
+	}
+}
+
+// Adds the epub e read by epub.Parse to the library the same way as uploads
+// to POST /books. Duplicates of books in the library are rejected with
+// ErrDuplicate.
+func (a *BookService) Import(e *epub.Epub) (*Book, error) {
+	return a.importRejecting(e, saveEpub)
+}
+
+// Adds the epub e opened with epub.OpenEpub to the library where it is, or
+// moved into the library layout if move is set. Duplicates of books in the
+// library are rejected with ErrDuplicate.
+func (a *BookService) ImportInPlace(e *epub.Epub, move bool) (*Book, error) {
+	if _, err := e.Checksum(); err != nil {
+		return nil, err
+	}
+
+	return a.importRejecting(e, keepEpub(move))
+}
+
+func (a *BookService) importRejecting(e *epub.Epub, place placeFunc) (*Book, error) {
+	book, outcome, err := a.importEpub(a.repository, e, duplicateReject, place)
+	if err != nil {
+		return nil, err
+	}
+	if outcome == outcomeDuplicate {
+		return nil, fmt.Errorf("%w: book %s at %s", ErrDuplicate, book.ID, book.Filepath)
+	}
+
+	return book, nil
+}
@@ -0,0 +1,443 @@
+// Imports run in the background by JobRunner. Uploads are spooled to disk and
+// tracked by jobs stored in the database, so they are resumed after a
+// restart and failed imports can be retried.
+
+package book
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"nubayrah/api/event"
+	"nubayrah/api/router/middleware"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	config "github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// States of an import job
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed" // At least one file failed to import
+)
+
+// What started an import job
+const (
+	jobKindImport = "import" // POST /books
+	jobKindBatch  = "batch"  // POST /books/batch
+)
+
+// How often JobRunner looks for queued jobs it wasn't told about
+const jobPollInterval = 30 * time.Second
+
+var (
+	ErrJobRunning   = errors.New("job is running")
+	ErrJobNotFailed = errors.New("only failed jobs can be retried")
+)
+
+// A file uploaded to an import job
+type JobFile struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"` // Set if the upload couldn't be spooled
+}
+
+type Job struct {
+	ID          uuid.UUID      `json:"id" gorm:"<-:create"`
+	Kind        string         `json:"kind"`
+	State       string         `json:"state" gorm:"index"`
+	OnDuplicate string         `json:"duplicate"`
+	Files       []*JobFile     `json:"files" gorm:"serializer:json"`
+	Done        int            `json:"done"`  // Epubs imported so far, including failures
+	Total       int            `json:"total"` // Epubs in the upload, known once the job starts
+	Error       string         `json:"error,omitempty"`
+	Results     []*BatchResult `json:"results" gorm:"serializer:json"`
+	CreatedAt   time.Time      `json:"createdAt" gorm:"autoCreateTime;index"`
+	StartedAt   *time.Time     `json:"startedAt"`
+	FinishedAt  *time.Time     `json:"finishedAt"`
+
+	// User that queued the job, nil without authentication, and the subjects
+	// of the books it could see then. Duplicates are detected as that user.
+	UserID          *uuid.UUID `json:"userId,omitempty"`
+	VisibleSubjects []string   `json:"-" gorm:"serializer:json"`
+}
+
+type Jobs []*Job
+
+// Directory the files of a job are spooled to until it succeeds
+func jobDir(id uuid.UUID) string {
+	return filepath.Join(config.GetString("library_path"), ".jobs", id.String())
+}
+
+// Wakes JobRunner when a job is queued
+var jobQueued = make(chan struct{}, 1)
+
+func notifyJobQueued() {
+	select {
+	case jobQueued <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Repository) CreateJob(job *Job) error {
+	if err := r.db.Create(job).Error; err != nil {
+		return err
+	}
+
+	r.publish(event.JobUpdated, job)
+	notifyJobQueued()
+	return nil
+}
+
+func (r *Repository) ReadJob(id uuid.UUID) (*Job, error) {
+	job := &Job{}
+	if err := r.db.Where("id = ?", id).First(job).Error; err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Lists jobs newest first, only those in state unless it is empty. Returns
+// the total number of matching jobs along with the requested page.
+func (r *Repository) ListJobs(state string, limit int, offset int) (Jobs, int64, error) {
+	query := r.db.Model(&Job{})
+	if state != "" {
+		query = query.Where("state = ?", state)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	jobs := make(Jobs, 0)
+	err := query.Order("created_at DESC").Limit(limit).Offset(offset).Find(&jobs).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return jobs, total, nil
+}
+
+// Queues a failed job again. Files that were imported by the previous
+// attempt are skipped.
+func (r *Repository) RetryJob(id uuid.UUID) (*Job, error) {
+	job, err := r.ReadJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.State != JobFailed {
+		return nil, ErrJobNotFailed
+	}
+
+	result := r.db.Model(&Job{}).
+		Where("id = ? AND state = ?", id, JobFailed).
+		Updates(map[string]any{
+			"state":       JobQueued,
+			"done":        0,
+			"error":       "",
+			"started_at":  nil,
+			"finished_at": nil,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrJobNotFailed
+	}
+
+	job, err = r.ReadJob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.publish(event.JobUpdated, job)
+	notifyJobQueued()
+	return job, nil
+}
+
+// Deletes a job that isn't running along with its spooled files
+func (r *Repository) DeleteJob(job *Job) error {
+	result := r.db.Where("id = ? AND state != ?", job.ID, JobRunning).Delete(&Job{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobRunning
+	}
+
+	return os.RemoveAll(jobDir(job.ID))
+}
+
+// Marks the oldest queued job as running and returns it, or nil if no job
+// is queued
+func (r *Repository) claimJob() (*Job, error) {
+	jobs := make(Jobs, 0, 1)
+	err := r.db.Where("state = ?", JobQueued).Order("created_at").Limit(1).Find(&jobs).Error
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+
+	job := jobs[0]
+	now := time.Now()
+	result := r.db.Model(&Job{}).
+		Where("id = ? AND state = ?", job.ID, JobQueued).
+		Updates(map[string]any{"state": JobRunning, "started_at": now})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Deleted since it was read
+		return r.claimJob()
+	}
+
+	job.State = JobRunning
+	job.StartedAt = &now
+	return job, nil
+}
+
+// Queues jobs left running when the server stopped
+func (r *Repository) requeueInterruptedJobs() (int64, error) {
+	result := r.db.Model(&Job{}).
+		Where("state = ?", JobRunning).
+		Updates(map[string]any{"state": JobQueued, "done": 0, "started_at": nil})
+
+	return result.RowsAffected, result.Error
+}
+
+func (r *Repository) saveJob(job *Job) error {
+	return r.db.Model(&Job{}).
+		Select("*").
+		Omit("id", "created_at").
+		Where("id = ?", job.ID).
+		Updates(job).Error
+}
+
+// Runs queued import jobs one at a time
+type JobRunner struct {
+	service *BookService
+}
+
+func NewJobRunner(db *gorm.DB) *JobRunner {
+	return &JobRunner{
+		service: NewBookService(db),
+	}
+}
+
+// Runs jobs as they are queued until ctx is cancelled. Jobs interrupted by a
+// previous shutdown are run again.
+func (j *JobRunner) Run(ctx context.Context) {
+	repository := j.service.repository
+
+	n, err := repository.requeueInterruptedJobs()
+	if err != nil {
+		log.Printf("error requeueing interrupted import jobs %v", err)
+	}
+	if n > 0 {
+		log.Printf("resuming %d interrupted import jobs", n)
+	}
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			job, err := repository.claimJob()
+			if err != nil {
+				log.Printf("error reading import jobs %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			j.run(job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-jobQueued:
+		}
+	}
+}
+
+// Imports the files of a claimed job and records the results. The spooled
+// files are kept for retries unless every file was imported.
+func (j *JobRunner) run(job *Job) {
+	repository := j.service.repository
+	dir := jobDir(job.ID)
+
+	items, results, closeArchives := spooledItems(dir, job.Files, job.Kind == jobKindBatch)
+	defer closeArchives()
+
+	// Keep what a previous attempt imported, results are saved as items finish
+	if len(job.Results) == len(results) {
+		for i, previous := range job.Results {
+			if items[i] != nil && previous.File == results[i].File && previous.Outcome != "" && previous.Outcome != outcomeFailed {
+				results[i] = previous
+				items[i] = nil
+			}
+		}
+	}
+
+	job.Results = results
+	job.Total = len(results)
+	job.Done = 0
+	for _, item := range items {
+		if item == nil {
+			job.Done++
+		}
+	}
+	if err := repository.saveJob(job); err != nil {
+		log.Printf("error saving import job %s: %v", job.ID, err)
+	}
+	repository.publish(event.JobUpdated, job)
+
+	done := job.Done
+	restricted := repository.Restrict(job.VisibleSubjects)
+	j.service.importBatch(restricted, items, results, job.OnDuplicate, func(int) {
+		done++
+		err := repository.db.Model(&Job{}).
+			Select("done", "results").
+			Where("id = ?", job.ID).
+			Updates(&Job{Done: done, Results: results}).Error
+		if err != nil {
+			log.Printf("error saving progress of import job %s: %v", job.ID, err)
+		}
+
+		// Results are sent once the job ends
+		progress := *job
+		progress.Done = done
+		progress.Results = nil
+		repository.publish(event.JobUpdated, &progress)
+	})
+
+	failed := 0
+	for _, result := range results {
+		if result.Outcome == outcomeFailed {
+			failed++
+		}
+	}
+
+	now := time.Now()
+	job.Results = results
+	job.Done = len(results)
+	job.FinishedAt = &now
+	job.State = JobSucceeded
+	job.Error = ""
+	if failed > 0 {
+		job.State = JobFailed
+		job.Error = fmt.Sprintf("%d of %d files failed to import", failed, len(results))
+	}
+
+	if err := repository.saveJob(job); err != nil {
+		log.Printf("error saving import job %s: %v", job.ID, err)
+		return
+	}
+
+	repository.publish(event.JobUpdated, job)
+	log.Printf("import job %s %s", job.ID, job.State)
+	if job.State == JobSucceeded {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("error removing files of import job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// Spools the epub of a single import and queues a job importing it.
+// Responds with 202 Accepted and the job.
+func (a *BookService) queueImport(w http.ResponseWriter, r *http.Request, part *multipart.Part, onDuplicate string) {
+	job := newJob(r, jobKindImport, onDuplicate)
+
+	dir := jobDir(job.ID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Printf("error creating import job directory %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err := spoolPart(part, filepath.Join(dir, "0"))
+	var tooLarge *tooLargeError
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.As(err, &maxBytesErr) {
+		os.RemoveAll(dir)
+		log.Printf("rejecting upload %v", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Printf("error reading file from post request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	job.Files = []*JobFile{{Name: part.FileName()}}
+	a.createJob(w, job)
+}
+
+// Spools the files of a batch import and queues a job importing them.
+// Responds with 202 Accepted and the job.
+func (a *BookService) queueBatch(w http.ResponseWriter, r *http.Request, reader *multipart.Reader, onDuplicate string) {
+	job := newJob(r, jobKindBatch, onDuplicate)
+
+	dir := jobDir(job.ID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Printf("error creating import job directory %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	files, err := spoolParts(reader, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Printf("error reading batch upload %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	job.Files = files
+	a.createJob(w, job)
+}
+
+// Returns a queued job of kind for the user making req
+func newJob(req *http.Request, kind string, onDuplicate string) *Job {
+	job := &Job{ID: uuid.New(), Kind: kind, State: JobQueued, OnDuplicate: onDuplicate}
+	if user := middleware.CurrentUser(req); user != nil {
+		id := user.UserID()
+		job.UserID = &id
+		job.VisibleSubjects = user.VisibleSubjects()
+	}
+	return job
+}
+
+func (a *BookService) createJob(w http.ResponseWriter, job *Job) {
+	if err := a.repository.CreateJob(job); err != nil {
+		os.RemoveAll(jobDir(job.ID))
+		log.Printf("error creating import job %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("error marshalling job into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID.String())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(j)
+}
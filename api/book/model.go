@@ -3,15 +3,63 @@
 package book
 
 import (
+	"log"
 	"nubayrah/epub"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type Book struct {
 	ID uuid.UUID `json:"id" gorm:"<-:create"`
 	epub.Metadata
-	Filepath string `json:"filePath"`
+	Filepath   string         `json:"filePath"`
+	Sha256     string         `json:"sha256" gorm:"index"`     // Hex digest of the epub as imported
+	PartialMD5 string         `json:"partialMd5" gorm:"index"` // KOReader's hash of the epub as it is now
+	ImportedAt time.Time      `json:"importedAt" gorm:"autoCreateTime;index"`
+	DeletedAt  gorm.DeletedAt `json:"deletedAt" gorm:"index"` // Set while the book is in the trash
+
+	// Reading state of the user fetching the book and its position synced
+	// from KOReader
+	Reading  *ReadingState `json:"reading,omitempty" gorm:"-"`
+	Progress *SyncProgress `json:"progress,omitempty" gorm:"-"`
 }
 
 type Books []*Book
+
+// Creates a new book with a fresh ID for an epub stored on disk
+func NewBook(e *epub.Epub) *Book {
+	partialMD5, err := e.PartialMD5()
+	if err != nil {
+		log.Printf("error hashing %s for KOReader: %v", e.FilePath, err)
+	}
+
+	return &Book{
+		Metadata:   *e.ExtractMetadata(),
+		ID:         uuid.New(),
+		Filepath:   e.FilePath,
+		Sha256:     e.Sha256,
+		PartialMD5: partialMD5,
+	}
+}
+
+// Builds a file name of the form `Author - Title.epub` for downloads
+func downloadFileName(b *Book) string {
+	name := b.Title
+	if b.Author != "" {
+		name = b.Author + " - " + name
+	}
+
+	// Drop characters that are invalid in file names on common systems
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	return strings.TrimSpace(name) + ".epub"
+}
@@ -0,0 +1,258 @@
+// Parsing of list query parameters into filters, sorting and pagination.
+
+package book
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Page size used when the request has no limit
+	defaultListLimit = 50
+	// Largest page size a request may ask for
+	maxListLimit = 500
+)
+
+// Sort keys accepted by the `sort` parameter and the columns they order by.
+// Empty sort columns fall back to the display value so they don't all
+// collect at the start of the list.
+var sortColumns = map[string][]string{
+	"title":      {"title"},
+	"titleSort":  {"COALESCE(NULLIF(title_sort, ''), title)"},
+	"author":     {"author"},
+	"authorSort": {"COALESCE(NULLIF(author_sort, ''), author)"},
+	"series":     {"series", "series_num"},
+	"pubDate":    {"pub_date"},
+	"importedAt": {"imported_at"},
+}
+
+// Filters, sorting and pagination for Repository.List
+// Each filter matches any of its values, different filters must all match.
+type ListOptions struct {
+	Authors    []string
+	Series     []string
+	Languages  []string
+	Subjects   []string
+	Publishers []string
+	Statuses   []string  // Reading statuses of Reader
+	Reader     uuid.UUID // Set by handlers, see ReaderID
+
+	// Books must credit any of these authors, set by handlers
+	AuthorIDs []uuid.UUID
+
+	// Collections of Reader, books must be in any of them
+	Collections []uuid.UUID
+	collections Collections // Loaded by the repository
+
+	Sort []SortField
+
+	Limit  int // 0 returns all matching books
+	Offset int
+}
+
+type SortField struct {
+	Key  string
+	Desc bool
+}
+
+// Reads ListOptions from the query parameters of a GET /books request
+//
+//	?author=&series=&language=&subject=&publisher=  filters, may be repeated
+//	?status=reading                                  reading status filter, may be repeated
+//	?collection=<id>                                 collection filter, may be repeated
+//	?sort=authorSort,-pubDate                        sort keys, `-` for descending
+//	?limit=50&offset=100                             pagination
+func ParseListOptions(query url.Values) (*ListOptions, error) {
+	opts := &ListOptions{
+		Authors:    query["author"],
+		Series:     query["series"],
+		Languages:  query["language"],
+		Subjects:   query["subject"],
+		Publishers: query["publisher"],
+		Statuses:   query["status"],
+		Limit:      defaultListLimit,
+	}
+
+	for _, status := range opts.Statuses {
+		if !slices.Contains(ReadingStatuses, status) {
+			return nil, fmt.Errorf("invalid reading status %q", status)
+		}
+	}
+
+	for _, v := range query["collection"] {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid collection %q", v)
+		}
+		opts.Collections = append(opts.Collections, id)
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, fmt.Errorf("invalid limit %q, must be between 1 and %d", v, maxListLimit)
+		}
+		opts.Limit = limit
+	}
+
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset %q", v)
+		}
+		opts.Offset = offset
+	}
+
+	if v := query.Get("sort"); v != "" {
+		for _, key := range strings.Split(v, ",") {
+			field := SortField{Key: strings.TrimSpace(key)}
+			if strings.HasPrefix(field.Key, "-") {
+				field.Key = field.Key[1:]
+				field.Desc = true
+			}
+			if _, ok := sortColumns[field.Key]; !ok {
+				return nil, fmt.Errorf("invalid sort key %q", field.Key)
+			}
+			opts.Sort = append(opts.Sort, field)
+		}
+	}
+
+	return opts, nil
+}
+
+// Adds the where clauses for all filters to tx
+func (o *ListOptions) filter(tx *gorm.DB) *gorm.DB {
+	match := func(tx *gorm.DB, column string, values []string) *gorm.DB {
+		if len(values) == 0 {
+			return tx
+		}
+		return tx.Where(fmt.Sprintf("%s COLLATE NOCASE IN ?", column), values)
+	}
+
+	// Columns are qualified as the search query joins tables with the same
+	// column names
+	tx = match(tx, "books.author", o.Authors)
+	tx = match(tx, "books.series", o.Series)
+	tx = match(tx, "books.language", o.Languages)
+	tx = match(tx, "books.publisher", o.Publishers)
+
+	if len(o.AuthorIDs) > 0 {
+		tx = tx.Where("books.id IN (SELECT book_id FROM book_authors WHERE author_id IN ?)", o.AuthorIDs)
+	}
+
+	// Subjects are stored as a json array
+	if len(o.Subjects) > 0 {
+		tx = tx.Where("EXISTS (SELECT 1 FROM json_each(books.subjects) WHERE json_each.value COLLATE NOCASE IN ?)", o.Subjects)
+	}
+
+	// Books without a reading state are unread
+	if len(o.Statuses) > 0 {
+		const state = "SELECT 1 FROM reading_states WHERE reading_states.book_id = books.id AND reading_states.user_id = ?"
+		if slices.Contains(o.Statuses, StatusUnread) {
+			tx = tx.Where("(EXISTS ("+state+" AND reading_states.status IN ?) OR NOT EXISTS ("+state+" AND reading_states.status != ?))",
+				o.Reader, o.Statuses, o.Reader, StatusUnread)
+		} else {
+			tx = tx.Where("EXISTS ("+state+" AND reading_states.status IN ?)", o.Reader, o.Statuses)
+		}
+	}
+
+	// Smart collections are evaluated as part of the query
+	if len(o.Collections) > 0 {
+		where, args := collectionsWhere(o.collections)
+		tx = tx.Where(where, args...)
+	}
+
+	return tx
+}
+
+// Adds the order clauses to tx. Books are always ordered by id last so
+// pages are stable between requests. Books of a single manual collection
+// are in the collection's order unless sorted otherwise.
+func (o *ListOptions) order(tx *gorm.DB) *gorm.DB {
+	sort := o.Sort
+	if len(sort) == 0 && len(o.collections) == 1 && len(o.Collections) == 1 && o.collections[0].Rules == nil {
+		// An expression replaces the whole order, so it includes the id
+		return tx.Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:  "(SELECT position FROM collection_books WHERE collection_id = ? AND book_id = books.id), id",
+			Vars: []any{o.collections[0].ID},
+		}})
+	} else if len(sort) == 0 {
+		sort = []SortField{{Key: "titleSort"}}
+	}
+
+	for _, field := range sort {
+		for _, column := range sortColumns[field.Key] {
+			if field.Desc {
+				column += " DESC"
+			}
+			tx = tx.Order(column)
+		}
+	}
+
+	return tx.Order("id")
+}
+
+// A link to another page of a paginated list
+type PageLink struct {
+	Rel  string // first, prev, next or last
+	Href string
+}
+
+// Returns links to the first, prev, next and last pages of the list requested
+// by r. Returns nil if the list is not paginated.
+func PageLinks(r *http.Request, opts *ListOptions, total int64) []PageLink {
+	if opts.Limit == 0 {
+		return nil
+	}
+
+	link := func(offset int, rel string) PageLink {
+		query := r.URL.Query()
+		query.Set("limit", strconv.Itoa(opts.Limit))
+		query.Set("offset", strconv.Itoa(offset))
+		u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		return PageLink{Rel: rel, Href: u.String()}
+	}
+
+	last := 0
+	if total > 0 {
+		last = int((total - 1) / int64(opts.Limit) * int64(opts.Limit))
+	}
+
+	links := []PageLink{link(0, "first")}
+	if opts.Offset > 0 {
+		links = append(links, link(max(0, opts.Offset-opts.Limit), "prev"))
+	}
+	if int64(opts.Offset+opts.Limit) < total {
+		links = append(links, link(opts.Offset+opts.Limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+
+	return links
+}
+
+// Sets the Link header with first, prev, next and last pages and the
+// X-Total-Count header
+func SetPaginationHeaders(w http.ResponseWriter, r *http.Request, opts *ListOptions, total int64) {
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+	links := PageLinks(r, opts, total)
+	if len(links) == 0 {
+		return
+	}
+
+	header := make([]string, len(links))
+	for i, link := range links {
+		header[i] = fmt.Sprintf(`<%s>; rel="%s"`, link.Href, link.Rel)
+	}
+
+	w.Header().Set("Link", strings.Join(header, ", "))
+}
@@ -0,0 +1,244 @@
+// Reading status, position and history of books per user.
+
+package book
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"nubayrah/api/router/middleware"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reading statuses of a book
+const (
+	StatusUnread    = "unread"
+	StatusReading   = "reading"
+	StatusFinished  = "finished"
+	StatusAbandoned = "abandoned"
+)
+
+var ReadingStatuses = []string{StatusUnread, StatusReading, StatusFinished, StatusAbandoned}
+
+// Where a user is in a book. Books without a state are unread.
+type ReadingState struct {
+	UserID     uuid.UUID  `json:"-" gorm:"primaryKey"`
+	BookID     uuid.UUID  `json:"bookId" gorm:"primaryKey;index"`
+	Status     string     `json:"status" gorm:"index"`
+	CFI        string     `json:"cfi,omitempty"`        // EPUB CFI of the position
+	SpineIndex *int       `json:"spineIndex,omitempty"` // Spine item of the position, for readers without CFIs
+	Percentage float64    `json:"percentage"`           // Between 0 and 1
+	StartedAt  *time.Time `json:"startedAt"`            // Start of the current or last read
+	FinishedAt *time.Time `json:"finishedAt"`
+	UpdatedAt  time.Time  `json:"updatedAt" gorm:"autoUpdateTime;index"`
+}
+
+type ReadingStates []*ReadingState
+
+// An update of a reading state, kept as the reading history
+type ReadingEntry struct {
+	ID         uuid.UUID `json:"id" gorm:"<-:create"`
+	UserID     uuid.UUID `json:"-" gorm:"index"`
+	BookID     uuid.UUID `json:"bookId" gorm:"index"`
+	Status     string    `json:"status"`
+	CFI        string    `json:"cfi,omitempty"`
+	SpineIndex *int      `json:"spineIndex,omitempty"`
+	Percentage float64   `json:"percentage"`
+	CreatedAt  time.Time `json:"createdAt" gorm:"autoCreateTime;index"`
+}
+
+type ReadingEntries []*ReadingEntry
+
+// Fields of a reading state that can be set by PATCH /reading/{id}
+type ReadingUpdate struct {
+	Status     *string  `json:"status"`
+	CFI        *string  `json:"cfi"`
+	SpineIndex *int     `json:"spineIndex"`
+	Percentage *float64 `json:"percentage"`
+}
+
+func (u *ReadingUpdate) Validate() error {
+	if u.Status != nil && !slices.Contains(ReadingStatuses, *u.Status) {
+		return fmt.Errorf("unknown reading status %q", *u.Status)
+	}
+	if u.CFI != nil && *u.CFI != "" && !(strings.HasPrefix(*u.CFI, "epubcfi(/") && strings.HasSuffix(*u.CFI, ")")) {
+		return fmt.Errorf("invalid cfi %q", *u.CFI)
+	}
+	if u.SpineIndex != nil && *u.SpineIndex < 0 {
+		return errors.New("spineIndex must not be negative")
+	}
+	if u.Percentage != nil && (*u.Percentage < 0 || *u.Percentage > 1) {
+		return errors.New("percentage must be between 0 and 1")
+	}
+	return nil
+}
+
+// Applies update to the state. Moving the position of an unread book starts
+// reading it, finishing it moves to the end and marking it unread forgets the
+// position.
+func (s *ReadingState) apply(update *ReadingUpdate, now time.Time) {
+	previous := s.Status
+	moved := update.CFI != nil || update.SpineIndex != nil || update.Percentage != nil
+
+	if update.CFI != nil {
+		s.CFI = *update.CFI
+	}
+	if update.SpineIndex != nil {
+		s.SpineIndex = update.SpineIndex
+	}
+	if update.Percentage != nil {
+		s.Percentage = *update.Percentage
+	}
+
+	if update.Status != nil {
+		s.Status = *update.Status
+	} else if moved && s.Status == StatusUnread {
+		s.Status = StatusReading
+	}
+
+	switch s.Status {
+	case StatusUnread:
+		*s = ReadingState{UserID: s.UserID, BookID: s.BookID, Status: StatusUnread}
+	case StatusReading:
+		// Reading a finished or abandoned book again starts a new read
+		if s.StartedAt == nil || previous != StatusReading {
+			s.StartedAt = &now
+		}
+		s.FinishedAt = nil
+	case StatusFinished:
+		if s.StartedAt == nil {
+			s.StartedAt = &now
+		}
+		if previous != StatusFinished {
+			s.FinishedAt = &now
+		}
+		if update.Percentage == nil {
+			s.Percentage = 1
+		}
+	case StatusAbandoned:
+		if s.StartedAt == nil {
+			s.StartedAt = &now
+		}
+		s.FinishedAt = nil
+	}
+}
+
+// Returns the ID of the user making req. Requests without a user, which are
+// only allowed while config.auth_required is off, share the state of
+// uuid.Nil.
+func ReaderID(req *http.Request) uuid.UUID {
+	if user := middleware.CurrentUser(req); user != nil {
+		return user.UserID()
+	}
+	return uuid.Nil
+}
+
+// Returns the reading state of a book for a user, unread if the user has none
+func (r *Repository) ReadReadingState(userID uuid.UUID, bookID uuid.UUID) (*ReadingState, error) {
+	states := make(ReadingStates, 0, 1)
+	err := r.db.Where("user_id = ? AND book_id = ?", userID, bookID).Limit(1).Find(&states).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(states) == 0 {
+		return &ReadingState{UserID: userID, BookID: bookID, Status: StatusUnread}, nil
+	}
+
+	return states[0], nil
+}
+
+// Applies update to a user's reading state of a book and adds it to the
+// reading history. Returns the new state.
+func (r *Repository) UpdateReadingState(userID uuid.UUID, bookID uuid.UUID, update *ReadingUpdate) (*ReadingState, error) {
+	var state *ReadingState
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		state, err = (&Repository{db: tx}).ReadReadingState(userID, bookID)
+		if err != nil {
+			return err
+		}
+
+		state.apply(update, time.Now())
+		err = tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(state).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&ReadingEntry{
+			ID:         uuid.New(),
+			UserID:     userID,
+			BookID:     bookID,
+			Status:     state.Status,
+			CFI:        state.CFI,
+			SpineIndex: state.SpineIndex,
+			Percentage: state.Percentage,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Returns a page of a user's reading states of visible books, most recently
+// updated first, only those with one of statuses unless it is empty. Unread
+// books only have a state if they were marked unread. Returns the total
+// number of matching states along with the page.
+func (r *Repository) ListReadingStates(userID uuid.UUID, statuses []string, limit int, offset int) (ReadingStates, int64, error) {
+	query := r.visible(r.db.Model(&ReadingState{}).
+		Joins("JOIN books ON books.id = reading_states.book_id AND books.deleted_at IS NULL")).
+		Where("reading_states.user_id = ?", userID)
+	if len(statuses) > 0 {
+		query = query.Where("reading_states.status IN ?", statuses)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	states := make(ReadingStates, 0)
+	tx := query.Select("reading_states.*").Order("reading_states.updated_at DESC")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	if err := tx.Offset(offset).Find(&states).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return states, total, nil
+}
+
+// Returns a page of a user's reading history of visible books, newest first,
+// only for bookID unless it is uuid.Nil
+func (r *Repository) ListReadingHistory(userID uuid.UUID, bookID uuid.UUID, limit int, offset int) (ReadingEntries, int64, error) {
+	query := r.visible(r.db.Model(&ReadingEntry{}).
+		Joins("JOIN books ON books.id = reading_entries.book_id AND books.deleted_at IS NULL")).
+		Where("reading_entries.user_id = ?", userID)
+	if bookID != uuid.Nil {
+		query = query.Where("reading_entries.book_id = ?", bookID)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	entries := make(ReadingEntries, 0)
+	tx := query.Select("reading_entries.*").Order("reading_entries.created_at DESC")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	if err := tx.Offset(offset).Find(&entries).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return entries, total, nil
+}
@@ -3,12 +3,33 @@
 package book
 
 import (
+	"fmt"
+	"net/http"
+	"nubayrah/api/event"
+	"nubayrah/api/router/middleware"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type Repository struct {
-	db *gorm.DB
+	db      *gorm.DB
+	pending *[]pendingEvent // Events held back until the transaction commits
+
+	// Books without one of these subjects are hidden from reads, nil shows
+	// every book
+	visibleSubjects []string
+}
+
+type pendingEvent struct {
+	typ  string
+	data any
+	book *Book
+}
+
+// Payload of events about a book that no longer exists in the library
+type bookRef struct {
+	ID uuid.UUID `json:"id"`
 }
 
 func NewRepository(db *gorm.DB) *Repository {
@@ -17,43 +38,211 @@ func NewRepository(db *gorm.DB) *Repository {
 	}
 }
 
-func (r *Repository) List() (Books, error) {
+// Returns a copy of the repository that only reads books having at least
+// one of subjects. No subjects shows every book.
+func (r *Repository) Restrict(subjects []string) *Repository {
+	restricted := *r
+	restricted.visibleSubjects = nil
+	if len(subjects) > 0 {
+		restricted.visibleSubjects = subjects
+	}
+	return &restricted
+}
+
+// Returns a copy of the repository only reading the books the user making
+// req may see
+func (r *Repository) For(req *http.Request) *Repository {
+	if user := middleware.CurrentUser(req); user != nil {
+		return r.Restrict(user.VisibleSubjects())
+	}
+	return r
+}
+
+// Hides the books the repository is restricted from in a query joining the
+// books table, for queries on tables related to books
+func (r *Repository) Visible(tx *gorm.DB) *gorm.DB {
+	return r.visible(tx)
+}
+
+// Hides the books the repository is restricted from in a query on books
+func (r *Repository) visible(tx *gorm.DB) *gorm.DB {
+	if r.visibleSubjects == nil {
+		return tx
+	}
+	return tx.Where("EXISTS (SELECT 1 FROM json_each(books.subjects) WHERE json_each.value COLLATE NOCASE IN ?)", r.visibleSubjects)
+}
+
+// Returns the page of books matching opts along with the total number of
+// matching books
+func (r *Repository) List(opts *ListOptions) (Books, int64, error) {
+	if err := r.loadCollections(opts); err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	if err := opts.filter(r.visible(r.db.Model(&Book{}))).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
 	books := make([]*Book, 0)
-	if err := r.db.Find(&books).Error; err != nil {
+	tx := opts.order(opts.filter(r.visible(r.db)))
+	if opts.Limit > 0 {
+		tx = tx.Limit(opts.Limit)
+	}
+	if err := tx.Offset(opts.Offset).Find(&books).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return books, total, nil
+}
+
+// A distinct value of a book field and the number of books having it
+type Group struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Fields that books can be grouped by with Repository.ListGroups
+var groupColumns = map[string]string{
+	"author":  "books.author",
+	"series":  "books.series",
+	"subject": "json_each.value",
+}
+
+// Returns a page of the distinct values of field ("author", "series" or
+// "subject") ordered by value, along with the total number of values
+func (r *Repository) ListGroups(field string, limit int, offset int) ([]*Group, int64, error) {
+	column, ok := groupColumns[field]
+	if !ok {
+		return nil, 0, fmt.Errorf("books cannot be grouped by %q", field)
+	}
+
+	base := func() *gorm.DB {
+		tx := r.visible(r.db.Model(&Book{}))
+		if field == "subject" {
+			// Subjects are stored as a json array
+			tx = tx.Joins("JOIN json_each(books.subjects)")
+		}
+		return tx.Where(fmt.Sprintf("%s != ''", column))
+	}
+
+	var total int64
+	if err := base().Distinct(column).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	groups := make([]*Group, 0)
+	tx := base().
+		Select(fmt.Sprintf("%s AS value, COUNT(*) AS count", column)).
+		Group(column).
+		Order(fmt.Sprintf("%s COLLATE NOCASE", column))
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	if err := tx.Offset(offset).Scan(&groups).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return groups, total, nil
+}
+
+// Returns the filepath of every book
+func (r *Repository) ListFilepaths() ([]string, error) {
+	paths := make([]string, 0)
+	if err := r.db.Model(&Book{}).Pluck("filepath", &paths).Error; err != nil {
 		return nil, err
 	}
 
-	return books, nil
+	return paths, nil
 }
 
 func (r *Repository) Create(book *Book) (*Book, error) {
 	if err := r.db.Create(book).Error; err != nil {
 		return nil, err
 	}
+	if err := r.linkAuthors(book); err != nil {
+		return nil, err
+	}
 
+	r.publishAbout(event.BookCreated, book, book)
 	return book, nil
 }
 
 func (r *Repository) Read(id uuid.UUID) (*Book, error) {
 	book := &Book{}
-	if err := r.db.Where("id = ?", id).First(&book).Error; err != nil {
+	if err := r.visible(r.db).Where("id = ?", id).First(&book).Error; err != nil {
 		return nil, err
 	}
 
 	return book, nil
 }
 
-// // func (r *Repository) Update(book *Book) (int64, error) {
-// // 	result := r.db.Model(&Book{}).
-// // 		Select("Title", "Author", "PublishedDate", "ImageURL", "Description", "UpdatedAt").
-// // 		Where("id = ?", book.ID).
-// // 		Updates(book)
+// Overwrites all editable columns of the row matching book.ID and links the
+// book to its authors
+func (r *Repository) Update(book *Book) (int64, error) {
+	result := r.db.Model(&Book{}).
+		Select("*").
+		Omit("id", "imported_at").
+		Where("id = ?", book.ID).
+		Updates(book)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.RowsAffected, result.Error
+	}
+
+	if err := r.linkAuthors(book); err != nil {
+		return 0, err
+	}
+
+	r.publishAbout(event.BookUpdated, book, book)
+	return result.RowsAffected, nil
+}
+
+func (r *Repository) UpdateFilepath(id uuid.UUID, path string) error {
+	return r.db.Model(&Book{}).Where("id = ?", id).Update("filepath", path).Error
+}
+
+// Runs fn inside a database transaction, rolling back if fn returns an error.
+// Events are only published once the transaction commits.
+func (r *Repository) Transaction(fn func(tx *Repository) error) error {
+	pending := make([]pendingEvent, 0)
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&Repository{db: tx, pending: &pending, visibleSubjects: r.visibleSubjects})
+	})
+	if err != nil {
+		return err
+	}
 
-// // 	return result.RowsAffected, result.Error
-// // }
+	for _, e := range pending {
+		r.publishAbout(e.typ, e.data, e.book)
+	}
+	return nil
+}
 
-func (r *Repository) Delete(id uuid.UUID) (int64, error) {
-	result := r.db.Where("id = ?", id).Delete(&Book{})
+func (r *Repository) Delete(book *Book) (int64, error) {
+	result := r.db.Where("id = ?", book.ID).Delete(&Book{})
 
+	if result.Error == nil && result.RowsAffected > 0 {
+		r.publishAbout(event.BookDeleted, &bookRef{ID: book.ID}, book)
+	}
 	return result.RowsAffected, result.Error
 }
+
+// Publishes an event about the library, or holds it back inside a
+// transaction
+func (r *Repository) publish(typ string, data any) {
+	r.publishAbout(typ, data, nil)
+}
+
+// Publishes an event about book, which only users who may see the book
+// receive. A nil book publishes to everyone like publish.
+func (r *Repository) publishAbout(typ string, data any, book *Book) {
+	if r.pending != nil {
+		*r.pending = append(*r.pending, pendingEvent{typ: typ, data: data, book: book})
+		return
+	}
+	if book == nil {
+		event.Publish(typ, data)
+		return
+	}
+	event.PublishAbout(typ, data, book.Subjects)
+}
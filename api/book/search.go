@@ -0,0 +1,305 @@
+// Full-text search over book metadata and content.
+//
+// Uses an FTS5 table, so go-sqlite3 must be built with the sqlite_fts5 tag.
+// Results are ranked by FTS5's bm25(). Triggers on the books table keep the
+// metadata columns in sync while the content column is filled in the
+// background by ContentIndexer.
+
+package book
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"nubayrah/epub"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// How often ContentIndexer looks for books that haven't been indexed yet
+const contentIndexInterval = 30 * time.Second
+
+// Books indexed per batch by ContentIndexer
+const contentIndexBatchSize = 10
+
+// Columns of books_fts that hold metadata, content is the extracted text
+var searchMetadataColumns = []string{"title", "author", "series", "subjects", "description"}
+
+// bm25 weights for title, author, series, subjects, description and content
+const searchWeights = "10.0, 5.0, 5.0, 2.0, 1.0, 0.5"
+
+// Returned by MigrateSearchIndex when SQLite was built without FTS5
+var ErrNoFTS5 = errors.New("full-text search needs SQLite with FTS5, build with -tags sqlite_fts5")
+
+// A book matching a search along with its rank and a highlighted excerpt
+type SearchResult struct {
+	*Book
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+// Maps books to rowids of books_fts, as the books table has no stable
+// integer key
+type searchDocument struct {
+	DocID          int64     `gorm:"column:docid;primaryKey;autoIncrement"`
+	BookID         uuid.UUID `gorm:"uniqueIndex"`
+	ContentIndexed bool
+}
+
+func (searchDocument) TableName() string {
+	return "book_search"
+}
+
+// Creates the full-text search table and the triggers that keep it in sync
+// with the books table, then adds any books missing from the index. Returns
+// ErrNoFTS5 if SQLite was built without FTS5.
+func MigrateSearchIndex(db *gorm.DB) error {
+	var fts5 bool
+	if err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5).Error; err != nil {
+		return err
+	}
+	if !fts5 {
+		return ErrNoFTS5
+	}
+
+	if err := db.AutoMigrate(&searchDocument{}); err != nil {
+		return err
+	}
+
+	statements := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS books_fts USING fts5(
+			title, author, series, subjects, description, content,
+			tokenize=unicode61
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS books_fts_insert AFTER INSERT ON books BEGIN
+			INSERT INTO book_search (book_id, content_indexed) VALUES (new.id, 0);
+			INSERT INTO books_fts (rowid, title, author, series, subjects, description)
+				VALUES ((SELECT docid FROM book_search WHERE book_id = new.id),
+					new.title, new.author, new.series, new.subjects, new.description);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS books_fts_update
+			AFTER UPDATE OF title, author, series, subjects, description ON books BEGIN
+			UPDATE books_fts SET title = new.title, author = new.author, series = new.series,
+				subjects = new.subjects, description = new.description
+				WHERE rowid = (SELECT docid FROM book_search WHERE book_id = new.id);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS books_fts_delete AFTER DELETE ON books BEGIN
+			DELETE FROM books_fts WHERE rowid = (SELECT docid FROM book_search WHERE book_id = old.id);
+			DELETE FROM book_search WHERE book_id = old.id;
+		END`,
+		// Books created before the index existed
+		`INSERT INTO book_search (book_id, content_indexed)
+			SELECT id, 0 FROM books WHERE id NOT IN (SELECT book_id FROM book_search)`,
+		`INSERT INTO books_fts (rowid, title, author, series, subjects, description)
+			SELECT book_search.docid, books.title, books.author, books.series, books.subjects, books.description
+			FROM book_search JOIN books ON books.id = book_search.book_id
+			WHERE book_search.docid NOT IN (SELECT rowid FROM books_fts)`,
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range statements {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Converts user input into an FTS5 match expression. Words and "quoted
+// phrases" must all match, a trailing * matches a prefix. Unless content is
+// set, matches are restricted to the metadata columns.
+func ParseSearchQuery(q string, content bool) (string, error) {
+	var terms []string
+
+	addTerm := func(words []string, prefix bool) {
+		if len(words) == 0 {
+			return
+		}
+		term := `"` + strings.Join(words, " ") + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+
+	// Odd parts are inside quotes
+	for i, part := range strings.Split(q, `"`) {
+		fields := strings.Fields(part)
+		if i%2 == 1 {
+			addTerm(searchWords(part), false)
+			continue
+		}
+		for _, field := range fields {
+			addTerm(searchWords(field), strings.HasSuffix(field, "*"))
+		}
+	}
+
+	if len(terms) == 0 {
+		return "", errors.New("search query has no words")
+	}
+
+	if content {
+		return strings.Join(terms, " "), nil
+	}
+
+	restricted := make([]string, len(terms))
+	for i, term := range terms {
+		restricted[i] = "{" + strings.Join(searchMetadataColumns, " ") + "}: " + term
+	}
+
+	return strings.Join(restricted, " "), nil
+}
+
+// Splits s into lowercase words the way the unicode61 tokenizer would, so
+// no FTS operators or syntax can reach the match expression
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Returns the page of books matching the full-text query ordered by rank,
+// along with the total number of matches. Filters and pagination from opts
+// apply, its sort order does not.
+func (r *Repository) Search(query string, opts *ListOptions) ([]*SearchResult, int64, error) {
+	if err := r.loadCollections(opts); err != nil {
+		return nil, 0, err
+	}
+
+	base := func() *gorm.DB {
+		return opts.filter(r.visible(r.db.Table("books_fts")).
+			Joins("JOIN book_search ON book_search.docid = books_fts.rowid").
+			Joins("JOIN books ON books.id = book_search.book_id").
+			Where("books.deleted_at IS NULL").
+			Where("books_fts MATCH ?", query))
+	}
+
+	var total int64
+	if err := base().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	type row struct {
+		Book    `gorm:"embedded"`
+		Score   float64
+		Snippet string
+	}
+	rows := make([]*row, 0)
+
+	// bm25() is lower for better matches
+	tx := base().Select(fmt.Sprintf(
+		"books.*, -bm25(books_fts, %s) AS score, "+
+			"snippet(books_fts, -1, '<mark>', '</mark>', '…', 24) AS snippet", searchWeights)).
+		Order("score DESC").
+		Order("books.id")
+	if opts.Limit > 0 {
+		tx = tx.Limit(opts.Limit)
+	}
+	if err := tx.Offset(opts.Offset).Scan(&rows).Error; err != nil {
+		return nil, 0, err
+	}
+
+	results := make([]*SearchResult, len(rows))
+	for i, row := range rows {
+		results[i] = &SearchResult{Book: &row.Book, Score: row.Score, Snippet: row.Snippet}
+	}
+
+	return results, total, nil
+}
+
+// Extracts the text of books and adds it to the full-text search index
+type ContentIndexer struct {
+	db *gorm.DB
+}
+
+func NewContentIndexer(db *gorm.DB) *ContentIndexer {
+	return &ContentIndexer{
+		db: db,
+	}
+}
+
+// Indexes pending books every contentIndexInterval until ctx is cancelled
+func (i *ContentIndexer) Run(ctx context.Context) {
+	ticker := time.NewTicker(contentIndexInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while there is a backlog
+		for {
+			n, err := i.IndexPending()
+			if err != nil {
+				log.Printf("error indexing book content %v", err)
+			}
+			if n < contentIndexBatchSize || err != nil || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Indexes the content of the next batch of books that haven't been indexed.
+// Returns the number of books processed.
+func (i *ContentIndexer) IndexPending() (int, error) {
+	pending := make([]*struct {
+		DocID    int64 `gorm:"column:docid"`
+		Filepath string
+	}, 0)
+
+	err := i.db.Table("book_search").
+		Select("book_search.docid, books.filepath").
+		Joins("JOIN books ON books.id = book_search.book_id").
+		Where("book_search.content_indexed = ?", false).
+		Limit(contentIndexBatchSize).
+		Scan(&pending).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range pending {
+		// Books that can't be read are marked indexed with no content so they
+		// aren't retried forever
+		text := ""
+		e, err := epub.OpenEpub(p.Filepath)
+		if err == nil {
+			text, err = e.ExtractText()
+			e.Close()
+		}
+		if err != nil {
+			log.Printf("error extracting text from %s: %v", p.Filepath, err)
+		}
+
+		err = i.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Exec("UPDATE books_fts SET content = ? WHERE rowid = ?", text, p.DocID).Error
+			if err != nil {
+				return err
+			}
+			return tx.Model(&searchDocument{}).
+				Where("docid = ?", p.DocID).
+				Update("content_indexed", true).Error
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(pending), nil
+}
+
+// Queues the content of a book to be indexed again by ContentIndexer
+func (r *Repository) ReindexContent(id uuid.UUID) error {
+	return r.db.Model(&searchDocument{}).
+		Where("book_id = ?", id).
+		Update("content_indexed", false).Error
+}
@@ -0,0 +1,129 @@
+// Reading progress synced from KOReader devices through the kosync API.
+
+package book
+
+import (
+	"context"
+	"log"
+	"nubayrah/epub"
+	"os"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The last reading position a user's KOReader devices pushed for a
+// document, in the kosync format
+type SyncProgress struct {
+	UserID     uuid.UUID  `json:"-" gorm:"primaryKey"`
+	Document   string     `json:"document" gorm:"primaryKey"` // KOReader's hash of the file
+	BookID     *uuid.UUID `json:"-" gorm:"index"`             // Book the document was matched to, if any
+	Progress   string     `json:"progress"`                   // KOReader's xpointer into the document
+	Percentage float64    `json:"percentage"`
+	Device     string     `json:"device"`
+	DeviceID   string     `json:"device_id"`
+	Timestamp  int64      `json:"timestamp"` // Unix time the progress was pushed
+}
+
+// Returns the book whose epub has KOReader's hash partialMD5, or nil if there
+// is none
+func (r *Repository) ReadByPartialMD5(partialMD5 string) (*Book, error) {
+	books := make(Books, 0, 1)
+	err := r.visible(r.db).Where("partial_md5 = ?", partialMD5).Limit(1).Find(&books).Error
+	if err != nil || len(books) == 0 {
+		return nil, err
+	}
+
+	return books[0], nil
+}
+
+// Stored as the KOReader hash of books whose epub is missing so backfilling
+// doesn't retry them every start. Matches no document.
+const partialMD5Missing = "missing"
+
+// Stores the KOReader hash of books imported before it was stored, until ctx
+// is cancelled. Books get their hash when they are imported and whenever
+// their epub is rewritten, so this only has work to do once.
+func BackfillPartialMD5(ctx context.Context, db *gorm.DB) error {
+	books := make(Books, 0)
+	if err := db.Where("partial_md5 = '' OR partial_md5 IS NULL").Find(&books).Error; err != nil {
+		return err
+	}
+
+	r := NewRepository(db)
+	hashed := 0
+	for _, b := range books {
+		if ctx.Err() != nil {
+			break
+		}
+
+		partialMD5, err := (&epub.Epub{FilePath: b.Filepath}).PartialMD5()
+		if os.IsNotExist(err) {
+			log.Printf("not hashing book %v for KOReader, its epub is missing", b.ID)
+			partialMD5 = partialMD5Missing
+		} else if err != nil {
+			log.Printf("error hashing book %v for KOReader: %v", b.ID, err)
+			continue
+		}
+		if err := r.UpdatePartialMD5(b.ID, partialMD5); err != nil {
+			return err
+		}
+		hashed++
+	}
+
+	if hashed > 0 {
+		log.Printf("hashed %d books for KOReader sync", hashed)
+	}
+	return nil
+}
+
+func (r *Repository) UpdatePartialMD5(id uuid.UUID, partialMD5 string) error {
+	return r.db.Model(&Book{}).Where("id = ?", id).Update("partial_md5", partialMD5).Error
+}
+
+// Stores the progress of a user's document, replacing what was pushed before
+func (r *Repository) SaveSyncProgress(p *SyncProgress) error {
+	return r.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(p).Error
+}
+
+// Returns the progress a user pushed for document, or nil if there is none
+func (r *Repository) ReadSyncProgress(userID uuid.UUID, document string) (*SyncProgress, error) {
+	progress := make([]*SyncProgress, 0, 1)
+	err := r.db.Where("user_id = ? AND document = ?", userID, document).Limit(1).Find(&progress).Error
+	if err != nil || len(progress) == 0 {
+		return nil, err
+	}
+
+	return progress[0], nil
+}
+
+// Returns the latest progress a user pushed for any document matched to a
+// book, or nil if there is none
+func (r *Repository) ReadBookSyncProgress(userID uuid.UUID, bookID uuid.UUID) (*SyncProgress, error) {
+	progress := make([]*SyncProgress, 0, 1)
+	err := r.db.Where("user_id = ? AND book_id = ?", userID, bookID).
+		Order("timestamp DESC").
+		Limit(1).
+		Find(&progress).Error
+	if err != nil || len(progress) == 0 {
+		return nil, err
+	}
+
+	return progress[0], nil
+}
+
+// Stores the KOReader hash of the epub of book after it was rewritten, logging
+// failures
+func (a *BookService) rehash(book *Book, e *epub.Epub) {
+	partialMD5, err := e.PartialMD5()
+	if err == nil {
+		err = a.repository.UpdatePartialMD5(book.ID, partialMD5)
+	}
+	if err != nil {
+		log.Printf("error hashing book %v for KOReader: %v", book.ID, err)
+		return
+	}
+
+	book.PartialMD5 = partialMD5
+}
@@ -0,0 +1,231 @@
+// Deleted books are soft-deleted and their files kept in a trash directory
+// inside the library until they are restored or purged.
+
+package book
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"nubayrah/api/event"
+	"nubayrah/epub"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	config "github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Directory inside config.library_path holding the files of deleted books.
+// Hidden so library scans skip it.
+const trashDirName = ".trash"
+
+// Directory holding the epub and cached covers of a deleted book
+func trashDir(id uuid.UUID) string {
+	return filepath.Join(config.GetString("library_path"), trashDirName, id.String())
+}
+
+// Moves the epub and cached covers of book into the trash and marks it
+// deleted. A book whose epub is already gone is still deleted.
+func (r *Repository) Trash(book *Book) error {
+	dir := trashDir(book.ID)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// Books found by scans or the inbox may be on another file system
+	trashed := filepath.Join(dir, filepath.Base(book.Filepath))
+	err = epub.MoveFile(book.Filepath, trashed)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := r.Delete(book); err != nil {
+		// Put the file back so the book stays usable
+		if rerr := epub.MoveFile(trashed, book.Filepath); rerr != nil && !os.IsNotExist(rerr) {
+			log.Printf("error moving epub of book %v back from the trash: %v", book.ID, rerr)
+		}
+		return err
+	}
+
+	// Thumbnails can be regenerated, so failing to keep them isn't an error
+	if err := os.Rename(coverCacheDir(book.ID), filepath.Join(dir, "covers")); err != nil {
+		ClearCoverCache(book.ID)
+	}
+
+	return nil
+}
+
+// Returns a page of deleted books, most recently deleted first, along with
+// the total number of deleted books
+func (r *Repository) ListTrash(limit int, offset int) (Books, int64, error) {
+	base := func() *gorm.DB {
+		return r.visible(r.db.Unscoped().Model(&Book{})).Where("deleted_at IS NOT NULL")
+	}
+
+	var total int64
+	if err := base().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	books := make(Books, 0)
+	tx := base().Order("deleted_at DESC").Order("id")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	if err := tx.Offset(offset).Find(&books).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return books, total, nil
+}
+
+// Returns the books deleted before t
+func (r *Repository) ListTrashedBefore(t time.Time) (Books, error) {
+	books := make(Books, 0)
+	err := r.db.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", t).
+		Find(&books).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return books, nil
+}
+
+func (r *Repository) ReadTrashed(id uuid.UUID) (*Book, error) {
+	book := &Book{}
+	err := r.visible(r.db.Unscoped()).
+		Where("id = ? AND deleted_at IS NOT NULL", id).
+		First(&book).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return book, nil
+}
+
+// Moves the epub of a deleted book back to where it was and undeletes it. If
+// another book took its place, the epub is restored as name_1.epub etc.
+func (r *Repository) Restore(id uuid.UUID) (*Book, error) {
+	book, err := r.ReadTrashed(id)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := trashDir(id)
+	trashed := filepath.Join(dir, filepath.Base(book.Filepath))
+	if _, err := os.Stat(trashed); err != nil {
+		return nil, err
+	}
+
+	target, err := unusedPath(book.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = epub.MoveFile(trashed, target)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.db.Unscoped().Model(&Book{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"deleted_at": nil, "filepath": target}).Error
+	if err != nil {
+		if rerr := epub.MoveFile(target, trashed); rerr != nil {
+			log.Printf("error moving epub of book %v back into the trash: %v", id, rerr)
+		}
+		return nil, err
+	}
+
+	ClearCoverCache(id)
+	if err := os.Rename(filepath.Join(dir, "covers"), coverCacheDir(id)); err != nil {
+		os.RemoveAll(filepath.Join(dir, "covers"))
+	}
+	os.RemoveAll(dir)
+
+	book.Filepath = target
+	book.DeletedAt = gorm.DeletedAt{}
+	r.publishAbout(event.BookRestored, book, book)
+	return book, nil
+}
+
+// Creates the triggers deleting the rows that belong to a book or a user
+// along with it, so purging a book or deleting a user is a single statement.
+// Packages owning other rows of books and users add their own, see
+// annotation.Migrate.
+func MigratePurge(db *gorm.DB) error {
+	statements := []string{
+		`CREATE TRIGGER IF NOT EXISTS books_purge AFTER DELETE ON books BEGIN
+			DELETE FROM reading_states WHERE book_id = old.id;
+			DELETE FROM reading_entries WHERE book_id = old.id;
+			DELETE FROM collection_books WHERE book_id = old.id;
+			DELETE FROM book_authors WHERE book_id = old.id;
+			UPDATE sync_progresses SET book_id = NULL WHERE book_id = old.id;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS users_purge AFTER DELETE ON users BEGIN
+			DELETE FROM reading_states WHERE user_id = old.id;
+			DELETE FROM reading_entries WHERE user_id = old.id;
+			DELETE FROM sync_progresses WHERE user_id = old.id;
+			DELETE FROM collection_books WHERE collection_id IN (SELECT id FROM collections WHERE user_id = old.id);
+			DELETE FROM collections WHERE user_id = old.id;
+		END`,
+	}
+
+	for _, stmt := range statements {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Permanently deletes a book and its files, whether it is in the trash or not
+func (r *Repository) Purge(book *Book) error {
+	// The rows belonging to the book go with it, see MigratePurge
+	err := r.Transaction(func(repo *Repository) error {
+		if err := repo.db.Unscoped().Where("id = ?", book.ID).Delete(&Book{}).Error; err != nil {
+			return err
+		}
+		repo.publishAbout(event.BookPurged, &bookRef{ID: book.ID}, book)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !book.DeletedAt.Valid {
+		if err := os.Remove(book.Filepath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return ClearCoverCache(book.ID)
+	}
+
+	return os.RemoveAll(trashDir(book.ID))
+}
+
+// Returns path if nothing exists there, otherwise the first unused
+// path_1.epub, path_2.epub etc.
+func unusedPath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := path[:len(path)-len(ext)]
+
+	target := path
+	for i := 1; i < 256; i++ {
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			return target, nil
+		}
+		target = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+
+	return "", errors.New("unable to find unused filename")
+}
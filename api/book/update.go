@@ -0,0 +1,150 @@
+// Writes changes to books into both the database and their epub.
+
+package book
+
+import (
+	"log"
+	"nubayrah/epub"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Writes the metadata of book into its row and its epub, then moves the epub
+// if its place in the library layout changed. The epub is rewritten before
+// the transaction and only moved over the old one once the row is updated.
+// The book stays usable at its old path if moving it fails.
+func (a *BookService) writeMetadata(book *Book) error {
+	e, err := epub.OpenEpub(book.Filepath)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+
+	e.Metadata = &book.Metadata
+	if err := e.StageChanges(); err != nil {
+		return err
+	}
+
+	err = a.repository.Transaction(func(repo *Repository) error {
+		if _, err := repo.Update(book); err != nil {
+			return err
+		}
+		return e.CommitChanges()
+	})
+	if err != nil {
+		return err
+	}
+
+	a.rehash(book, e)
+	a.relocate(book, e)
+	return nil
+}
+
+// Moves the epub of book to its place in the library layout and stores the
+// new path, logging failures
+func (a *BookService) relocate(book *Book, e *epub.Epub) {
+	oldPath := e.FilePath
+	moved, err := e.Relocate()
+	if err != nil {
+		log.Printf("error relocating book %v: %v", book.ID, err)
+		return
+	}
+	if !moved {
+		return
+	}
+
+	if err := a.repository.UpdateFilepath(book.ID, e.FilePath); err != nil {
+		log.Printf("error updating filepath of book %v: %v", book.ID, err)
+		os.MkdirAll(filepath.Dir(oldPath), os.ModePerm)
+		os.Rename(e.FilePath, oldPath)
+		return
+	}
+
+	book.Filepath = e.FilePath
+}
+
+// Replaces the epub and metadata of existing with the uploaded epub e,
+// keeping its ID. The epub is only moved over the existing one once the row
+// is updated, so a failure leaves both as they were.
+func (a *BookService) replaceBook(repo *Repository, existing *Book, e *epub.Epub) (*Book, error) {
+	book := NewBook(e)
+	book.ID = existing.ID
+	book.ImportedAt = existing.ImportedAt
+	book.Filepath = existing.Filepath
+
+	err := repo.Transaction(func(repo *Repository) error {
+		if _, err := repo.Update(book); err != nil {
+			return err
+		}
+		return e.Overwrite(existing.Filepath)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.repository.ReindexContent(book.ID); err != nil {
+		log.Printf("error queueing content of book %v for indexing: %v", book.ID, err)
+	}
+	if err := ClearCoverCache(book.ID); err != nil {
+		log.Printf("error clearing cover cache %v", err)
+	}
+
+	a.relocate(book, e)
+	return book, nil
+}
+
+// Fills in the metadata of existing that is missing from the uploaded epub e.
+// The upload itself is discarded.
+func (a *BookService) mergeBook(existing *Book, e *epub.Epub) (*Book, error) {
+	if !mergeMetadata(&existing.Metadata, e.Metadata) {
+		return existing, nil
+	}
+
+	if err := a.writeMetadata(existing); err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+// Copies the fields of src into dst where dst has none and adds the subjects
+// of src missing from dst. Returns whether dst changed.
+func mergeMetadata(dst *epub.Metadata, src *epub.Metadata) bool {
+	changed := false
+
+	fill := func(dst *string, src string) {
+		if *dst == "" && src != "" {
+			*dst = src
+			changed = true
+		}
+	}
+
+	fill(&dst.TitleSort, src.TitleSort)
+	fill(&dst.AuthorSort, src.AuthorSort)
+	fill(&dst.Language, src.Language)
+	fill(&dst.Isbn, src.Isbn)
+	fill(&dst.Publisher, src.Publisher)
+	fill(&dst.PubDate, src.PubDate)
+	fill(&dst.Rights, src.Rights)
+	fill(&dst.Description, src.Description)
+
+	if dst.Series == "" && src.Series != "" {
+		dst.Series, dst.SeriesNum = src.Series, src.SeriesNum
+		changed = true
+	}
+
+	if len(dst.Contributors) == 0 && len(src.Contributors) > 0 {
+		dst.Contributors = src.Contributors
+		changed = true
+	}
+
+	for _, subject := range src.Subjects {
+		if !slices.Contains(dst.Subjects, subject) {
+			dst.Subjects = append(dst.Subjects, subject)
+			changed = true
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,41 @@
+// Reading uploaded files from requests.
+
+package book
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	config "github.com/spf13/viper"
+)
+
+// Largest epub accepted by HandleImportBook in bytes from
+// config.max_upload_mb, 0 if uploads are unlimited
+func maxUploadSize() int64 {
+	return config.GetInt64("max_upload_mb") << 20
+}
+
+// Returns the first file in field of a multipart request. The body is read
+// as a stream, unlike Request.FormFile which buffers files in memory or in
+// temp files before returning them.
+func formFilePart(r *http.Request, field string) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == field && part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
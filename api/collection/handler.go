@@ -0,0 +1,405 @@
+// Handles the routes for the collections of the user making the request.
+
+package collection
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Service represents a service for managing collections of books.
+type Service struct {
+	repository *book.Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: book.NewRepository(db),
+	}
+}
+
+// Fields of a collection that can be set by POST and PATCH
+type collectionFields struct {
+	Name        *string    `json:"name"`
+	Description *string    `json:"description"`
+	Rules       *book.Rule `json:"rules"`
+}
+
+func (f *collectionFields) apply(c *book.Collection) {
+	if f.Name != nil {
+		c.Name = *f.Name
+	}
+	if f.Description != nil {
+		c.Description = *f.Description
+	}
+	if f.Rules != nil {
+		c.Rules = f.Rules
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Book -> ListCollections()
+	r.Get("/", s.HandleGetCollections)
+
+	// Book -> CreateCollection()
+	r.Post("/", s.HandleCreateCollection)
+
+	r.Route("/{id}", func(r chi.Router) {
+
+		// Book -> ReadCollection()
+		r.Get("/", s.HandleGetCollection)
+
+		// Book -> UpdateCollection()
+		r.Patch("/", s.HandleUpdateCollection)
+
+		// Book -> DeleteCollection()
+		r.Delete("/", s.HandleDeleteCollection)
+
+		r.Route("/books", func(r chi.Router) {
+
+			// Book -> List() of the collection
+			r.Get("/", s.HandleGetCollectionBooks)
+
+			// Book -> AddCollectionBooks()
+			r.Post("/", s.HandleAddCollectionBooks)
+
+			// Book -> SetCollectionBooks()
+			r.Put("/", s.HandleSetCollectionBooks)
+
+			// Book -> RemoveCollectionBook()
+			r.Delete("/{bookID}", s.HandleRemoveCollectionBook)
+		})
+	})
+}
+
+// Handler for listing the user's collections at /collections, by name
+func (s *Service) HandleGetCollections(w http.ResponseWriter, r *http.Request) {
+	collections, err := s.repository.For(r).ListCollections(book.ReaderID(r))
+	if err != nil {
+		log.Printf("error reading collections %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(collections)
+	if err != nil {
+		log.Printf("error marshalling collections into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for creating a collection at /collections
+// Accepts json with a name, a description and the rules of smart
+// collections. Collections without rules are manual.
+func (s *Service) HandleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	fields := &collectionFields{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fields); err != nil {
+		log.Printf("error decoding collection from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c := &book.Collection{ID: uuid.New(), UserID: book.ReaderID(r)}
+	fields.apply(c)
+	if err := c.Validate(); err != nil {
+		log.Printf("invalid collection: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	c, err := s.repository.For(r).CreateCollection(c)
+	if err != nil {
+		log.Printf("error creating collection %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(c)
+	if err != nil {
+		log.Printf("error marshalling collection into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/collections/"+c.ID.String())
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+}
+
+// Handler for a collection at /collections/{id}
+func (s *Service) HandleGetCollection(w http.ResponseWriter, r *http.Request) {
+	c := s.readCollection(w, r)
+	if c == nil {
+		return
+	}
+
+	j, err := json.Marshal(c)
+	if err != nil {
+		log.Printf("error marshalling collection into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for editing a collection at /collections/{id} from a partial json
+// body. Manual collections can't be given rules.
+func (s *Service) HandleUpdateCollection(w http.ResponseWriter, r *http.Request) {
+	c := s.readCollection(w, r)
+	if c == nil {
+		return
+	}
+
+	fields := &collectionFields{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fields); err != nil {
+		log.Printf("error decoding collection from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if fields.Rules != nil && c.Rules == nil {
+		log.Printf("manual collection %v can't be given rules", c.ID)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	fields.apply(c)
+	if err := c.Validate(); err != nil {
+		log.Printf("invalid collection: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := s.repository.For(r).UpdateCollection(c); err != nil {
+		log.Printf("error updating collection %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(c)
+	if err != nil {
+		log.Printf("error marshalling collection into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for deleting a collection at /collections/{id}
+// The books in it stay in the library.
+func (s *Service) HandleDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	c := s.readCollection(w, r)
+	if c == nil {
+		return
+	}
+
+	if err := s.repository.DeleteCollection(c); err != nil {
+		log.Printf("error deleting collection %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for the books of a collection at /collections/{id}/books
+// Books of manual collections are in the collection's order unless ?sort= is
+// given. Accepts the same filters, sorting and pagination as GET /books.
+func (s *Service) HandleGetCollectionBooks(w http.ResponseWriter, r *http.Request) {
+	c := s.readCollection(w, r)
+	if c == nil {
+		return
+	}
+
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	opts.Reader = book.ReaderID(r)
+	opts.Collections = []uuid.UUID{c.ID}
+
+	books, total, err := s.repository.For(r).List(opts)
+	if err != nil {
+		log.Printf("error reading rows %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(books)
+	if err != nil {
+		log.Printf("error marshalling books into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Handler for adding books to a manual collection at /collections/{id}/books
+// Accepts json with the bookIds to add and optionally the position to insert
+// them at, they are added at the end otherwise. Books already in the
+// collection are moved.
+func (s *Service) HandleAddCollectionBooks(w http.ResponseWriter, r *http.Request) {
+	c := s.readCollection(w, r)
+	if c == nil {
+		return
+	}
+
+	var body struct {
+		BookIDs  []uuid.UUID `json:"bookIds"`
+		Position *int        `json:"position"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		log.Printf("error decoding collection books from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	position := -1
+	if body.Position != nil {
+		position = *body.Position
+	}
+
+	err := s.repository.For(r).AddCollectionBooks(c, body.BookIDs, position)
+	s.writeCollectionBooks(w, r, c, err)
+}
+
+// Handler for replacing the books of a manual collection at
+// /collections/{id}/books
+// Accepts json with the bookIds in their new order, which reorders the
+// collection when they are the same books.
+func (s *Service) HandleSetCollectionBooks(w http.ResponseWriter, r *http.Request) {
+	c := s.readCollection(w, r)
+	if c == nil {
+		return
+	}
+
+	var body struct {
+		BookIDs []uuid.UUID `json:"bookIds"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		log.Printf("error decoding collection books from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := s.repository.For(r).SetCollectionBooks(c, body.BookIDs)
+	s.writeCollectionBooks(w, r, c, err)
+}
+
+// Handler for removing a book from a manual collection at
+// /collections/{id}/books/{bookID}
+func (s *Service) HandleRemoveCollectionBook(w http.ResponseWriter, r *http.Request) {
+	c := s.readCollection(w, r)
+	if c == nil {
+		return
+	}
+
+	bookID, err := uuid.Parse(chi.URLParam(r, "bookID"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	n, err := s.repository.RemoveCollectionBook(c, bookID)
+	if errors.Is(err, book.ErrSmartCollection) {
+		log.Printf("error removing book from collection %v", err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("error removing book from collection %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Responds to a change of the books of c with the updated collection, or
+// with the status matching err
+func (s *Service) writeCollectionBooks(w http.ResponseWriter, r *http.Request, c *book.Collection, err error) {
+	switch {
+	case errors.Is(err, book.ErrSmartCollection):
+		log.Printf("error changing books of collection %v", err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	case errors.Is(err, book.ErrUnknownBooks):
+		log.Printf("error changing books of collection %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		log.Printf("error changing books of collection %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	c, err = s.repository.For(r).ReadCollection(c.UserID, c.ID)
+	if err != nil {
+		log.Printf("error reading collection %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(c)
+	if err != nil {
+		log.Printf("error marshalling collection into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Reads the user's collection in the URL, responding 404 Not Found and
+// returning nil if there is none
+func (s *Service) readCollection(w http.ResponseWriter, r *http.Request) *book.Collection {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	c, err := s.repository.For(r).ReadCollection(book.ReaderID(r), UUID)
+	if err != nil {
+		log.Printf("error finding collection: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	return c
+}
@@ -0,0 +1,179 @@
+// Publishes changes to the library to clients following GET /events. Recent
+// events are kept in memory so clients can resume after reconnecting.
+
+package event
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Types of events
+const (
+	BookCreated    = "book.created"
+	BookUpdated    = "book.updated"
+	BookDeleted    = "book.deleted" // Moved to the trash
+	BookRestored   = "book.restored"
+	BookPurged     = "book.purged"
+	CoverChanged   = "book.cover"
+	JobUpdated     = "job.updated" // State or progress of an import job changed
+	LibraryScanned = "library.scanned"
+
+	// Sent first to clients resuming from an event that is no longer
+	// kept, they should reload everything
+	Reset = "reset"
+)
+
+// Number of events kept for clients resuming with Last-Event-ID
+const logSize = 1000
+
+// Events buffered for a subscriber before it is dropped as too slow
+const subscriberBuffer = 64
+
+type Event struct {
+	ID   int64
+	Type string
+	Data json.RawMessage
+
+	// Subjects of the book the event is about, only users who may see books
+	// with one of them receive it. Nil for events that aren't about a book.
+	Subjects []string
+}
+
+type Bus struct {
+	mu          sync.Mutex
+	log         []*Event // Ring buffer of the most recent events
+	start       int      // Index of the oldest event in log
+	lastID      int64
+	evictedID   int64 // ID of the newest event dropped from log
+	subscribers map[chan *Event]struct{}
+}
+
+// IDs start at the time the bus was created so IDs from before a restart
+// are recognized as older than anything kept
+func NewBus() *Bus {
+	now := time.Now().UnixMilli()
+	return &Bus{
+		log:         make([]*Event, 0, logSize),
+		lastID:      now,
+		evictedID:   now,
+		subscribers: make(map[chan *Event]struct{}),
+	}
+}
+
+// Bus used by the package level functions
+var defaultBus = NewBus()
+
+// Publishes an event on the default bus, data is sent as JSON
+func Publish(typ string, data any) {
+	defaultBus.Publish(typ, data)
+}
+
+// Publishes an event about a book with subjects on the default bus, see
+// Event.Subjects
+func PublishAbout(typ string, data any, subjects []string) {
+	defaultBus.PublishAbout(typ, data, subjects)
+}
+
+func (b *Bus) Publish(typ string, data any) {
+	b.publish(typ, data, nil)
+}
+
+func (b *Bus) PublishAbout(typ string, data any, subjects []string) {
+	if subjects == nil {
+		// Books without subjects are still hidden from restricted users
+		subjects = []string{}
+	}
+	b.publish(typ, data, subjects)
+}
+
+func (b *Bus) publish(typ string, data any, subjects []string) {
+	j, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("error marshalling %s event into json %v", typ, err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e := &Event{ID: b.lastID, Type: typ, Data: j, Subjects: subjects}
+
+	if len(b.log) < logSize {
+		b.log = append(b.log, e)
+	} else {
+		b.evictedID = b.log[b.start].ID
+		b.log[b.start] = e
+		b.start = (b.start + 1) % logSize
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// The client resumes from the log when it reconnects
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribes to the default bus, see Bus.Subscribe
+func Subscribe(lastID int64) ([]*Event, <-chan *Event, func()) {
+	return defaultBus.Subscribe(lastID)
+}
+
+// Returns the events published after lastID along with a channel receiving
+// new events, and a function to stop receiving them. The channel is closed
+// if the subscriber falls too far behind. Resuming from an ID that is no
+// longer kept returns a Reset event followed by every kept event. A
+// negative lastID only subscribes to new events.
+func (b *Bus) Subscribe(lastID int64) ([]*Event, <-chan *Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	missed := make([]*Event, 0)
+	if lastID >= 0 {
+		if lastID < b.evictedID || lastID > b.lastID {
+			missed = append(missed, &Event{ID: b.lastID, Type: Reset, Data: json.RawMessage("{}")})
+			lastID = b.evictedID
+		}
+		for i := range b.log {
+			e := b.log[(b.start+i)%len(b.log)]
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	ch := make(chan *Event, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+
+	return missed, ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Closes the channels of every subscriber, ending their streams
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Ends the streams of the default bus, for shutting down the server
+func CloseStreams() {
+	defaultBus.Close()
+}
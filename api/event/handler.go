@@ -0,0 +1,131 @@
+// Handles the Server-Sent Events stream of library changes.
+
+package event
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"nubayrah/api/router/middleware"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How often a comment is sent to keep idle streams from timing out
+const keepAliveInterval = 30 * time.Second
+
+// Service represents a service for following library changes.
+type Service struct {
+	bus   *Bus
+	roles map[string]string // Role users need to receive each type of event
+}
+
+// Creates a new Service. Events with a type in roles are only streamed to
+// users with the role, like the routes the events come from.
+func NewService(roles map[string]string) *Service {
+	return &Service{
+		bus:   defaultBus,
+		roles: roles,
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	// Event -> Subscribe()
+	r.Get("/", s.HandleStream)
+}
+
+// Handler for the event stream at /events
+// Streams events as they are published. Clients reconnecting with a
+// Last-Event-ID header first receive the events they missed. Events about
+// books the user may not see are left out.
+func (s *Service) HandleStream(w http.ResponseWriter, r *http.Request) {
+	lastID := int64(-1)
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("error parsing Last-Event-ID %q", v)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	}
+
+	user := middleware.CurrentUser(r)
+	rc := http.NewResponseController(w)
+
+	missed, events, unsubscribe := s.bus.Subscribe(lastID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range missed {
+		if s.visible(user, e) {
+			writeEvent(w, e)
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		log.Printf("error flushing event stream %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !s.visible(user, e) {
+				continue
+			}
+			writeEvent(w, e)
+
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Reports whether user may receive e, every event is sent without a user
+func (s *Service) visible(user middleware.User, e *Event) bool {
+	if user == nil {
+		return true
+	}
+	if role, ok := s.roles[e.Type]; ok && !user.HasRole(role) {
+		return false
+	}
+
+	allowed := user.VisibleSubjects()
+	if e.Subjects == nil || allowed == nil {
+		return true
+	}
+	// Matched without case like the books users may read
+	for _, subject := range e.Subjects {
+		for _, a := range allowed {
+			if strings.EqualFold(subject, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeEvent(w http.ResponseWriter, e *Event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+}
@@ -0,0 +1,182 @@
+// Handles the routes for following and retrying background imports.
+
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+	"slices"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var jobStates = []string{book.JobQueued, book.JobRunning, book.JobSucceeded, book.JobFailed}
+
+// Service represents a service for managing import jobs.
+type Service struct {
+	repository *book.Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: book.NewRepository(db),
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Job -> ListJobs()
+	r.Get("/", s.HandleGetJobs)
+
+	r.Route("/{id}", func(r chi.Router) {
+
+		// Job -> ReadJob()
+		r.Get("/", s.HandleGetJob)
+
+		// Job -> RetryJob()
+		r.Post("/retry", s.HandleRetryJob)
+
+		// Job -> DeleteJob()
+		r.Delete("/", s.HandleDeleteJob)
+	})
+}
+
+// Handler for listing import jobs at /jobs, newest first
+// Accepts ?state= along with ?limit= and ?offset= like GET /books.
+func (s *Service) HandleGetJobs(w http.ResponseWriter, r *http.Request) {
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	if state != "" && !slices.Contains(jobStates, state) {
+		log.Printf("unknown job state %q", state)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jobs, total, err := s.repository.ListJobs(state, opts.Limit, opts.Offset)
+	if err != nil {
+		log.Printf("error reading jobs %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(jobs)
+	if err != nil {
+		log.Printf("error marshalling jobs into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Handler for the state and progress of an import job at /jobs/{id}
+func (s *Service) HandleGetJob(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	job, err := s.repository.ReadJob(UUID)
+	if err != nil {
+		log.Printf("error finding job: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	j, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("error marshalling job into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for queueing a failed import job again at /jobs/{id}/retry
+// Responds with 409 Conflict if the job hasn't failed.
+func (s *Service) HandleRetryJob(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	job, err := s.repository.RetryJob(UUID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("error finding job: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, book.ErrJobNotFailed) {
+		log.Printf("error retrying job %s: %v", UUID, err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("error retrying job %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("error marshalling job into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(j)
+}
+
+// Handler for deleting an import job and its uploaded files at /jobs/{id}
+// Responds with 409 Conflict while the job is running.
+func (s *Service) HandleDeleteJob(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	job, err := s.repository.ReadJob(UUID)
+	if err != nil {
+		log.Printf("error finding job: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = s.repository.DeleteJob(job)
+	if errors.Is(err, book.ErrJobRunning) {
+		log.Printf("error deleting job %s: %v", UUID, err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("error deleting job %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
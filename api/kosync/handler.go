@@ -0,0 +1,238 @@
+// Handles the routes of the kosync protocol, so KOReader devices can sync
+// reading progress with Nubayrah as their progress sync server.
+
+package kosync
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/user"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Headers KOReader sends its credentials in. The key is the hex MD5 digest
+// of the password.
+const (
+	userHeader = "X-Auth-User"
+	keyHeader  = "X-Auth-Key"
+)
+
+// Error bodies of the kosync protocol, which KOReader shows to its user
+type syncError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+var (
+	errUnauthorized         = &syncError{Code: 2001, Message: "Unauthorized"}
+	errUserExists           = &syncError{Code: 2002, Message: "Username is already registered."}
+	errInvalidRequest       = &syncError{Code: 2003, Message: "Invalid request"}
+	errDocumentMissing      = &syncError{Code: 2004, Message: "Field 'document' not provided."}
+	errRegistrationDisabled = &syncError{Code: 2005, Message: "Users are created in Nubayrah, log in with your Nubayrah account."}
+)
+
+// Body of PUT /syncs/progress
+type progressUpdate struct {
+	Document   string   `json:"document"`
+	Progress   string   `json:"progress"`
+	Percentage *float64 `json:"percentage"`
+	Device     string   `json:"device"`
+	DeviceID   string   `json:"device_id"`
+}
+
+// Service represents a service for syncing KOReader reading progress.
+type Service struct {
+	users *user.Repository
+	books *book.Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		users: user.NewRepository(db),
+		books: book.NewRepository(db),
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	// User -> ReadByName()
+	r.Post("/users/create", s.HandleCreateUser)
+
+	r.Group(func(r chi.Router) {
+		r.Use(s.requireSyncUser)
+
+		// User -> CheckSyncKey()
+		r.Get("/users/auth", s.HandleAuthorize)
+
+		// Book -> SaveSyncProgress()
+		r.Put("/syncs/progress", s.HandleUpdateProgress)
+
+		// Book -> ReadSyncProgress()
+		r.Get("/syncs/progress/{document}", s.HandleGetProgress)
+	})
+}
+
+type userKey struct{}
+
+// Responds 401 Unauthorized to requests without the credentials of a user
+func (s *Service) requireSyncUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.users.ReadByName(r.Header.Get(userHeader))
+		if err != nil {
+			log.Printf("error reading user %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if u == nil || !u.CheckSyncKey(r.Header.Get(keyHeader)) {
+			log.Printf("failed KOReader login for %q", r.Header.Get(userHeader))
+			writeJSON(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
+
+func syncUser(r *http.Request) *user.User {
+	return r.Context().Value(userKey{}).(*user.User)
+}
+
+// Handler for KOReader's registration at /users/create
+// Users are created in Nubayrah, existing users are told to log in instead.
+func (s *Service) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username == "" {
+		log.Printf("error decoding KOReader registration %v", err)
+		writeJSON(w, http.StatusForbidden, errInvalidRequest)
+		return
+	}
+
+	u, err := s.users.ReadByName(body.Username)
+	if err != nil {
+		log.Printf("error reading user %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if u != nil {
+		writeJSON(w, http.StatusPaymentRequired, errUserExists)
+		return
+	}
+
+	writeJSON(w, http.StatusForbidden, errRegistrationDisabled)
+}
+
+// Handler for KOReader's login check at /users/auth
+func (s *Service) HandleAuthorize(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"authorized": "OK"})
+}
+
+// Handler for pushing the progress of a document at /syncs/progress
+// The document is matched to a book by KOReader's hash of its epub.
+func (s *Service) HandleUpdateProgress(w http.ResponseWriter, r *http.Request) {
+	var body progressUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Printf("error decoding progress %v", err)
+		writeJSON(w, http.StatusForbidden, errInvalidRequest)
+		return
+	}
+	if body.Document == "" {
+		writeJSON(w, http.StatusForbidden, errDocumentMissing)
+		return
+	}
+	if body.Progress == "" || body.Percentage == nil || body.Device == "" {
+		writeJSON(w, http.StatusForbidden, errInvalidRequest)
+		return
+	}
+
+	u := syncUser(r)
+	progress := &book.SyncProgress{
+		UserID:     u.ID,
+		Document:   body.Document,
+		Progress:   body.Progress,
+		Percentage: *body.Percentage,
+		Device:     body.Device,
+		DeviceID:   body.DeviceID,
+		Timestamp:  time.Now().Unix(),
+	}
+
+	matched, err := s.books.Restrict(u.VisibleSubjects()).ReadByPartialMD5(body.Document)
+	if err != nil {
+		log.Printf("error matching document %s to a book: %v", body.Document, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if matched != nil {
+		progress.BookID = &matched.ID
+	} else {
+		// The book's epub may have been rewritten since the device got it
+		previous, err := s.books.ReadSyncProgress(u.ID, body.Document)
+		if err != nil {
+			log.Printf("error reading progress %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if previous != nil {
+			progress.BookID = previous.BookID
+		}
+	}
+
+	if err := s.books.SaveSyncProgress(progress); err != nil {
+		log.Printf("error saving progress %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Keep the reading position in Nubayrah up to date
+	if progress.BookID != nil {
+		update := &book.ReadingUpdate{Percentage: &progress.Percentage}
+		if _, err := s.books.UpdateReadingState(u.ID, *progress.BookID, update); err != nil {
+			log.Printf("error updating reading state %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"document":  progress.Document,
+		"timestamp": progress.Timestamp,
+	})
+}
+
+// Handler for fetching the progress of a document at /syncs/progress/{document}
+// Responds with an empty object if no progress was pushed.
+func (s *Service) HandleGetProgress(w http.ResponseWriter, r *http.Request) {
+	progress, err := s.books.ReadSyncProgress(syncUser(r).ID, chi.URLParam(r, "document"))
+	if err != nil {
+		log.Printf("error reading progress %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if progress == nil {
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+	writeJSON(w, http.StatusOK, progress)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error marshalling json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
@@ -0,0 +1,85 @@
+// Handles library maintenance routes that operate on the files under
+// library_path rather than on single books.
+
+package library
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nubayrah/api/router/middleware"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	config "github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Service represents a service for maintaining the library on disk.
+type Service struct {
+	scanner    *Scanner
+	reconciler *Reconciler
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		scanner:    NewScanner(db),
+		reconciler: NewReconciler(db),
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Scanner -> Scan()
+	r.Post("/scan", s.HandleScan)
+
+	// Reconciler -> Reconcile()
+	r.Post("/reconcile", s.HandleReconcile)
+}
+
+// Handler for importing epubs already on disk at /library/scan
+// Scans config.scan_path, books are moved into the library with ?move=true.
+func (s *Service) HandleScan(w http.ResponseWriter, r *http.Request) {
+	move, _ := strconv.ParseBool(r.URL.Query().Get("move"))
+
+	result, err := s.scanner.Scan(config.GetString("scan_path"), move)
+	if err != nil {
+		log.Printf("error scanning library %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("error marshalling scan result into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for reconciling the database with the library at /library/reconcile
+// With ?dryRun=true the differences are reported without fixing them.
+func (s *Service) HandleReconcile(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+
+	report, err := s.reconciler.Reconcile(config.GetString("library_path"), dryRun)
+	if err != nil {
+		log.Printf("error reconciling library %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("error marshalling reconcile report into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
@@ -0,0 +1,189 @@
+// Finds, and optionally fixes, differences between the database and the
+// files under library_path.
+
+package library
+
+import (
+	"io/fs"
+	"log"
+	"nubayrah/api/book"
+	"nubayrah/epub"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Differences found by Reconciler.Reconcile
+type ReconcileReport struct {
+	DryRun     bool                   `json:"dryRun"`
+	Missing    book.Books             `json:"missing"`    // Books whose file no longer exists
+	Orphans    []string               `json:"orphans"`    // Epubs in the library without a book
+	Mismatched []*Mismatch            `json:"mismatched"` // Books whose file has different metadata
+	Duplicates []*book.DuplicateGroup `json:"duplicates"` // Books sharing an identifier or file
+	Failed     []*ScanFailure         `json:"failed"`     // Files that could not be read or fixed
+}
+
+// A book along with the metadata fields that differ from its file
+type Mismatch struct {
+	Book   *book.Book `json:"book"`
+	Fields []string   `json:"fields"`
+}
+
+type Reconciler struct {
+	repository *book.Repository
+	scanner    *Scanner
+}
+
+func NewReconciler(db *gorm.DB) *Reconciler {
+	return &Reconciler{
+		repository: book.NewRepository(db),
+		scanner:    NewScanner(db),
+	}
+}
+
+// Compares the books in the database with the epubs under dir. Unless dryRun
+// is set, books with missing files are deleted, orphans are imported in place
+// and mismatched books are updated from their file. Duplicates are only
+// reported as there is no telling which of them should be kept.
+func (r *Reconciler) Reconcile(dir string, dryRun bool) (*ReconcileReport, error) {
+	books, _, err := r.repository.List(&book.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{
+		DryRun:     dryRun,
+		Missing:    make(book.Books, 0),
+		Orphans:    make([]string, 0),
+		Mismatched: make([]*Mismatch, 0),
+		Duplicates: book.GroupDuplicates(books, "uid", "filePath"),
+		Failed:     make([]*ScanFailure, 0),
+	}
+
+	known := make(map[string]bool, len(books))
+	for _, b := range books {
+		known[absPath(b.Filepath)] = true
+
+		e, err := epub.OpenEpub(b.Filepath)
+		if os.IsNotExist(err) {
+			report.Missing = append(report.Missing, b)
+			continue
+		}
+		if err != nil {
+			report.Failed = append(report.Failed, &ScanFailure{Path: b.Filepath, Error: err.Error()})
+			continue
+		}
+
+		fields := metadataDiff(&b.Metadata, e.ExtractMetadata())
+		if len(fields) > 0 {
+			report.Mismatched = append(report.Mismatched, &Mismatch{Book: b, Fields: fields})
+		}
+		e.Close()
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			report.Failed = append(report.Failed, &ScanFailure{Path: path, Error: err.Error()})
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(path), ".epub") && !known[absPath(path)] {
+			report.Orphans = append(report.Orphans, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		r.fix(report)
+	}
+
+	return report, nil
+}
+
+// Applies the fixes for the differences in report. Failures are added to
+// report.Failed.
+func (r *Reconciler) fix(report *ReconcileReport) {
+	fail := func(path string, err error) {
+		log.Printf("error reconciling %s: %v", path, err)
+		report.Failed = append(report.Failed, &ScanFailure{Path: path, Error: err.Error()})
+	}
+
+	for _, b := range report.Missing {
+		// Nothing left to keep in the trash
+		if err := r.repository.Purge(b); err != nil {
+			fail(b.Filepath, err)
+		}
+	}
+
+	for _, path := range report.Orphans {
+		if _, err := r.scanner.importFile(path, false); err != nil {
+			fail(path, err)
+		}
+	}
+
+	for _, m := range report.Mismatched {
+		e, err := epub.OpenEpub(m.Book.Filepath)
+		if err != nil {
+			fail(m.Book.Filepath, err)
+			continue
+		}
+
+		updated := *m.Book
+		updated.Metadata = *e.ExtractMetadata()
+		updated.PartialMD5, err = e.PartialMD5()
+		e.Close()
+		if err != nil {
+			fail(m.Book.Filepath, err)
+			continue
+		}
+
+		if _, err := r.repository.Update(&updated); err != nil {
+			fail(m.Book.Filepath, err)
+		}
+	}
+}
+
+// Returns the json names of the metadata fields that differ between a and b
+func metadataDiff(a *epub.Metadata, b *epub.Metadata) []string {
+	fields := make([]string, 0)
+
+	va := reflect.ValueOf(a).Elem()
+	vb := reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		fa, fb := va.Field(i), vb.Field(i)
+
+		// Rows from before creators were stored only know the first one,
+		// which is compared as the author
+		if va.Type().Field(i).Name == "Creators" && a.Creators == nil {
+			continue
+		}
+
+		// Empty and missing lists are the same
+		if fa.Kind() == reflect.Slice && fa.Len() == 0 && fb.Len() == 0 {
+			continue
+		}
+
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			name, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("json"), ",")
+			fields = append(fields, name)
+		}
+	}
+
+	return fields
+}
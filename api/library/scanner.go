@@ -0,0 +1,158 @@
+// Imports epubs that are already on disk into the database.
+
+package library
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"nubayrah/api/book"
+	"nubayrah/api/event"
+	"nubayrah/epub"
+	"path/filepath"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Outcome of scanning a directory
+type ScanResult struct {
+	Added   book.Books     `json:"added"`
+	Skipped int            `json:"skipped"` // Files that were already in the database or duplicates of a book in it
+	Failed  []*ScanFailure `json:"failed"`
+}
+
+// A file that could not be imported
+type ScanFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type Scanner struct {
+	repository *book.Repository
+	books      *book.BookService
+}
+
+func NewScanner(db *gorm.DB) *Scanner {
+	return &Scanner{
+		repository: book.NewRepository(db),
+		books:      book.NewBookService(db),
+	}
+}
+
+// Walks dir and adds every epub that isn't in the database yet. Books are
+// registered where they are unless move is set, in which case they are moved
+// into the library like uploaded books. Hidden files and directories are
+// skipped.
+func (s *Scanner) Scan(dir string, move bool) (*ScanResult, error) {
+	known, err := s.knownPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ScanResult{
+		Added:  make(book.Books, 0),
+		Failed: make([]*ScanFailure, 0),
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are reported but don't stop the scan
+			result.Failed = append(result.Failed, &ScanFailure{Path: path, Error: err.Error()})
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".epub") {
+			return nil
+		}
+
+		if known[absPath(path)] {
+			result.Skipped++
+			return nil
+		}
+
+		b, err := s.importFile(path, move)
+		if errors.Is(err, book.ErrDuplicate) {
+			log.Printf("skipping %s: %v", path, err)
+			result.Skipped++
+			return nil
+		}
+		if err != nil {
+			log.Printf("error importing %s: %v", path, err)
+			result.Failed = append(result.Failed, &ScanFailure{Path: path, Error: err.Error()})
+			return nil
+		}
+
+		// Moved books may land in a directory that hasn't been walked yet
+		known[absPath(b.Filepath)] = true
+		result.Added = append(result.Added, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	event.Publish(event.LibraryScanned, &scanSummary{
+		Dir:     dir,
+		Added:   len(result.Added),
+		Skipped: result.Skipped,
+		Failed:  len(result.Failed),
+	})
+	return result, nil
+}
+
+// Payload of the event published when a scan finishes, the added books are
+// published as they are created
+type scanSummary struct {
+	Dir     string `json:"dir"`
+	Added   int    `json:"added"`
+	Skipped int    `json:"skipped"`
+	Failed  int    `json:"failed"`
+}
+
+// Opens the epub at path and creates its database row. Duplicates of books
+// in the library are rejected like uploads.
+func (s *Scanner) importFile(path string, move bool) (*book.Book, error) {
+	e, err := epub.OpenEpub(path)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+
+	return s.books.ImportInPlace(e, move)
+}
+
+// Returns the set of absolute paths of all books in the database
+func (s *Scanner) knownPaths() (map[string]bool, error) {
+	paths, err := s.repository.ListFilepaths()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		known[absPath(p)] = true
+	}
+
+	return known, nil
+}
+
+// Cleans path and makes it absolute so paths stored relative to different
+// working directories compare equal
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
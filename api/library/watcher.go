@@ -0,0 +1,218 @@
+// Imports epubs dropped into an inbox directory. Files are imported once
+// they stop changing, then moved to imported/ or, along with a log of the
+// error, to failed/.
+
+package library
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"nubayrah/api/book"
+	"nubayrah/epub"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gorm.io/gorm"
+)
+
+// Subdirectories of the inbox processed files are moved to
+const (
+	inboxImportedDir = "imported"
+	inboxFailedDir   = "failed"
+)
+
+type Watcher struct {
+	books    *book.BookService
+	dir      string
+	debounce time.Duration // Time a file must be left unchanged before importing it
+	timers   map[string]*time.Timer
+	ready    chan string
+}
+
+func NewWatcher(db *gorm.DB, dir string, debounce time.Duration) *Watcher {
+	return &Watcher{
+		books:    book.NewBookService(db),
+		dir:      dir,
+		debounce: debounce,
+		timers:   make(map[string]*time.Timer),
+		ready:    make(chan string),
+	}
+}
+
+// Watches the inbox until ctx is cancelled. Epubs already in the inbox are
+// imported on start.
+func (w *Watcher) Run(ctx context.Context) error {
+	for _, sub := range []string{inboxImportedDir, inboxFailedDir} {
+		err := os.MkdirAll(filepath.Join(w.dir, sub), os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = watcher.Add(w.dir)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			w.schedule(ctx, filepath.Join(w.dir, entry.Name()))
+		}
+	}
+
+	defer func() {
+		for _, timer := range w.timers {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+				w.schedule(ctx, event.Name)
+			} else if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				w.cancel(event.Name)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("error watching inbox %v", err)
+
+		case path := <-w.ready:
+			delete(w.timers, path)
+			w.process(ctx, path)
+		}
+	}
+}
+
+// Starts or restarts the debounce timer of an epub in the inbox. Hidden files
+// are ignored, so partial downloads and sync temp files aren't picked up.
+func (w *Watcher) schedule(ctx context.Context, path string) {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") || !strings.EqualFold(filepath.Ext(name), ".epub") {
+		return
+	}
+
+	if timer, ok := w.timers[path]; ok {
+		timer.Reset(w.debounce)
+		return
+	}
+
+	w.timers[path] = time.AfterFunc(w.debounce, func() {
+		select {
+		case w.ready <- path:
+		case <-ctx.Done():
+		}
+	})
+}
+
+func (w *Watcher) cancel(path string) {
+	if timer, ok := w.timers[path]; ok {
+		timer.Stop()
+		delete(w.timers, path)
+	}
+}
+
+// Imports the file at path unless it was changed within the debounce time
+func (w *Watcher) process(ctx context.Context, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		// Removed before it settled
+		return
+	}
+
+	if wait := w.debounce - time.Since(info.ModTime()); wait > 0 {
+		w.schedule(ctx, path)
+		return
+	}
+
+	b, err := w.importFile(path)
+	if err != nil {
+		log.Printf("error importing %s from inbox: %v", path, err)
+		w.fail(path, err)
+		return
+	}
+
+	log.Printf("imported %s from inbox as %s", path, b.Filepath)
+
+	_, err = moveUnused(path, filepath.Join(w.dir, inboxImportedDir))
+	if err != nil {
+		log.Printf("error moving %s out of inbox: %v", path, err)
+	}
+}
+
+// Imports the epub the same way as uploads to POST /books. Duplicates of
+// books in the library are rejected.
+func (w *Watcher) importFile(path string) (*book.Book, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	e, err := epub.Parse(file)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+
+	return w.books.Import(e)
+}
+
+// Moves the file at path to failed/ and writes err next to it
+func (w *Watcher) fail(path string, importErr error) {
+	dst, err := moveUnused(path, filepath.Join(w.dir, inboxFailedDir))
+	if err != nil {
+		log.Printf("error moving %s out of inbox: %v", path, err)
+		return
+	}
+
+	msg := fmt.Sprintf("%s\t%s\t%v\n", time.Now().Format(time.RFC3339), filepath.Base(path), importErr)
+	err = os.WriteFile(dst+".log", []byte(msg), os.ModePerm)
+	if err != nil {
+		log.Printf("error writing inbox error log %v", err)
+	}
+}
+
+// Moves the file at path into dir, numbering it as name_1.epub etc. if the
+// name is taken. Returns the new path.
+func moveUnused(path string, dir string) (string, error) {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+
+	dst := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			break
+		}
+		if i == 256 {
+			return "", fmt.Errorf("unable to find unused filename for %s", name)
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+
+	return dst, os.Rename(path, dst)
+}
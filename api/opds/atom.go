@@ -0,0 +1,216 @@
+// OPDS 1.2 rendering of feeds as atom documents.
+// https://specs.opds.io/opds-1.2
+
+package opds
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+	"strconv"
+	"time"
+)
+
+const (
+	atomNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	atomAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	openSearchType      = "application/opensearchdescription+xml"
+)
+
+type atomFeed struct {
+	XMLName      xml.Name     `xml:"feed"`
+	Xmlns        string       `xml:"xmlns,attr"`
+	XmlnsDC      string       `xml:"xmlns:dc,attr"`
+	XmlnsOPDS    string       `xml:"xmlns:opds,attr"`
+	XmlnsOS      string       `xml:"xmlns:opensearch,attr"`
+	XmlnsThr     string       `xml:"xmlns:thr,attr"`
+	ID           string       `xml:"id"`
+	Title        string       `xml:"title"`
+	Updated      string       `xml:"updated"`
+	Author       *atomAuthor  `xml:"author"`
+	TotalResults string       `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage string       `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex   string       `xml:"opensearch:startIndex,omitempty"`
+	Links        []*atomLink  `xml:"link"`
+	Entries      []*atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name   string `xml:"name"`
+	FileAs string `xml:"opds:file-as,omitempty"`
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+	Count string `xml:"thr:count,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string          `xml:"title"`
+	ID         string          `xml:"id"`
+	Updated    string          `xml:"updated"`
+	Authors    []*atomAuthor   `xml:"author"`
+	Language   string          `xml:"dc:language,omitempty"`
+	Issued     string          `xml:"dc:issued,omitempty"`
+	Publisher  string          `xml:"dc:publisher,omitempty"`
+	Identifier string          `xml:"dc:identifier,omitempty"`
+	Categories []*atomCategory `xml:"category"`
+	Summary    *atomText       `xml:"summary"`
+	Content    *atomText       `xml:"content"`
+	Links      []*atomLink     `xml:"link"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type openSearchDescription struct {
+	XMLName        xml.Name       `xml:"OpenSearchDescription"`
+	Xmlns          string         `xml:"xmlns,attr"`
+	ShortName      string         `xml:"ShortName"`
+	Description    string         `xml:"Description"`
+	InputEncoding  string         `xml:"InputEncoding"`
+	OutputEncoding string         `xml:"OutputEncoding"`
+	URL            *openSearchURL `xml:"Url"`
+}
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+// OPDS 1.2 feeds served under /opds
+type atomFormat struct{}
+
+func (atomFormat) base() string {
+	return "/opds"
+}
+
+func (atomFormat) contentType(kind feedKind) string {
+	if kind == kindAcquisition {
+		return atomAcquisitionType
+	}
+	return atomNavigationType
+}
+
+func (f atomFormat) write(w io.Writer, fd *feed) error {
+	af := &atomFeed{
+		Xmlns:     "http://www.w3.org/2005/Atom",
+		XmlnsDC:   "http://purl.org/dc/terms/",
+		XmlnsOPDS: "http://opds-spec.org/2010/catalog",
+		XmlnsOS:   "http://a9.com/-/spec/opensearch/1.1/",
+		XmlnsThr:  "http://purl.org/syndication/thread/1.0",
+		ID:        fd.ID,
+		Title:     fd.Title,
+		Updated:   fd.Updated.Format(time.RFC3339),
+		Author:    &atomAuthor{Name: "Nubayrah"},
+		Links: []*atomLink{
+			{Rel: "self", Href: fd.Self, Type: f.contentType(fd.Kind)},
+			{Rel: "start", Href: f.base(), Type: atomNavigationType},
+			{Rel: "search", Href: f.base() + "/search.xml", Type: openSearchType},
+		},
+	}
+
+	if len(fd.Pages) > 0 {
+		af.TotalResults = strconv.FormatInt(fd.Total, 10)
+		af.ItemsPerPage = strconv.Itoa(fd.ItemsPerPage)
+		af.StartIndex = strconv.Itoa(fd.Offset + 1)
+	}
+	for _, page := range fd.Pages {
+		rel := page.Rel
+		if rel == "prev" {
+			rel = "previous"
+		}
+		af.Links = append(af.Links, &atomLink{Rel: rel, Href: page.Href, Type: f.contentType(fd.Kind)})
+	}
+
+	updated := fd.Updated.Format(time.RFC3339)
+	for _, nav := range fd.Navigation {
+		entry := &atomEntry{
+			Title:   nav.Title,
+			ID:      nav.Href,
+			Updated: updated,
+			Links: []*atomLink{
+				{Rel: "subsection", Href: nav.Href, Type: f.contentType(nav.Kind)},
+			},
+		}
+		if nav.Count > 0 {
+			entry.Content = &atomText{Type: "text", Text: fmt.Sprintf("%d books", nav.Count)}
+			entry.Links[0].Count = strconv.FormatInt(nav.Count, 10)
+		}
+		af.Entries = append(af.Entries, entry)
+	}
+
+	for _, b := range fd.Publications {
+		af.Entries = append(af.Entries, atomBookEntry(b))
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(af)
+}
+
+func atomBookEntry(b *book.Book) *atomEntry {
+	entry := &atomEntry{
+		Title:      b.Title,
+		ID:         fmt.Sprintf("urn:uuid:%s", b.ID),
+		Updated:    bookUpdated(b).Format(time.RFC3339),
+		Authors:    []*atomAuthor{{Name: b.Author, FileAs: b.AuthorSort}},
+		Language:   b.Language,
+		Issued:     b.PubDate,
+		Publisher:  b.Publisher,
+		Identifier: b.Uid,
+		Links: []*atomLink{
+			{Rel: "http://opds-spec.org/image", Href: coverHref(b)},
+			{Rel: "http://opds-spec.org/image/thumbnail", Href: thumbnailHref(b), Type: "image/jpeg"},
+			{Rel: "http://opds-spec.org/acquisition", Href: acquisitionHref(b), Type: middleware.HeaderValueContentTypeEpub},
+		},
+	}
+
+	for _, s := range b.Subjects {
+		entry.Categories = append(entry.Categories, &atomCategory{Term: s, Label: s})
+	}
+
+	if b.Description != "" {
+		entry.Summary = &atomText{Type: "text", Text: b.Description}
+	}
+
+	return entry
+}
+
+// Writes the OpenSearch description pointing clients to the search feed
+func (f atomFormat) writeOpenSearch(w http.ResponseWriter, r *http.Request) error {
+	desc := &openSearchDescription{
+		Xmlns:          "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:      "Nubayrah",
+		Description:    "Search the Nubayrah library",
+		InputEncoding:  "UTF-8",
+		OutputEncoding: "UTF-8",
+		URL: &openSearchURL{
+			Type:     atomAcquisitionType,
+			Template: absoluteURL(r, f.base()+"/search?q={searchTerms}"),
+		},
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(desc)
+}
@@ -0,0 +1,83 @@
+// Version independent model of a catalog feed, rendered as OPDS 1.2 (atom)
+// or OPDS 2.0 (json) by the formats in atom.go and opds2.go.
+
+package opds
+
+import (
+	"fmt"
+	"net/http"
+	"nubayrah/api/book"
+	"time"
+)
+
+// Width requested for thumbnail links
+const thumbnailWidth = 256
+
+type feedKind int
+
+const (
+	kindNavigation feedKind = iota
+	kindAcquisition
+)
+
+type feed struct {
+	ID      string
+	Title   string
+	Kind    feedKind
+	Self    string
+	Updated time.Time
+
+	// Entries of navigation feeds
+	Navigation []*navEntry
+	// Entries of acquisition feeds
+	Publications []*book.Book
+
+	// Pagination, Pages is empty for unpaginated feeds
+	Pages        []book.PageLink
+	Total        int64
+	ItemsPerPage int
+	Offset       int
+}
+
+// Link to another feed
+type navEntry struct {
+	Title string
+	Href  string
+	Kind  feedKind
+	Count int64 // Number of books in the linked feed, 0 if unknown
+}
+
+// Links of a book to its file and cover images
+func acquisitionHref(b *book.Book) string {
+	return fmt.Sprintf("/books/%s/file", b.ID)
+}
+
+func coverHref(b *book.Book) string {
+	return fmt.Sprintf("/books/%s/cover", b.ID)
+}
+
+func thumbnailHref(b *book.Book) string {
+	return fmt.Sprintf("/books/%s/cover?w=%d", b.ID, thumbnailWidth)
+}
+
+// Last modification time of a book, books imported before import times were
+// recorded fall back to now
+func bookUpdated(b *book.Book) time.Time {
+	if b.ImportedAt.IsZero() {
+		return time.Now()
+	}
+	return b.ImportedAt
+}
+
+// Absolute url of path on the host the request was made to. Needed where
+// clients don't resolve relative links, such as OpenSearch templates.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, path)
+}
@@ -0,0 +1,290 @@
+// Handles the OPDS catalog routes. The same feeds are served as OPDS 1.2
+// under /opds and as OPDS 2.0 under /opds/v2.
+
+package opds
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Renders feeds in one version of the OPDS spec
+type format interface {
+	// Path the feeds of this format are served under
+	base() string
+	contentType(kind feedKind) string
+	write(w io.Writer, fd *feed) error
+}
+
+// Builds a feed for a request, links in the feed are relative to base
+type feedFunc func(r *http.Request, base string) (*feed, error)
+
+// Returned by feedFuncs for invalid requests
+type badRequestError struct {
+	error
+}
+
+// Service represents a service for browsing books as OPDS catalogs.
+type Service struct {
+	repository *book.Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: book.NewRepository(db),
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+	s.registerFeeds(r, atomFormat{})
+
+	// OpenSearch description for OPDS 1.2 clients
+	r.Get("/search.xml", s.HandleOpenSearch)
+
+	r.Route("/v2", func(r chi.Router) {
+		s.registerFeeds(r, opds2Format{})
+	})
+}
+
+func (s *Service) registerFeeds(r chi.Router, f format) {
+	// Navigation
+	r.Get("/", s.serve(f, s.rootFeed))
+	r.Get("/authors", s.serve(f, s.groupFeed("author", "Authors", "sort=titleSort")))
+	r.Get("/series", s.serve(f, s.groupFeed("series", "Series", "sort=series")))
+	r.Get("/subjects", s.serve(f, s.groupFeed("subject", "Subjects", "sort=titleSort")))
+	r.Get("/collections", s.serve(f, s.collectionsFeed))
+
+	// Acquisition
+	r.Get("/books", s.serve(f, s.booksFeed))
+	r.Get("/search", s.serve(f, s.searchFeed))
+}
+
+// Wraps a feedFunc into a handler writing the feed in format f
+func (s *Service) serve(f format, build feedFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fd, err := build(r, f.base())
+		if _, ok := err.(badRequestError); ok {
+			log.Printf("invalid catalog request %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("error building catalog feed %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(middleware.HeaderKeyContentType, f.contentType(fd.Kind))
+		if err := f.write(w, fd); err != nil {
+			log.Printf("error writing catalog feed %v", err)
+		}
+	}
+}
+
+// Handler for the OpenSearch description at /opds/search.xml
+func (s *Service) HandleOpenSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(middleware.HeaderKeyContentType, openSearchType)
+	if err := (atomFormat{}).writeOpenSearch(w, r); err != nil {
+		log.Printf("error writing opensearch description %v", err)
+	}
+}
+
+// Start of the catalog, links to all other navigation feeds
+func (s *Service) rootFeed(r *http.Request, base string) (*feed, error) {
+	return &feed{
+		ID:      "urn:nubayrah:root",
+		Title:   "Nubayrah",
+		Kind:    kindNavigation,
+		Self:    base,
+		Updated: time.Now(),
+		Navigation: []*navEntry{
+			{Title: "Recently added", Href: base + "/books?sort=-importedAt", Kind: kindAcquisition},
+			{Title: "All books", Href: base + "/books", Kind: kindAcquisition},
+			{Title: "Authors", Href: base + "/authors", Kind: kindNavigation},
+			{Title: "Series", Href: base + "/series", Kind: kindNavigation},
+			{Title: "Subjects", Href: base + "/subjects", Kind: kindNavigation},
+			{Title: "Collections", Href: base + "/collections", Kind: kindNavigation},
+		},
+	}, nil
+}
+
+// Navigation feed listing the distinct values of field, each linking to the
+// books having that value sorted by sort
+func (s *Service) groupFeed(field string, title string, sort string) feedFunc {
+	return func(r *http.Request, base string) (*feed, error) {
+		opts, err := book.ParseListOptions(r.URL.Query())
+		if err != nil {
+			return nil, badRequestError{err}
+		}
+
+		groups, total, err := s.repository.For(r).ListGroups(field, opts.Limit, opts.Offset)
+		if err != nil {
+			return nil, err
+		}
+
+		fd := &feed{
+			ID:           fmt.Sprintf("urn:nubayrah:%s", field),
+			Title:        title,
+			Kind:         kindNavigation,
+			Self:         r.URL.RequestURI(),
+			Updated:      time.Now(),
+			Pages:        book.PageLinks(r, opts, total),
+			Total:        total,
+			ItemsPerPage: opts.Limit,
+			Offset:       opts.Offset,
+		}
+
+		for _, g := range groups {
+			fd.Navigation = append(fd.Navigation, &navEntry{
+				Title: g.Value,
+				Href:  fmt.Sprintf("%s/books?%s=%s&%s", base, field, url.QueryEscape(g.Value), sort),
+				Kind:  kindAcquisition,
+				Count: g.Count,
+			})
+		}
+
+		return fd, nil
+	}
+}
+
+// Navigation feed listing the collections of the user, each linking to the
+// books in it
+func (s *Service) collectionsFeed(r *http.Request, base string) (*feed, error) {
+	collections, err := s.repository.For(r).ListCollections(book.ReaderID(r))
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &feed{
+		ID:      "urn:nubayrah:collections",
+		Title:   "Collections",
+		Kind:    kindNavigation,
+		Self:    r.URL.RequestURI(),
+		Updated: time.Now(),
+	}
+
+	for _, c := range collections {
+		fd.Navigation = append(fd.Navigation, &navEntry{
+			Title: c.Name,
+			Href:  fmt.Sprintf("%s/books?collection=%s", base, c.ID),
+			Kind:  kindAcquisition,
+			Count: c.BookCount,
+		})
+	}
+
+	return fd, nil
+}
+
+// Acquisition feed of books, accepts the same filters, sorting and pagination
+// as GET /books
+func (s *Service) booksFeed(r *http.Request, base string) (*feed, error) {
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		return nil, badRequestError{err}
+	}
+	opts.Reader = book.ReaderID(r)
+
+	books, total, err := s.repository.For(r).List(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Feeds of a collection are titled after it
+	title := booksFeedTitle(r.URL.Query())
+	if len(opts.Collections) == 1 {
+		if c, err := s.repository.For(r).ReadCollection(opts.Reader, opts.Collections[0]); err == nil {
+			title = c.Name
+		}
+	}
+
+	return &feed{
+		ID:           "urn:nubayrah:books:" + r.URL.RawQuery,
+		Title:        title,
+		Kind:         kindAcquisition,
+		Self:         r.URL.RequestURI(),
+		Updated:      time.Now(),
+		Publications: books,
+		Pages:        book.PageLinks(r, opts, total),
+		Total:        total,
+		ItemsPerPage: opts.Limit,
+		Offset:       opts.Offset,
+	}, nil
+}
+
+// Describes the books selected by the filters in query
+func booksFeedTitle(query url.Values) string {
+	var parts []string
+	for _, filter := range []struct{ key, label string }{
+		{"author", "by"},
+		{"series", "in series"},
+		{"subject", "about"},
+		{"language", "in"},
+		{"publisher", "published by"},
+	} {
+		if values := query[filter.key]; len(values) > 0 {
+			parts = append(parts, filter.label+" "+strings.Join(values, ", "))
+		}
+	}
+
+	if len(parts) > 0 {
+		return "Books " + strings.Join(parts, " ")
+	}
+	if strings.HasPrefix(query.Get("sort"), "-importedAt") {
+		return "Recently added"
+	}
+	return "All books"
+}
+
+// Acquisition feed of books matching a full-text search. OPDS 1.2 clients
+// send the terms as ?q=, OPDS 2.0 clients as ?query=
+func (s *Service) searchFeed(r *http.Request, base string) (*feed, error) {
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		return nil, badRequestError{err}
+	}
+	opts.Reader = book.ReaderID(r)
+
+	terms := r.URL.Query().Get("q")
+	if terms == "" {
+		terms = r.URL.Query().Get("query")
+	}
+
+	query, err := book.ParseSearchQuery(terms, false)
+	if err != nil {
+		return nil, badRequestError{err}
+	}
+
+	results, total, err := s.repository.For(r).Search(query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	books := make([]*book.Book, len(results))
+	for i, result := range results {
+		books[i] = result.Book
+	}
+
+	return &feed{
+		ID:           "urn:nubayrah:search:" + r.URL.RawQuery,
+		Title:        fmt.Sprintf("Search results for %q", terms),
+		Kind:         kindAcquisition,
+		Self:         r.URL.RequestURI(),
+		Updated:      time.Now(),
+		Publications: books,
+		Pages:        book.PageLinks(r, opts, total),
+		Total:        total,
+		ItemsPerPage: opts.Limit,
+		Offset:       opts.Offset,
+	}, nil
+}
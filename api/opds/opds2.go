@@ -0,0 +1,164 @@
+// OPDS 2.0 rendering of feeds as json documents.
+// https://drafts.opds.io/opds-2.0
+
+package opds
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+	"time"
+)
+
+const opds2Type = "application/opds+json"
+
+type opds2Feed struct {
+	Metadata     *opds2FeedMetadata  `json:"metadata"`
+	Links        []*opds2Link        `json:"links"`
+	Navigation   []*opds2Link        `json:"navigation,omitempty"`
+	Publications []*opds2Publication `json:"publications,omitempty"`
+}
+
+type opds2FeedMetadata struct {
+	Title         string `json:"title"`
+	Modified      string `json:"modified"`
+	NumberOfItems int64  `json:"numberOfItems,omitempty"`
+	ItemsPerPage  int    `json:"itemsPerPage,omitempty"`
+	CurrentPage   int    `json:"currentPage,omitempty"`
+}
+
+type opds2Link struct {
+	Rel        string           `json:"rel,omitempty"`
+	Href       string           `json:"href"`
+	Type       string           `json:"type,omitempty"`
+	Title      string           `json:"title,omitempty"`
+	Templated  bool             `json:"templated,omitempty"`
+	Properties *opds2Properties `json:"properties,omitempty"`
+}
+
+type opds2Properties struct {
+	NumberOfItems int64 `json:"numberOfItems,omitempty"`
+}
+
+type opds2Publication struct {
+	Metadata *opds2PubMetadata `json:"metadata"`
+	Links    []*opds2Link      `json:"links"`
+	Images   []*opds2Link      `json:"images"`
+}
+
+type opds2PubMetadata struct {
+	Type        string           `json:"@type"`
+	Identifier  string           `json:"identifier"`
+	Title       string           `json:"title"`
+	SortAs      string           `json:"sortAs,omitempty"`
+	Author      []*opds2Contrib  `json:"author,omitempty"`
+	Language    string           `json:"language,omitempty"`
+	Published   string           `json:"published,omitempty"`
+	Modified    string           `json:"modified"`
+	Publisher   string           `json:"publisher,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Subject     []string         `json:"subject,omitempty"`
+	BelongsTo   *opds2Collection `json:"belongsTo,omitempty"`
+}
+
+type opds2Contrib struct {
+	Name     string   `json:"name"`
+	SortAs   string   `json:"sortAs,omitempty"`
+	Position *float64 `json:"position,omitempty"`
+}
+
+type opds2Collection struct {
+	Series []*opds2Contrib `json:"series"`
+}
+
+// OPDS 2.0 feeds served under /opds/v2
+type opds2Format struct{}
+
+func (opds2Format) base() string {
+	return "/opds/v2"
+}
+
+func (opds2Format) contentType(feedKind) string {
+	return opds2Type
+}
+
+func (f opds2Format) write(w io.Writer, fd *feed) error {
+	of := &opds2Feed{
+		Metadata: &opds2FeedMetadata{
+			Title:    fd.Title,
+			Modified: fd.Updated.Format(time.RFC3339),
+		},
+		Links: []*opds2Link{
+			{Rel: "self", Href: fd.Self, Type: opds2Type},
+			{Rel: "start", Href: f.base(), Type: opds2Type},
+			{Rel: "search", Href: f.base() + "/search{?query}", Type: opds2Type, Templated: true},
+		},
+	}
+
+	if len(fd.Pages) > 0 {
+		of.Metadata.NumberOfItems = fd.Total
+		of.Metadata.ItemsPerPage = fd.ItemsPerPage
+		of.Metadata.CurrentPage = fd.Offset/fd.ItemsPerPage + 1
+	}
+	for _, page := range fd.Pages {
+		rel := page.Rel
+		if rel == "prev" {
+			rel = "previous"
+		}
+		of.Links = append(of.Links, &opds2Link{Rel: rel, Href: page.Href, Type: opds2Type})
+	}
+
+	for _, nav := range fd.Navigation {
+		link := &opds2Link{Rel: "subsection", Href: nav.Href, Type: opds2Type, Title: nav.Title}
+		if nav.Count > 0 {
+			link.Properties = &opds2Properties{NumberOfItems: nav.Count}
+		}
+		of.Navigation = append(of.Navigation, link)
+	}
+
+	for _, b := range fd.Publications {
+		of.Publications = append(of.Publications, opds2BookPublication(b))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(of)
+}
+
+func opds2BookPublication(b *book.Book) *opds2Publication {
+	pub := &opds2Publication{
+		Metadata: &opds2PubMetadata{
+			Type:        "http://schema.org/Book",
+			Identifier:  fmt.Sprintf("urn:uuid:%s", b.ID),
+			Title:       b.Title,
+			SortAs:      b.TitleSort,
+			Author:      []*opds2Contrib{{Name: b.Author, SortAs: b.AuthorSort}},
+			Language:    b.Language,
+			Published:   b.PubDate,
+			Modified:    bookUpdated(b).Format(time.RFC3339),
+			Publisher:   b.Publisher,
+			Description: b.Description,
+			Subject:     b.Subjects,
+		},
+		Links: []*opds2Link{
+			{Rel: "http://opds-spec.org/acquisition", Href: acquisitionHref(b), Type: middleware.HeaderValueContentTypeEpub},
+		},
+		Images: []*opds2Link{
+			{Href: coverHref(b)},
+			{Href: thumbnailHref(b), Type: "image/jpeg"},
+		},
+	}
+
+	if b.Series != "" {
+		series := &opds2Contrib{Name: b.Series}
+		if b.SeriesNum >= 0 {
+			position := b.SeriesNum
+			series.Position = &position
+		}
+		pub.Metadata.BelongsTo = &opds2Collection{Series: []*opds2Contrib{series}}
+	}
+
+	return pub
+}
@@ -0,0 +1,218 @@
+// Handles the routes for the reading status, position and history of the
+// user making the request.
+
+package reading
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+	"nubayrah/epub"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Service represents a service for tracking what users read.
+type Service struct {
+	repository *book.Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: book.NewRepository(db),
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Book -> ListReadingStates()
+	r.Get("/", s.HandleGetReadingStates)
+
+	// Book -> ListReadingHistory()
+	r.Get("/history", s.HandleGetReadingHistory)
+
+	r.Route("/{id}", func(r chi.Router) {
+
+		// Book -> ReadReadingState()
+		r.Get("/", s.HandleGetReadingState)
+
+		// Book -> UpdateReadingState()
+		r.Patch("/", s.HandleUpdateReadingState)
+	})
+}
+
+// Handler for listing reading states at /reading, most recently updated first
+// Accepts ?status= along with ?limit= and ?offset= like GET /books.
+func (s *Service) HandleGetReadingStates(w http.ResponseWriter, r *http.Request) {
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	states, total, err := s.repository.For(r).ListReadingStates(book.ReaderID(r), opts.Statuses, opts.Limit, opts.Offset)
+	if err != nil {
+		log.Printf("error reading reading states %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(states)
+	if err != nil {
+		log.Printf("error marshalling reading states into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Handler for the reading history at /reading/history, newest first
+// Accepts ?book= along with ?limit= and ?offset= like GET /books.
+func (s *Service) HandleGetReadingHistory(w http.ResponseWriter, r *http.Request) {
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	bookID := uuid.Nil
+	if v := r.URL.Query().Get("book"); v != "" {
+		bookID, err = uuid.Parse(v)
+		if err != nil {
+			log.Printf("error parsing book uuid %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, total, err := s.repository.For(r).ListReadingHistory(book.ReaderID(r), bookID, opts.Limit, opts.Offset)
+	if err != nil {
+		log.Printf("error reading reading history %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(entries)
+	if err != nil {
+		log.Printf("error marshalling reading history into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Handler for the reading state of a book at /reading/{bookID}
+func (s *Service) HandleGetReadingState(w http.ResponseWriter, r *http.Request) {
+	b := s.readBook(w, r)
+	if b == nil {
+		return
+	}
+
+	state, err := s.repository.ReadReadingState(book.ReaderID(r), b.ID)
+	if err != nil {
+		log.Printf("error reading reading state %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("error marshalling reading state into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for updating the reading state of a book at /reading/{bookID}
+// The body is a partial book.ReadingUpdate. Every update is added to the
+// reading history.
+func (s *Service) HandleUpdateReadingState(w http.ResponseWriter, r *http.Request) {
+	b := s.readBook(w, r)
+	if b == nil {
+		return
+	}
+
+	update := &book.ReadingUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+		log.Printf("error decoding reading state %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := update.Validate(); err != nil {
+		log.Printf("invalid reading state %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if update.SpineIndex != nil {
+		e, err := epub.OpenEpub(b.Filepath)
+		if err != nil {
+			log.Printf("error opening epub of book %v: %v", b.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		spine, err := e.GetSpinePaths()
+		e.Close()
+		if err != nil {
+			log.Printf("error reading spine of book %v: %v", b.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if *update.SpineIndex >= len(spine) {
+			log.Printf("spine index %d is past the %d items of book %v", *update.SpineIndex, len(spine), b.ID)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	state, err := s.repository.UpdateReadingState(book.ReaderID(r), b.ID, update)
+	if err != nil {
+		log.Printf("error updating reading state %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("error marshalling reading state into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Reads the book in the URL, responding 404 Not Found and returning nil if
+// the user can't see it
+func (s *Service) readBook(w http.ResponseWriter, r *http.Request) *book.Book {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	b, err := s.repository.For(r).Read(UUID)
+	if err != nil {
+		log.Printf("error finding book in db: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	return b
+}
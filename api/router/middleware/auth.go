@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/google/uuid"
+	config "github.com/spf13/viper"
+)
+
+// A user that made a request
+type User interface {
+	UserID() uuid.UUID
+
+	// Reports whether the user has role or one that includes it
+	HasRole(role string) bool
+
+	// Subjects of the books the user may see, nil if it may see every book
+	VisibleSubjects() []string
+}
+
+// Identifies the user making a request from its session cookie, bearer
+// token or HTTP Basic credentials. Returns nil if there are no valid
+// credentials.
+type Authenticator interface {
+	Authenticate(r *http.Request) (User, error)
+}
+
+type userKey struct{}
+
+// Adds the user making the request to its context, requests without valid
+// credentials continue without one
+func Authenticate(a Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := a.Authenticate(r)
+			if err != nil {
+				log.Printf("error authenticating request %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Returns the user added to the request by Authenticate, or nil
+func CurrentUser(r *http.Request) User {
+	user, _ := r.Context().Value(userKey{}).(User)
+	return user
+}
+
+// Responds 401 Unauthorized to requests without a user unless
+// config.auth_required is off. A non-empty realm asks clients for HTTP Basic
+// credentials, for OPDS readers that can't log in otherwise.
+func RequireUser(realm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if CurrentUser(r) == nil && config.GetBool("auth_required") {
+				if realm != "" {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Responds 403 Forbidden to requests by users without role, or 401 if there
+// is no user, unless config.auth_required is off. Only requests with one of
+// methods are checked, all requests are if none are given.
+func RequireRole(role string, methods ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(methods) > 0 && !slices.Contains(methods, r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			user := CurrentUser(r)
+			if user == nil {
+				if config.GetBool("auth_required") {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			} else if !user.HasRole(role) {
+				log.Printf("user %s lacks role %s for %s %s", user.UserID(), role, r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
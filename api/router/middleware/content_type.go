@@ -5,7 +5,7 @@ import "net/http"
 const (
 	HeaderKeyContentType       = "Content-Type"
 	HeaderValueContentTypeJSON = "application/json;charset=utf8"
-	HeaderValueContentTypePNG  = "image/png"
+	HeaderValueContentTypeEpub = "application/epub+zip"
 )
 
 func ContentTypeJSON(next http.Handler) http.Handler {
@@ -14,10 +14,3 @@ func ContentTypeJSON(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-
-func ContentTypePNG(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set(HeaderKeyContentType, HeaderValueContentTypePNG)
-		next.ServeHTTP(w, r)
-	})
-}
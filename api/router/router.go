@@ -2,7 +2,20 @@ package router
 
 import (
 	"net/http"
+	"nubayrah/api/annotation"
+	"nubayrah/api/author"
 	"nubayrah/api/book"
+	"nubayrah/api/collection"
+	"nubayrah/api/event"
+	"nubayrah/api/job"
+	"nubayrah/api/kosync"
+	"nubayrah/api/library"
+	"nubayrah/api/opds"
+	"nubayrah/api/reading"
+	apimiddleware "nubayrah/api/router/middleware"
+	"nubayrah/api/trash"
+	"nubayrah/api/user"
+	"nubayrah/api/webhook"
 	"os"
 	"path"
 	"strings"
@@ -10,6 +23,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/spf13/viper"
 	"gorm.io/gorm"
 )
 
@@ -20,28 +34,92 @@ func NewRouter(db *gorm.DB) chi.Router {
 	// Create multiplexer/router for the server
 	r := chi.NewRouter()
 
-	// Include CORS handler to fix CORS error in API calls.
-	r.Use(cors.Handler(cors.Options{
-		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
-		AllowedOrigins: []string{"https://*", "http://*"},
-		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: false,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
-	}))
+	// Only origins listed in config.cors_origins may call the API from
+	// another site, with the user's cookies
+	if origins := viper.GetStringSlice("cors_origins"); len(origins) > 0 {
+		r.Use(cors.Handler(cors.Options{
+			AllowedOrigins:   origins,
+			AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Last-Event-ID"},
+			ExposedHeaders:   []string{"Link", "X-Total-Count", "Content-Disposition", "Location"},
+			AllowCredentials: true,
+			MaxAge:           300, // Maximum value not ignored by any of major browsers
+		}))
+	}
 
 	// Use Logger for REST API request logging.
 	r.Use(middleware.Logger)
 
+	// Identify the user of every request, routes below decide whether one
+	// is required and which role it needs. Readers can only read, editors
+	// change books and admins everything else.
+	r.Use(apimiddleware.Authenticate(user.NewAuthenticator(db)))
+	requireUser := apimiddleware.RequireUser("")
+	requireEditorForWrites := apimiddleware.RequireRole(user.RoleEditor, "POST", "PUT", "PATCH", "DELETE")
+	requireEditor := apimiddleware.RequireRole(user.RoleEditor)
+	requireAdmin := apimiddleware.RequireRole(user.RoleAdmin)
+
 	// Router path for base endpoint. Serves built react project.
 	// Used to re-route all non-defined API endpoints back to index.html react project.
 	r.Get("/*", HandleServeClient)
 
+	// Login and account routes
+	UserService := user.NewService(db)
+	r.Route("/auth", UserService.RegisterAuthRoutes)
+	r.Route("/users", UserService.RegisterRoutes)
+
+	// Annotation routes, every user annotates for themselves so readers may
+	// write them
+	AnnotationService := annotation.NewService(db)
+	r.With(requireUser).Route("/books/{id}/annotations", AnnotationService.RegisterRoutes)
+	r.With(requireUser).Route("/annotations", AnnotationService.RegisterListRoutes)
+
 	// Book object routes
 	BookService := book.NewBookService(db)
-	r.Route("/books", BookService.RegisterRoutes)
+	r.With(requireUser, requireEditorForWrites).Route("/books", BookService.RegisterRoutes)
+
+	// Author routes, renaming and merging rewrites the epubs of their books
+	AuthorService := author.NewService(db)
+	r.With(requireUser, requireEditorForWrites).Route("/authors", AuthorService.RegisterRoutes)
+
+	// Reading status and history routes, every user tracks their own
+	ReadingService := reading.NewService(db)
+	r.With(requireUser).Route("/reading", ReadingService.RegisterRoutes)
+
+	// Collection routes, every user keeps their own collections
+	CollectionService := collection.NewService(db)
+	r.With(requireUser).Route("/collections", CollectionService.RegisterRoutes)
+
+	// Deleted book routes
+	TrashService := trash.NewService(db)
+	r.With(requireUser, requireEditor).Route("/trash", TrashService.RegisterRoutes)
+
+	// Background import job routes
+	JobService := job.NewService(db)
+	r.With(requireUser, requireEditor).Route("/jobs", JobService.RegisterRoutes)
+
+	// Library change event stream
+	EventService := event.NewService(map[string]string{
+		event.JobUpdated:     user.RoleEditor,
+		event.LibraryScanned: user.RoleAdmin,
+	})
+	r.With(requireUser).Route("/events", EventService.RegisterRoutes)
+
+	// Webhook routes
+	WebhookService := webhook.NewService(db)
+	r.With(requireUser, requireAdmin).Route("/webhooks", WebhookService.RegisterRoutes)
+
+	// Library maintenance routes
+	LibraryService := library.NewService(db)
+	r.With(requireUser, requireAdmin).Route("/library", LibraryService.RegisterRoutes)
+
+	// OPDS catalog routes, e-readers are asked for HTTP Basic credentials
+	OPDSService := opds.NewService(db)
+	r.With(apimiddleware.RequireUser("Nubayrah")).Route("/opds", OPDSService.RegisterRoutes)
+
+	// KOReader progress sync routes, devices log in with their own headers
+	KosyncService := kosync.NewService(db)
+	r.Route("/kosync", KosyncService.RegisterRoutes)
 
 	return r
 
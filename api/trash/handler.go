@@ -0,0 +1,150 @@
+// Handles the routes for listing, restoring and purging deleted books.
+
+package trash
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Service represents a service for managing deleted books.
+type Service struct {
+	repository *book.Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: book.NewRepository(db),
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Book -> ListTrash()
+	r.Get("/", s.HandleGetTrash)
+
+	// Book -> Purge() for every deleted book
+	r.Delete("/", s.HandleEmptyTrash)
+
+	r.Route("/{id}", func(r chi.Router) {
+
+		// Book -> Restore()
+		r.Post("/restore", s.HandleRestoreBook)
+
+		// Book -> Purge()
+		r.Delete("/", s.HandlePurgeBook)
+	})
+}
+
+// Handler for listing deleted books at /trash
+// Accepts ?limit= and ?offset= like GET /books.
+func (s *Service) HandleGetTrash(w http.ResponseWriter, r *http.Request) {
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	books, total, err := s.repository.For(r).ListTrash(opts.Limit, opts.Offset)
+	if err != nil {
+		log.Printf("error reading trash %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(books)
+	if err != nil {
+		log.Printf("error marshalling books into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Handler for restoring a deleted book at /trash/{id}/restore
+func (s *Service) HandleRestoreBook(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := s.repository.For(r).Restore(UUID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("error finding book in trash: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error restoring book %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(b)
+	if err != nil {
+		log.Printf("error marshalling book into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for permanently deleting a book in the trash at /trash/{id}
+func (s *Service) HandlePurgeBook(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := s.repository.For(r).ReadTrashed(UUID)
+	if err != nil {
+		log.Printf("error finding book in trash: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := s.repository.Purge(b); err != nil {
+		log.Printf("error purging book %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for permanently deleting every book in the trash at /trash
+func (s *Service) HandleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	books, _, err := s.repository.For(r).ListTrash(0, 0)
+	if err != nil {
+		log.Printf("error reading trash %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := purge(s.repository, books); err != nil {
+		log.Printf("error emptying trash %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,79 @@
+// Empties the trash of books deleted longer ago than the retention period.
+
+package trash
+
+import (
+	"context"
+	"log"
+	"nubayrah/api/book"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How often Purger looks for expired books
+const purgeInterval = time.Hour
+
+type Purger struct {
+	repository *book.Repository
+	retention  time.Duration
+}
+
+func NewPurger(db *gorm.DB, retention time.Duration) *Purger {
+	return &Purger{
+		repository: book.NewRepository(db),
+		retention:  retention,
+	}
+}
+
+// Purges expired books every purgeInterval until ctx is cancelled
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := p.PurgeExpired()
+		if err != nil {
+			log.Printf("error emptying trash %v", err)
+		}
+		if n > 0 {
+			log.Printf("purged %d books from trash", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purges the books deleted longer than the retention period ago. Returns
+// the number of books purged.
+func (p *Purger) PurgeExpired() (int, error) {
+	books, err := p.repository.ListTrashedBefore(time.Now().Add(-p.retention))
+	if err != nil {
+		return 0, err
+	}
+
+	return purge(p.repository, books)
+}
+
+// Purges books, continuing past failures. Returns the number of books purged
+// and the first error.
+func purge(repository *book.Repository, books book.Books) (int, error) {
+	var firstErr error
+	n := 0
+	for _, b := range books {
+		if err := repository.Purge(b); err != nil {
+			log.Printf("error purging book %s: %v", b.ID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		n++
+	}
+
+	return n, firstErr
+}
@@ -0,0 +1,105 @@
+// Identifies the user making a request for middleware.Authenticate.
+
+package user
+
+import (
+	"log"
+	"net/http"
+	"nubayrah/api/router/middleware"
+	"strings"
+	"time"
+
+	config "github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Cookie holding the session secret of the web client
+const SessionCookie = "nubayrah_session"
+
+type Authenticator struct {
+	repository *Repository
+}
+
+func NewAuthenticator(db *gorm.DB) *Authenticator {
+	return &Authenticator{
+		repository: NewRepository(db),
+	}
+}
+
+// Accepts a session cookie, a bearer API token, or HTTP Basic credentials
+// with either the user's password or one of its API tokens. A cookie of an
+// expired session doesn't hide the Authorization header.
+func (a *Authenticator) Authenticate(r *http.Request) (middleware.User, error) {
+	var u *User
+	var err error
+
+	if cookie, cookieErr := r.Cookie(SessionCookie); cookieErr == nil {
+		u, err = a.repository.readSessionUser(cookie.Value)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			return u, nil
+		}
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		u, err = a.repository.readTokenUser(strings.TrimSpace(token))
+	} else if username, password, ok := r.BasicAuth(); ok {
+		u, err = a.checkBasic(username, password)
+	}
+
+	// A nil *User must not become a non-nil middleware.User
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (a *Authenticator) checkBasic(username string, password string) (*User, error) {
+	if strings.HasPrefix(password, tokenPrefix) {
+		u, err := a.repository.readTokenUser(password)
+		if err != nil || u == nil || u.Username != username {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	u, err := a.repository.ReadByName(username)
+	if err != nil || u == nil || !u.CheckPassword(password) {
+		return nil, err
+	}
+	if err := a.repository.backfillSyncKey(u, password); err != nil {
+		log.Printf("error storing KOReader sync key of user %s: %v", u.ID, err)
+	}
+	return u, nil
+}
+
+// How long sessions last from config.session_days
+func sessionLength() time.Duration {
+	return time.Duration(max(1, config.GetInt("session_days"))) * 24 * time.Hour
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, secret string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,558 @@
+// Handles the routes for logging in, API tokens and managing users.
+
+package user
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nubayrah/api/router/middleware"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Body of requests with a username and password
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Body of POST /users
+type newUser struct {
+	credentials
+	Role        string   `json:"role"`
+	AllowedTags []string `json:"allowedTags"`
+}
+
+// Body of PUT /users/{id}/password
+type passwordChange struct {
+	Password        string `json:"password"`
+	CurrentPassword string `json:"currentPassword"` // Required to change your own password
+}
+
+// Fields of a user that can be set by PATCH /users/{id}
+type userFields struct {
+	Role        *string   `json:"role"`
+	AllowedTags *[]string `json:"allowedTags"`
+}
+
+// Service represents a service for managing users and their credentials.
+type Service struct {
+	repository *Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: NewRepository(db),
+	}
+}
+
+// Routes under /users
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// User -> Create()
+	r.Post("/", s.HandleCreateUser)
+
+	// User -> UpdatePassword(), for admins or the user itself
+	r.With(middleware.RequireUser("")).Put("/{id}/password", s.HandleSetPassword)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireRole(RoleAdmin))
+
+		// User -> List()
+		r.Get("/", s.HandleGetUsers)
+
+		// User -> Update()
+		r.Patch("/{id}", s.HandleUpdateUser)
+
+		// User -> Delete()
+		r.Delete("/{id}", s.HandleDeleteUser)
+	})
+}
+
+// Routes under /auth
+func (s *Service) RegisterAuthRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// User -> CreateSession()
+	r.Post("/login", s.HandleLogin)
+
+	// User -> DeleteSession()
+	r.Post("/logout", s.HandleLogout)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireUser(""))
+
+		// User -> Read()
+		r.Get("/me", s.HandleGetCurrentUser)
+
+		// User -> ListTokens()
+		r.Get("/tokens", s.HandleGetTokens)
+
+		// User -> CreateToken()
+		r.Post("/tokens", s.HandleCreateToken)
+
+		// User -> DeleteToken()
+		r.Delete("/tokens/{id}", s.HandleDeleteToken)
+	})
+}
+
+// Handler for logging in the web client at /auth/login
+// Accepts json with a username and password and responds with the user and
+// a session cookie.
+func (s *Service) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	creds := &credentials{}
+	if err := json.NewDecoder(r.Body).Decode(creds); err != nil {
+		log.Printf("error decoding credentials from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u, err := s.repository.ReadByName(creds.Username)
+	if err != nil {
+		log.Printf("error reading user %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if u == nil || !u.CheckPassword(creds.Password) {
+		log.Printf("failed login for %q", creds.Username)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err := s.repository.backfillSyncKey(u, creds.Password); err != nil {
+		log.Printf("error storing KOReader sync key of user %s: %v", u.ID, err)
+	}
+
+	expires := time.Now().Add(sessionLength())
+	secret, err := s.repository.CreateSession(u.ID, expires)
+	if err != nil {
+		log.Printf("error creating session %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(u)
+	if err != nil {
+		log.Printf("error marshalling user into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(w, r, secret, expires)
+	w.Write(j)
+}
+
+// Handler for ending the session of the web client at /auth/logout
+func (s *Service) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if err := s.repository.DeleteSession(cookie.Value); err != nil {
+			log.Printf("error deleting session %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	clearSessionCookie(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for the logged in user at /auth/me
+func (s *Service) HandleGetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	j, err := json.Marshal(u)
+	if err != nil {
+		log.Printf("error marshalling user into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for listing the API tokens of the logged in user at /auth/tokens
+func (s *Service) HandleGetTokens(w http.ResponseWriter, r *http.Request) {
+	u, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := s.repository.ListTokens(u.ID)
+	if err != nil {
+		log.Printf("error reading tokens %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(tokens)
+	if err != nil {
+		log.Printf("error marshalling tokens into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for creating an API token at /auth/tokens
+// Accepts json with a name for the token. The secret is only included in
+// this response.
+func (s *Service) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
+	u, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Printf("error decoding token from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token, secret, err := s.repository.CreateToken(u.ID, body.Name)
+	if err != nil {
+		log.Printf("error creating token %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		*Token
+		Secret string `json:"token"`
+	}{token, secret})
+	if err != nil {
+		log.Printf("error marshalling token into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+}
+
+// Handler for revoking an API token of the logged in user at /auth/tokens/{id}
+func (s *Service) HandleDeleteToken(w http.ResponseWriter, r *http.Request) {
+	u, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	n, err := s.repository.DeleteToken(u.ID, UUID)
+	if err != nil {
+		log.Printf("error deleting token %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for listing users at /users
+func (s *Service) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.repository.List()
+	if err != nil {
+		log.Printf("error reading users %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(users)
+	if err != nil {
+		log.Printf("error marshalling users into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for creating a user at /users from json with a username, password
+// and optionally a role, reader by default, and allowed tags. The first user
+// can be created without logging in and is always an admin, later users are
+// created by admins.
+func (s *Service) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
+	n, err := s.repository.Count()
+	if err != nil {
+		log.Printf("error counting users %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if n > 0 {
+		middleware.RequireRole(RoleAdmin)(http.HandlerFunc(s.createUser)).ServeHTTP(w, r)
+		return
+	}
+
+	body := &newUser{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		log.Printf("error decoding user from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body.Role = RoleAdmin
+	body.AllowedTags = nil
+	s.writeNewUser(w, body)
+}
+
+func (s *Service) createUser(w http.ResponseWriter, r *http.Request) {
+	body := &newUser{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		log.Printf("error decoding user from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.Role == "" {
+		body.Role = RoleReader
+	}
+	s.writeNewUser(w, body)
+}
+
+// Creates the user described by body and responds with it
+func (s *Service) writeNewUser(w http.ResponseWriter, body *newUser) {
+	u, err := NewUser(body.Username, body.Password, body.Role)
+	if err != nil {
+		log.Printf("invalid user: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	existing, err := s.repository.ReadByName(u.Username)
+	if err != nil {
+		log.Printf("error reading user %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		log.Printf("user %q already exists", u.Username)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	u.AllowedTags = body.AllowedTags
+	u, err = s.repository.Create(u)
+	if err != nil {
+		log.Printf("error creating user %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(u)
+	if err != nil {
+		log.Printf("error marshalling user into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/users/"+u.ID.String())
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+}
+
+// Handler for changing the role and allowed tags of a user at /users/{id}
+// from a partial json body. Responds with 409 Conflict instead of demoting
+// the last admin.
+func (s *Service) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	u, err := s.repository.Read(UUID)
+	if err != nil {
+		log.Printf("error finding user: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	fields := &userFields{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fields); err != nil {
+		log.Printf("error decoding user from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	wasAdmin := u.Role == RoleAdmin
+	if fields.Role != nil {
+		u.Role = *fields.Role
+	}
+	if fields.AllowedTags != nil {
+		u.AllowedTags = *fields.AllowedTags
+	}
+
+	if err := u.Validate(); err != nil {
+		log.Printf("invalid user: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if wasAdmin && u.Role != RoleAdmin && !s.otherAdminExists(w, u.ID) {
+		return
+	}
+
+	if err := s.repository.Update(u); err != nil {
+		log.Printf("error updating user %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(u)
+	if err != nil {
+		log.Printf("error marshalling user into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for deleting a user and everything belonging to it at /users/{id}
+// Responds with 409 Conflict instead of deleting the last admin.
+func (s *Service) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	u, err := s.repository.Read(UUID)
+	if err != nil {
+		log.Printf("error finding user: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if u.Role == RoleAdmin && !s.otherAdminExists(w, u.ID) {
+		return
+	}
+
+	n, err := s.repository.Delete(UUID)
+	if err != nil {
+		log.Printf("error deleting user %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for replacing the password of a user at /users/{id}/password
+// Accepts json with the new password. Users can change their own password
+// given their current one, admins anyone else's. Requires a logged in user
+// even with config.auth_required off. Existing sessions of the user are
+// logged out.
+func (s *Service) HandleSetPassword(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	current := middleware.CurrentUser(r)
+	if current == nil {
+		log.Printf("refusing to change the password of %s without a logged in user", UUID)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	self := current.UserID() == UUID
+	if !self && !current.HasRole(RoleAdmin) {
+		log.Printf("user %s may not change the password of %s", current.UserID(), UUID)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	u, err := s.repository.Read(UUID)
+	if err != nil {
+		log.Printf("error finding user: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	change := &passwordChange{}
+	if err := json.NewDecoder(r.Body).Decode(change); err != nil {
+		log.Printf("error decoding password from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if self && !u.CheckPassword(change.CurrentPassword) {
+		log.Printf("wrong current password for user %s", u.ID)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := u.SetPassword(change.Password); err != nil {
+		log.Printf("invalid password: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := s.repository.UpdatePassword(u); err != nil {
+		log.Printf("error updating password %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reports whether an admin other than id exists, responding 409 Conflict if
+// not so the last admin isn't removed
+func (s *Service) otherAdminExists(w http.ResponseWriter, id uuid.UUID) bool {
+	n, err := s.repository.CountAdmins(id)
+	if err != nil {
+		log.Printf("error counting admins %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if n == 0 {
+		log.Printf("refusing to remove the last admin %s", id)
+		w.WriteHeader(http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// Returns the logged in user, responding 401 if there is none. Routes behind
+// middleware.RequireUser only get here without one if auth is disabled.
+func currentUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	u, ok := middleware.CurrentUser(r).(*User)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	return u, true
+}
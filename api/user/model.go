@@ -0,0 +1,167 @@
+// The data Models of users and their credentials.
+
+package user
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Shortest password accepted for new users
+const minPasswordLength = 8
+
+// Roles of users, each allowed everything the previous one is
+const (
+	RoleReader = "reader" // Browses, reads and downloads books
+	RoleEditor = "editor" // Also imports, edits and deletes books
+	RoleAdmin  = "admin"  // Also manages users, webhooks and the library
+)
+
+var roles = []string{RoleReader, RoleEditor, RoleAdmin}
+
+// Prefix of API tokens, so they can be told apart from passwords
+const tokenPrefix = "nbt_"
+
+type User struct {
+	ID           uuid.UUID `json:"id" gorm:"<-:create"`
+	Username     string    `json:"username" gorm:"uniqueIndex"`
+	PasswordHash string    `json:"-"`                         // bcrypt hash
+	SyncKeyHash  string    `json:"-"`                         // bcrypt hash of the MD5 of the password, which KOReader sends instead
+	Role         string    `json:"role" gorm:"default:admin"` // Users from before roles existed keep full access
+	// Subjects the user is limited to, books without any of them are hidden.
+	// Empty for users that can see every book.
+	AllowedTags []string  `json:"allowedTags" gorm:"serializer:json"`
+	CreatedAt   time.Time `json:"createdAt" gorm:"autoCreateTime"`
+}
+
+type Users []*User
+
+func (u *User) UserID() uuid.UUID {
+	return u.ID
+}
+
+// Reports whether the user has role or one that includes it
+func (u *User) HasRole(role string) bool {
+	return slices.Contains(roles, role) && slices.Index(roles, u.Role) >= slices.Index(roles, role)
+}
+
+func (u *User) VisibleSubjects() []string {
+	if len(u.AllowedTags) == 0 {
+		return nil
+	}
+	return u.AllowedTags
+}
+
+// Creates a user with a fresh ID, the bcrypt hash of password and role
+func NewUser(username string, password string, role string) (*User, error) {
+	u := &User{ID: uuid.New(), Username: strings.TrimSpace(username), Role: role}
+	if err := u.SetPassword(password); err != nil {
+		return nil, err
+	}
+	return u, u.Validate()
+}
+
+func (u *User) Validate() error {
+	if u.Username == "" || len(u.Username) > 64 {
+		return errors.New("username must be between 1 and 64 characters")
+	}
+	// Usernames are sent before a colon in HTTP Basic credentials
+	if strings.Contains(u.Username, ":") {
+		return errors.New("username must not contain ':'")
+	}
+	if !slices.Contains(roles, u.Role) {
+		return fmt.Errorf("unknown role %q", u.Role)
+	}
+	return nil
+}
+
+func (u *User) SetPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("password is too short")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	u.PasswordHash = string(hash)
+	return u.setSyncKey(password)
+}
+
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// KOReader's kosync client logs in with the hex MD5 digest of the password
+func syncKey(password string) string {
+	sum := md5.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (u *User) setSyncKey(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(syncKey(password)), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	u.SyncKeyHash = string(hash)
+	return nil
+}
+
+// Checks the key a KOReader device logs in with. Users from before KOReader
+// sync existed have no key until they log in with their password.
+func (u *User) CheckSyncKey(key string) bool {
+	if u.SyncKeyHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.SyncKeyHash), []byte(strings.ToLower(key))) == nil
+}
+
+// A login of the web client, identified by the cookie holding its secret
+type Session struct {
+	SecretHash string    `gorm:"primaryKey"`
+	UserID     uuid.UUID `gorm:"index"`
+	ExpiresAt  time.Time `gorm:"index"`
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+}
+
+// A token for scripts and OPDS readers, sent as a bearer token or as the
+// password of HTTP Basic credentials
+type Token struct {
+	ID         uuid.UUID  `json:"id" gorm:"<-:create"`
+	UserID     uuid.UUID  `json:"userId" gorm:"index"`
+	Name       string     `json:"name"`
+	SecretHash string     `json:"-" gorm:"uniqueIndex"`
+	CreatedAt  time.Time  `json:"createdAt" gorm:"autoCreateTime"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type Tokens []*Token
+
+// Returns a random secret for sessions and tokens
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Secrets are stored hashed so a leaked database can't be used to log in.
+// They are random enough that a fast hash is sufficient.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
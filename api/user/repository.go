@@ -0,0 +1,220 @@
+// Contains all logic that needs to be done in order to communicate with the database.
+
+package user
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func (r *Repository) Count() (int64, error) {
+	var n int64
+	err := r.db.Model(&User{}).Count(&n).Error
+	return n, err
+}
+
+// Counts admins other than the user with id except
+func (r *Repository) CountAdmins(except uuid.UUID) (int64, error) {
+	var n int64
+	err := r.db.Model(&User{}).Where("role = ? AND id != ?", RoleAdmin, except).Count(&n).Error
+	return n, err
+}
+
+func (r *Repository) List() (Users, error) {
+	users := make(Users, 0)
+	if err := r.db.Order("username").Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (r *Repository) Create(u *User) (*User, error) {
+	if err := r.db.Create(u).Error; err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (r *Repository) Read(id uuid.UUID) (*User, error) {
+	u := &User{}
+	if err := r.db.Where("id = ?", id).First(u).Error; err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Returns the user with username, or nil if there is none
+func (r *Repository) ReadByName(username string) (*User, error) {
+	users := make(Users, 0, 1)
+	if err := r.db.Where("username = ?", username).Limit(1).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	return users[0], nil
+}
+
+// Saves the role and allowed tags of a user
+func (r *Repository) Update(u *User) error {
+	return r.db.Model(&User{}).
+		Select("role", "allowed_tags").
+		Where("id = ?", u.ID).
+		Updates(u).Error
+}
+
+// Replaces the password of a user and logs out all of its sessions
+func (r *Repository) UpdatePassword(u *User) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).
+			Where("id = ?", u.ID).
+			Updates(map[string]any{"password_hash": u.PasswordHash, "sync_key_hash": u.SyncKeyHash}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", u.ID).Delete(&Session{}).Error
+	})
+}
+
+// Gives a user that logged in with password the KOReader sync key it lacks
+func (r *Repository) backfillSyncKey(u *User, password string) error {
+	if u.SyncKeyHash != "" {
+		return nil
+	}
+	if err := u.setSyncKey(password); err != nil {
+		return err
+	}
+	return r.db.Model(&User{}).Where("id = ?", u.ID).Update("sync_key_hash", u.SyncKeyHash).Error
+}
+
+// Deletes a user along with its sessions and tokens. Its reading states,
+// sync progress, annotations and collections are deleted by triggers, see
+// book.MigratePurge.
+func (r *Repository) Delete(id uuid.UUID) (int64, error) {
+	var affected int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", id).Delete(&Session{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&Token{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id = ?", id).Delete(&User{})
+		affected = result.RowsAffected
+		return result.Error
+	})
+
+	return affected, err
+}
+
+// Starts a session for a user and returns its secret
+func (r *Repository) CreateSession(userID uuid.UUID, expires time.Time) (string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+
+	session := &Session{SecretHash: hashSecret(secret), UserID: userID, ExpiresAt: expires}
+	if err := r.db.Create(session).Error; err != nil {
+		return "", err
+	}
+
+	// Forget sessions that ran out
+	if err := r.db.Where("expires_at < ?", time.Now()).Delete(&Session{}).Error; err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func (r *Repository) DeleteSession(secret string) error {
+	return r.db.Where("secret_hash = ?", hashSecret(secret)).Delete(&Session{}).Error
+}
+
+// Returns the user of an unexpired session, or nil if there is none
+func (r *Repository) readSessionUser(secret string) (*User, error) {
+	users := make(Users, 0, 1)
+	err := r.db.Joins("JOIN sessions ON sessions.user_id = users.id").
+		Where("sessions.secret_hash = ? AND sessions.expires_at > ?", hashSecret(secret), time.Now()).
+		Limit(1).
+		Find(&users).Error
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+
+	return users[0], nil
+}
+
+// Creates an API token for a user and returns it along with its secret
+func (r *Repository) CreateToken(userID uuid.UUID, name string) (*Token, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	secret = tokenPrefix + secret
+
+	token := &Token{ID: uuid.New(), UserID: userID, Name: name, SecretHash: hashSecret(secret)}
+	if err := r.db.Create(token).Error; err != nil {
+		return nil, "", err
+	}
+
+	return token, secret, nil
+}
+
+func (r *Repository) ListTokens(userID uuid.UUID) (Tokens, error) {
+	tokens := make(Tokens, 0)
+	if err := r.db.Where("user_id = ?", userID).Order("created_at").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (r *Repository) DeleteToken(userID uuid.UUID, id uuid.UUID) (int64, error) {
+	result := r.db.Where("id = ? AND user_id = ?", id, userID).Delete(&Token{})
+
+	return result.RowsAffected, result.Error
+}
+
+// Returns the user of an API token, or nil if there is none, and records
+// that the token was used
+func (r *Repository) readTokenUser(secret string) (*User, error) {
+	tokens := make(Tokens, 0, 1)
+	err := r.db.Where("secret_hash = ?", hashSecret(secret)).Limit(1).Find(&tokens).Error
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+	token := tokens[0]
+
+	// Only written once a minute to keep reads cheap
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > time.Minute {
+		err := r.db.Model(&Token{}).Where("id = ?", token.ID).Update("last_used_at", now).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	users := make(Users, 0, 1)
+	if err := r.db.Where("id = ?", token.UserID).Limit(1).Find(&users).Error; err != nil || len(users) == 0 {
+		return nil, err
+	}
+
+	return users[0], nil
+}
@@ -0,0 +1,265 @@
+// Queues library events for the webhooks subscribed to them and delivers
+// them, retrying failed deliveries with exponential backoff. The queue is
+// kept in the database so pending deliveries survive restarts.
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"nubayrah/api/event"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Headers sent with every delivery
+const (
+	SignatureHeader = "X-Nubayrah-Signature" // sha256= followed by the hex HMAC-SHA256 of the body
+	EventHeader     = "X-Nubayrah-Event"
+	DeliveryHeader  = "X-Nubayrah-Delivery"
+)
+
+const (
+	// Attempts before a delivery is marked failed
+	maxAttempts = 8
+
+	// Wait before retrying a failed delivery, doubled after every attempt
+	retryDelay    = 30 * time.Second
+	maxRetryDelay = 6 * time.Hour
+
+	// Longest a webhook can take to respond
+	deliveryTimeout = 10 * time.Second
+
+	// How often the queue is checked when nothing is due sooner
+	dispatchInterval = time.Minute
+
+	// Deliveries attempted per check of the queue
+	deliveryBatchSize = 20
+)
+
+type Dispatcher struct {
+	repository  *Repository
+	client      *http.Client
+	missed      []*event.Event
+	events      <-chan *event.Event
+	unsubscribe func()
+	lastID      int64 // ID of the last event queued
+}
+
+// Subscribes to library events right away, so events published before Run
+// is called are still delivered
+func NewDispatcher(db *gorm.DB) *Dispatcher {
+	missed, events, unsubscribe := event.Subscribe(-1)
+	return &Dispatcher{
+		repository:  NewRepository(db),
+		client:      &http.Client{Timeout: deliveryTimeout},
+		missed:      missed,
+		events:      events,
+		unsubscribe: unsubscribe,
+		lastID:      -1,
+	}
+}
+
+// Queues events and sends due deliveries until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	defer func() { d.unsubscribe() }()
+
+	for _, e := range d.missed {
+		d.enqueue(e)
+	}
+
+	for {
+		d.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case e, ok := <-d.events:
+			if !ok {
+				// Dropped for falling behind while delivering, pick up
+				// where it left off
+				missed, events, unsubscribe := event.Subscribe(d.lastID)
+				d.events, d.unsubscribe = events, unsubscribe
+				for _, e := range missed {
+					d.enqueue(e)
+				}
+				continue
+			}
+			d.enqueue(e)
+
+		case <-time.After(d.nextWait()):
+		}
+	}
+}
+
+// Time until the next pending delivery is due, at most dispatchInterval
+func (d *Dispatcher) nextWait() time.Duration {
+	next, err := d.repository.nextDue()
+	if err != nil {
+		log.Printf("error reading webhook deliveries %v", err)
+		return dispatchInterval
+	}
+	if next == nil {
+		return dispatchInterval
+	}
+
+	return min(max(0, time.Until(*next)), dispatchInterval)
+}
+
+// Queues a delivery of e for every webhook subscribed to it
+func (d *Dispatcher) enqueue(e *event.Event) {
+	if e.Type == event.Reset {
+		// Events lost while disconnected can't be recovered
+		log.Printf("webhook events were missed")
+		return
+	}
+	d.lastID = e.ID
+
+	webhooks, err := d.repository.List()
+	if err != nil {
+		log.Printf("error reading webhooks %v", err)
+		return
+	}
+
+	now := time.Now()
+	deliveries := make(Deliveries, 0)
+	for _, w := range webhooks {
+		if !w.Subscribed(e.Type) {
+			continue
+		}
+
+		id := uuid.New()
+		body, err := json.Marshal(&payload{ID: id, Event: e.Type, Timestamp: now, Data: e.Data})
+		if err != nil {
+			log.Printf("error marshalling webhook payload into json %v", err)
+			continue
+		}
+
+		deliveries = append(deliveries, &Delivery{
+			ID:          id,
+			WebhookID:   w.ID,
+			Event:       e.Type,
+			Payload:     string(body),
+			State:       DeliveryPending,
+			NextAttempt: now,
+		})
+	}
+
+	if err := d.repository.CreateDeliveries(deliveries); err != nil {
+		log.Printf("error queueing webhook deliveries %v", err)
+	}
+}
+
+// Attempts the deliveries that are due
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := d.repository.dueDeliveries(time.Now(), deliveryBatchSize)
+		if err != nil {
+			log.Printf("error reading webhook deliveries %v", err)
+			return
+		}
+
+		for _, delivery := range deliveries {
+			d.deliver(ctx, delivery)
+		}
+
+		if len(deliveries) < deliveryBatchSize {
+			return
+		}
+	}
+}
+
+// Sends a delivery once and records the outcome
+func (d *Dispatcher) deliver(ctx context.Context, delivery *Delivery) {
+	w, err := d.repository.Read(delivery.WebhookID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Deleted along with its deliveries since they were read
+		return
+	}
+	if err != nil {
+		log.Printf("error reading webhook %v", err)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.StatusCode, err = d.send(ctx, w, delivery)
+	if ctx.Err() != nil {
+		// Interrupted by shutdown, try again after the restart
+		return
+	}
+
+	if err == nil {
+		now := time.Now()
+		delivery.State = DeliverySucceeded
+		delivery.Error = ""
+		delivery.DeliveredAt = &now
+	} else {
+		log.Printf("error delivering %s to webhook %s: %v", delivery.Event, w.ID, err)
+		delivery.Error = err.Error()
+		if delivery.Attempts >= maxAttempts {
+			delivery.State = DeliveryFailed
+		} else {
+			delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts))
+		}
+	}
+
+	if err := d.repository.updateDelivery(delivery); err != nil {
+		log.Printf("error saving webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// Posts the payload of a delivery to a webhook. Returns the response status
+// and an error unless the webhook responded with a 2xx status.
+func (d *Dispatcher) send(ctx context.Context, w *Webhook, delivery *Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Nubayrah-Webhook")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID.String())
+	req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Returns the signature header of body for a webhook with secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Wait before the attempt after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	delay := retryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
@@ -0,0 +1,258 @@
+// Handles the routes for managing webhooks and reading their delivery logs.
+
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/router/middleware"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Service represents a service for managing webhooks.
+type Service struct {
+	repository *Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	// Creates a new Service
+	return &Service{
+		repository: NewRepository(db),
+	}
+}
+
+func (s *Service) RegisterRoutes(r chi.Router) {
+
+	r.Use(middleware.ContentTypeJSON)
+
+	// Webhook -> List()
+	r.Get("/", s.HandleGetWebhooks)
+
+	// Webhook -> Create()
+	r.Post("/", s.HandleCreateWebhook)
+
+	r.Route("/{id}", func(r chi.Router) {
+
+		// Webhook -> Read()
+		r.Get("/", s.HandleGetWebhook)
+
+		// Webhook -> Update()
+		r.Patch("/", s.HandleUpdateWebhook)
+
+		// Webhook -> Delete()
+		r.Delete("/", s.HandleDeleteWebhook)
+
+		// Webhook -> ListDeliveries()
+		r.Get("/deliveries", s.HandleGetDeliveries)
+	})
+}
+
+// Handler for listing webhooks at /webhooks
+func (s *Service) HandleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := s.repository.List()
+	if err != nil {
+		log.Printf("error reading webhooks %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(webhooks)
+	if err != nil {
+		log.Printf("error marshalling webhooks into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for registering a webhook at /webhooks
+// Accepts json with a url and optionally a secret, the events to deliver and
+// whether it is active. A secret is generated if none is given. The secret
+// is only included in this response.
+func (s *Service) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	fields := &webhookFields{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fields); err != nil {
+		log.Printf("error decoding webhook from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	webhook := &Webhook{ID: uuid.New(), Active: true}
+	fields.apply(webhook)
+
+	if webhook.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			log.Printf("error generating webhook secret %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		webhook.Secret = secret
+	}
+
+	if err := webhook.Validate(); err != nil {
+		log.Printf("invalid webhook: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	webhook, err := s.repository.Create(webhook)
+	if err != nil {
+		log.Printf("error creating webhook %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		*Webhook
+		Secret string `json:"secret"`
+	}{webhook, webhook.Secret})
+	if err != nil {
+		log.Printf("error marshalling webhook into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/webhooks/"+webhook.ID.String())
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+}
+
+// Handler for a specific webhook at /webhooks/{id}
+func (s *Service) HandleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := s.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	j, err := json.Marshal(webhook)
+	if err != nil {
+		log.Printf("error marshalling webhook into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for updating a webhook at /webhooks/{id} from a partial json body
+func (s *Service) HandleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := s.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	fields := &webhookFields{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fields); err != nil {
+		log.Printf("error decoding webhook from request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	fields.apply(webhook)
+	if err := webhook.Validate(); err != nil {
+		log.Printf("invalid webhook: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := s.repository.Update(webhook); err != nil {
+		log.Printf("error updating webhook %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(webhook)
+	if err != nil {
+		log.Printf("error marshalling webhook into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(j)
+}
+
+// Handler for deleting a webhook and its delivery log at /webhooks/{id}
+func (s *Service) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	n, err := s.repository.Delete(UUID)
+	if err != nil {
+		log.Printf("error deleting webhook %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for the delivery log of a webhook at /webhooks/{id}/deliveries
+// Lists deliveries newest first, accepts ?limit= and ?offset= like GET /books.
+func (s *Service) HandleGetDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := s.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := book.ParseListOptions(r.URL.Query())
+	if err != nil {
+		log.Printf("error parsing list options %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	deliveries, total, err := s.repository.ListDeliveries(webhook.ID, opts.Limit, opts.Offset)
+	if err != nil {
+		log.Printf("error reading webhook deliveries %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(deliveries)
+	if err != nil {
+		log.Printf("error marshalling deliveries into json %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	book.SetPaginationHeaders(w, r, opts, total)
+	w.Write(j)
+}
+
+// Reads the webhook in the url, responding 404 if there is none
+func (s *Service) readWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	UUID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("error parsing uuid from url: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+
+	webhook, err := s.repository.Read(UUID)
+	if err != nil {
+		log.Printf("error finding webhook: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+
+	return webhook, true
+}
@@ -0,0 +1,136 @@
+// The data Models of webhooks and their deliveries.
+
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"nubayrah/api/event"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Events that can be delivered to webhooks
+var deliverableEvents = []string{
+	event.BookCreated,
+	event.BookUpdated,
+	event.BookDeleted,
+	event.BookRestored,
+	event.BookPurged,
+}
+
+// Events delivered to webhooks that don't list any
+var defaultEvents = []string{event.BookCreated, event.BookUpdated, event.BookDeleted}
+
+// States of a delivery
+const (
+	DeliveryPending   = "pending" // Waiting for its first or next attempt
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed" // Gave up after maxAttempts
+)
+
+type Webhook struct {
+	ID        uuid.UUID `json:"id" gorm:"<-:create"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"` // Key of the HMAC-SHA256 signature of payloads
+	Events    []string  `json:"events" gorm:"serializer:json"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+}
+
+type Webhooks []*Webhook
+
+// Fields of a webhook that can be set by POST and PATCH /webhooks
+type webhookFields struct {
+	URL    *string   `json:"url"`
+	Secret *string   `json:"secret"`
+	Events *[]string `json:"events"`
+	Active *bool     `json:"active"`
+}
+
+// Sets the provided fields of w
+func (f *webhookFields) apply(w *Webhook) {
+	if f.URL != nil {
+		w.URL = *f.URL
+	}
+	if f.Secret != nil {
+		w.Secret = *f.Secret
+	}
+	if f.Events != nil {
+		w.Events = *f.Events
+	}
+	if f.Active != nil {
+		w.Active = *f.Active
+	}
+}
+
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q", w.URL)
+	}
+
+	for _, e := range w.Events {
+		if !slices.Contains(deliverableEvents, e) {
+			return fmt.Errorf("unknown webhook event %q", e)
+		}
+	}
+
+	if w.Secret == "" {
+		return fmt.Errorf("webhook secret must not be empty")
+	}
+
+	return nil
+}
+
+// Reports whether the webhook receives events of type typ
+func (w *Webhook) Subscribed(typ string) bool {
+	if !w.Active {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return slices.Contains(defaultEvents, typ)
+	}
+	return slices.Contains(w.Events, typ)
+}
+
+// Returns a random secret for webhooks created without one
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// An event sent, or to be sent, to a webhook. Pending deliveries are the
+// queue worked through by Dispatcher, the rest are the delivery log.
+type Delivery struct {
+	ID          uuid.UUID  `json:"id" gorm:"<-:create"`
+	WebhookID   uuid.UUID  `json:"webhookId" gorm:"index"`
+	Event       string     `json:"event"`
+	Payload     string     `json:"payload"`
+	State       string     `json:"state" gorm:"index"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"nextAttempt" gorm:"index"`
+	StatusCode  int        `json:"statusCode,omitempty"` // Response to the last attempt
+	Error       string     `json:"error,omitempty"`      // Why the last attempt failed
+	CreatedAt   time.Time  `json:"createdAt" gorm:"autoCreateTime;index"`
+	DeliveredAt *time.Time `json:"deliveredAt"`
+}
+
+type Deliveries []*Delivery
+
+// Body posted to webhooks
+type payload struct {
+	ID        uuid.UUID       `json:"id"` // ID of the delivery, the same for every attempt
+	Event     string          `json:"event"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
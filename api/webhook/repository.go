@@ -0,0 +1,129 @@
+// Contains all logic that needs to be done in order to communicate with the database.
+
+package webhook
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func (r *Repository) List() (Webhooks, error) {
+	webhooks := make(Webhooks, 0)
+	if err := r.db.Order("created_at").Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (r *Repository) Create(w *Webhook) (*Webhook, error) {
+	if err := r.db.Create(w).Error; err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (r *Repository) Read(id uuid.UUID) (*Webhook, error) {
+	w := &Webhook{}
+	if err := r.db.Where("id = ?", id).First(w).Error; err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Overwrites all editable columns of the row matching w.ID
+func (r *Repository) Update(w *Webhook) error {
+	return r.db.Model(&Webhook{}).
+		Select("*").
+		Omit("id", "created_at").
+		Where("id = ?", w.ID).
+		Updates(w).Error
+}
+
+// Deletes a webhook along with its delivery log and pending deliveries
+func (r *Repository) Delete(id uuid.UUID) (int64, error) {
+	var affected int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", id).Delete(&Delivery{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id = ?", id).Delete(&Webhook{})
+		affected = result.RowsAffected
+		return result.Error
+	})
+
+	return affected, err
+}
+
+// Returns a page of the deliveries of a webhook, newest first, along with
+// the total number of deliveries
+func (r *Repository) ListDeliveries(webhookID uuid.UUID, limit int, offset int) (Deliveries, int64, error) {
+	query := r.db.Model(&Delivery{}).Where("webhook_id = ?", webhookID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	deliveries := make(Deliveries, 0)
+	err := query.Order("created_at DESC").Limit(limit).Offset(offset).Find(&deliveries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return deliveries, total, nil
+}
+
+func (r *Repository) CreateDeliveries(deliveries Deliveries) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return r.db.Create(&deliveries).Error
+}
+
+// Returns pending deliveries due by now, oldest first
+func (r *Repository) dueDeliveries(now time.Time, limit int) (Deliveries, error) {
+	deliveries := make(Deliveries, 0)
+	err := r.db.Where("state = ? AND next_attempt <= ?", DeliveryPending, now).
+		Order("next_attempt").
+		Limit(limit).
+		Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// Returns when the next pending delivery is due, or nil if there are none
+func (r *Repository) nextDue() (*time.Time, error) {
+	deliveries := make(Deliveries, 0, 1)
+	err := r.db.Where("state = ?", DeliveryPending).Order("next_attempt").Limit(1).Find(&deliveries).Error
+	if err != nil || len(deliveries) == 0 {
+		return nil, err
+	}
+
+	return &deliveries[0].NextAttempt, nil
+}
+
+// Records the outcome of an attempt
+func (r *Repository) updateDelivery(d *Delivery) error {
+	return r.db.Model(&Delivery{}).
+		Select("state", "attempts", "next_attempt", "status_code", "error", "delivered_at").
+		Where("id = ?", d.ID).
+		Updates(d).Error
+}
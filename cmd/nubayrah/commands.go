@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"nubayrah/api/library"
+	"nubayrah/api/user"
+	"nubayrah/config"
+	"nubayrah/sqlite"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Runs a subcommand given on the command line instead of the server
+func runCommand(name string, args []string) error {
+	switch name {
+	case "scan":
+		return scanCommand(args)
+	case "reconcile":
+		return reconcileCommand(args)
+	case "adduser":
+		return addUserCommand(args)
+	case "passwd":
+		return passwdCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// nubayrah scan [-move] [dir]
+// Imports epubs in dir, or config.scan_path, that aren't in the database yet.
+func scanCommand(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	move := flags.Bool("move", false, "move books into the library instead of importing them in place")
+	flags.Parse(args)
+
+	err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	dir := viper.GetString("scan_path")
+	if flags.NArg() > 0 {
+		dir = flags.Arg(0)
+	}
+
+	result, err := library.NewScanner(sqlite.NewDB()).Scan(dir, *move)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range result.Added {
+		fmt.Printf("added   %s\n", b.Filepath)
+	}
+	for _, f := range result.Failed {
+		fmt.Printf("failed  %s: %s\n", f.Path, f.Error)
+	}
+	fmt.Printf("%d added, %d already in library, %d failed\n", len(result.Added), result.Skipped, len(result.Failed))
+
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d files could not be imported", len(result.Failed))
+	}
+	return nil
+}
+
+// nubayrah reconcile [-dry-run]
+// Fixes differences between the database and the files in config.library_path.
+func reconcileCommand(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report differences without fixing them")
+	flags.Parse(args)
+
+	err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	report, err := library.NewReconciler(sqlite.NewDB()).Reconcile(viper.GetString("library_path"), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range report.Missing {
+		fmt.Printf("missing    %s (%s)\n", b.Filepath, b.ID)
+	}
+	for _, path := range report.Orphans {
+		fmt.Printf("orphan     %s\n", path)
+	}
+	for _, m := range report.Mismatched {
+		fmt.Printf("mismatch   %s: %s\n", m.Book.Filepath, strings.Join(m.Fields, ", "))
+	}
+	for _, d := range report.Duplicates {
+		fmt.Printf("duplicate  %s %s:\n", d.Key, d.Value)
+		for _, b := range d.Books {
+			fmt.Printf("           %s (%s)\n", b.Filepath, b.ID)
+		}
+	}
+	for _, f := range report.Failed {
+		fmt.Printf("failed     %s: %s\n", f.Path, f.Error)
+	}
+
+	action := "fixed"
+	if *dryRun {
+		action = "found"
+	}
+	fmt.Printf("%s %d missing, %d orphaned, %d mismatched, %d duplicate groups need manual review\n", action,
+		len(report.Missing), len(report.Orphans), len(report.Mismatched), len(report.Duplicates))
+
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d files could not be reconciled", len(report.Failed))
+	}
+	return nil
+}
+
+// nubayrah adduser [-role admin|editor|reader] <username>
+// Creates a user with a password read from stdin, for setting up the first
+// account or recovering access.
+func addUserCommand(args []string) error {
+	flags := flag.NewFlagSet("adduser", flag.ExitOnError)
+	role := flags.String("role", user.RoleAdmin, "role of the user: admin, editor or reader")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: nubayrah adduser [-role admin|editor|reader] <username>")
+	}
+
+	err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	u, err := user.NewUser(flags.Arg(0), password, *role)
+	if err != nil {
+		return err
+	}
+
+	repository := user.NewRepository(sqlite.NewDB())
+	existing, err := repository.ReadByName(u.Username)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("user %q already exists", u.Username)
+	}
+
+	if _, err := repository.Create(u); err != nil {
+		return err
+	}
+
+	fmt.Printf("created user %s (%s)\n", u.Username, u.ID)
+	return nil
+}
+
+// nubayrah passwd <username>
+// Replaces the password of a user with one read from stdin and logs out its
+// sessions.
+func passwdCommand(args []string) error {
+	flags := flag.NewFlagSet("passwd", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: nubayrah passwd <username>")
+	}
+
+	err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	repository := user.NewRepository(sqlite.NewDB())
+	u, err := repository.ReadByName(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("no user %q", flags.Arg(0))
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	if err := u.SetPassword(password); err != nil {
+		return err
+	}
+
+	if err := repository.UpdatePassword(u); err != nil {
+		return err
+	}
+
+	fmt.Printf("updated password of %s\n", u.Username)
+	return nil
+}
+
+// Reads a password from the first line of stdin
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -5,11 +5,17 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"nubayrah/api/book"
+	"nubayrah/api/event"
+	"nubayrah/api/library"
 	"nubayrah/api/router"
+	"nubayrah/api/trash"
+	"nubayrah/api/webhook"
 	"nubayrah/config"
 	"nubayrah/sqlite"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/spf13/viper"
 	"gorm.io/gorm"
@@ -19,6 +25,14 @@ const FSPATH = "./static/"
 
 func main() {
 
+	// Subcommands run once and exit instead of starting the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Setting up a signal handler to receive kill signal.
 	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)   // Single buffer that takes os.Signal items
@@ -36,6 +50,30 @@ func main() {
 	// Starts the API server
 	m.StartServer()
 	//
+	// Starts indexing book content for full-text search
+	if viper.GetBool("search_index_content") {
+		m.StartContentIndexer(ctx)
+	}
+	//
+	// Starts hashing books imported before KOReader sync for it
+	m.StartPartialMD5Backfill(ctx)
+	//
+	// Starts running queued and interrupted import jobs
+	m.StartJobRunner(ctx)
+	//
+	// Starts delivering library events to webhooks
+	m.StartWebhookDispatcher(ctx)
+	//
+	// Starts importing books dropped into the inbox
+	if viper.GetString("inbox_path") != "" {
+		m.StartInboxWatcher(ctx)
+	}
+	//
+	// Starts emptying the trash of books past the retention period
+	if viper.GetInt("trash_retention_days") > 0 {
+		m.StartTrashPurger(ctx)
+	}
+	//
 	// Line to wait for CTRL-C
 	<-ctx.Done()
 
@@ -79,6 +117,8 @@ func (m *Main) StartServer() {
 
 	// Attach the router to the http.Server
 	m.server.Handler = router.NewRouter(m.db)
+	// Event streams never finish on their own
+	m.server.RegisterOnShutdown(event.CloseStreams)
 	// Start with connecting to the Database
 	go func() {
 
@@ -91,3 +131,43 @@ func (m *Main) StartServer() {
 	}()
 
 }
+
+func (m *Main) StartContentIndexer(ctx context.Context) {
+	log.Printf("Starting book content indexer")
+	go book.NewContentIndexer(m.db).Run(ctx)
+}
+
+func (m *Main) StartPartialMD5Backfill(ctx context.Context) {
+	go func() {
+		if err := book.BackfillPartialMD5(ctx, m.db); err != nil {
+			log.Printf("error hashing books for KOReader sync %v", err)
+		}
+	}()
+}
+
+func (m *Main) StartJobRunner(ctx context.Context) {
+	log.Printf("Starting import job runner")
+	go book.NewJobRunner(m.db).Run(ctx)
+}
+
+func (m *Main) StartWebhookDispatcher(ctx context.Context) {
+	log.Printf("Starting webhook dispatcher")
+	go webhook.NewDispatcher(m.db).Run(ctx)
+}
+
+func (m *Main) StartInboxWatcher(ctx context.Context) {
+	dir := viper.GetString("inbox_path")
+	log.Printf("Watching inbox at %s", dir)
+	w := library.NewWatcher(m.db, dir, viper.GetDuration("inbox_debounce"))
+	go func() {
+		if err := w.Run(ctx); err != nil {
+			log.Printf("error watching inbox %v", err)
+		}
+	}()
+}
+
+func (m *Main) StartTrashPurger(ctx context.Context) {
+	days := viper.GetInt("trash_retention_days")
+	log.Printf("Purging books deleted more than %d days ago", days)
+	go trash.NewPurger(m.db, time.Duration(days)*24*time.Hour).Run(ctx)
+}
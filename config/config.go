@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"nubayrah/epub"
 
 	"github.com/spf13/viper"
 )
@@ -27,5 +29,10 @@ func Load() error {
 	}
 
 	log.Printf("Using configuration file %v", viper.Get("config_path"))
+
+	if err := epub.ValidateLayout(viper.GetString("library_layout")); err != nil {
+		return fmt.Errorf("invalid library_layout: %w", err)
+	}
+
 	return nil
 }
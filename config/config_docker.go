@@ -21,9 +21,21 @@ func DefaultConfig() error {
 	const libraryRoot = "/library"
 
 	viper.SetDefault("library_path", libraryRoot)
+	viper.SetDefault("scan_path", libraryRoot)
+	viper.SetDefault("library_layout", "{author}/{title}.epub")
 	viper.SetDefault("config_path", filepath.Join(dataRoot, "config.yaml"))
 	viper.SetDefault("host", "0.0.0.0")
 	viper.SetDefault("port", 5050)
+	viper.SetDefault("cache_path", filepath.Join(dataRoot, "cache"))
+	viper.SetDefault("search_index_content", true)
+	viper.SetDefault("inbox_path", "")
+	viper.SetDefault("inbox_debounce", "5s")
+	viper.SetDefault("trash_retention_days", 30)
+	viper.SetDefault("max_upload_mb", 512)
+	viper.SetDefault("import_workers", 4)
+	viper.SetDefault("auth_required", true)
+	viper.SetDefault("session_days", 30)
+	viper.SetDefault("cors_origins", []string{})
 	viper.SetDefault("db_path", filepath.Join(libraryRoot, "nubayrah.db"))
 
 	// tells Viper to look for `dataRoot/config.yaml``
@@ -0,0 +1,314 @@
+/*
+https://idpf.org/epub/linking/cfi/
+*/
+
+package epub
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A step of a CFI path such as /4[chap01ref]
+type CFIStep struct {
+	Index     int    // Even for elements, odd for the text between them
+	Assertion string // The id asserted in brackets, if any
+}
+
+// A parsed EPUB CFI pointing at a position or a range in a publication. Only
+// the steps through the package document are kept, the path inside the
+// content document is only checked for syntax.
+type CFI struct {
+	Spine   CFIStep // Step from the package element to the spine
+	ItemRef CFIStep // Step from the spine to the itemref of the content document
+	Range   bool    // Whether the CFI has a start and an end
+}
+
+// A step along with whether it follows an indirection
+type cfiStep struct {
+	CFIStep
+	indirect bool
+}
+
+// Parses an epubcfi(...) fragment, either a position or a range of the form
+// epubcfi(parent,start,end)
+func ParseCFI(s string) (*CFI, error) {
+	inner, ok := strings.CutPrefix(s, "epubcfi(")
+	if !ok || !strings.HasSuffix(inner, ")") {
+		return nil, fmt.Errorf("cfi %q is not of the form epubcfi(...)", s)
+	}
+	inner = inner[:len(inner)-1]
+
+	parts, err := splitCFI(inner)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) != 1 && len(parts) != 3 {
+		return nil, errors.New("cfi range must have a parent, a start and an end")
+	}
+
+	steps, err := parseCFIPath(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	// The package document is only left through an indirection after the
+	// itemref step
+	if len(steps) < 2 || steps[0].indirect || steps[1].indirect {
+		return nil, errors.New("cfi must start with steps to the spine and an itemref")
+	}
+	if len(steps) > 2 && !steps[2].indirect {
+		return nil, errors.New("cfi must step into the content document with '!' after the itemref")
+	}
+
+	for _, local := range parts[1:] {
+		if local == "" {
+			return nil, errors.New("cfi range start and end must not be empty")
+		}
+		if _, err := parseCFIPath(local); err != nil {
+			return nil, err
+		}
+	}
+
+	return &CFI{Spine: steps[0].CFIStep, ItemRef: steps[1].CFIStep, Range: len(parts) == 3}, nil
+}
+
+// Splits a CFI at the commas separating the parent path from the start and
+// end of a range, skipping those inside assertions and escaped by ^
+func splitCFI(s string) ([]string, error) {
+	parts := make([]string, 0, 3)
+	start := 0
+	inAssertion := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '^':
+			i++
+		case '[':
+			inAssertion = true
+		case ']':
+			inAssertion = false
+		case ',':
+			if !inAssertion {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if inAssertion {
+		return nil, errors.New("cfi has an unterminated assertion")
+	}
+
+	return append(parts, s[start:]), nil
+}
+
+// Parses the steps of a CFI path, up to an optional character, temporal or
+// spatial offset that must end it
+func parseCFIPath(s string) ([]cfiStep, error) {
+	p := &cfiParser{s: s}
+	steps := make([]cfiStep, 0)
+	indirect := false
+
+	for !p.done() {
+		switch p.s[p.i] {
+		case '!':
+			if indirect {
+				return nil, p.errorf("repeated '!'")
+			}
+			indirect = true
+			p.i++
+		case '/':
+			p.i++
+			index, err := p.integer()
+			if err != nil {
+				return nil, err
+			}
+			assertion, err := p.assertion()
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, cfiStep{CFIStep: CFIStep{Index: index, Assertion: assertion}, indirect: indirect})
+			indirect = false
+		case ':', '~', '@':
+			if indirect {
+				return nil, p.errorf("offset after '!'")
+			}
+			if err := p.offset(); err != nil {
+				return nil, err
+			}
+			if !p.done() {
+				return nil, p.errorf("offset must end the path")
+			}
+		default:
+			return nil, p.errorf("unexpected %q", p.s[p.i])
+		}
+	}
+
+	if indirect {
+		return nil, p.errorf("'!' without a step after it")
+	}
+	return steps, nil
+}
+
+type cfiParser struct {
+	s string
+	i int
+}
+
+func (p *cfiParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *cfiParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("invalid cfi at %d: %s", p.i, fmt.Sprintf(format, args...))
+}
+
+func (p *cfiParser) integer() (int, error) {
+	start := p.i
+	for !p.done() && p.s[p.i] >= '0' && p.s[p.i] <= '9' {
+		p.i++
+	}
+	if start == p.i {
+		return 0, p.errorf("expected a number")
+	}
+	// Leading zeros aren't allowed
+	if p.i-start > 1 && p.s[start] == '0' {
+		return 0, p.errorf("number with a leading zero")
+	}
+	return strconv.Atoi(p.s[start:p.i])
+}
+
+// Parses a number with an optional fraction, as used by temporal and spatial
+// offsets
+func (p *cfiParser) number() error {
+	if _, err := p.integer(); err != nil {
+		return err
+	}
+	if !p.done() && p.s[p.i] == '.' {
+		p.i++
+		start := p.i
+		for !p.done() && p.s[p.i] >= '0' && p.s[p.i] <= '9' {
+			p.i++
+		}
+		if start == p.i {
+			return p.errorf("expected digits after '.'")
+		}
+	}
+	return nil
+}
+
+// Parses an optional [assertion], returning its unescaped value
+func (p *cfiParser) assertion() (string, error) {
+	if p.done() || p.s[p.i] != '[' {
+		return "", nil
+	}
+	p.i++
+
+	var sb strings.Builder
+	for !p.done() {
+		c := p.s[p.i]
+		switch c {
+		case '^':
+			p.i++
+			if p.done() {
+				return "", p.errorf("'^' at the end")
+			}
+			sb.WriteByte(p.s[p.i])
+		case ']':
+			p.i++
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+		}
+		p.i++
+	}
+
+	return "", p.errorf("unterminated assertion")
+}
+
+// Parses a character offset :n, a temporal offset ~s and a spatial offset
+// @x:y, in that order, each optional, followed by an optional assertion
+func (p *cfiParser) offset() error {
+	if !p.done() && p.s[p.i] == ':' {
+		p.i++
+		if _, err := p.integer(); err != nil {
+			return err
+		}
+	}
+	if !p.done() && p.s[p.i] == '~' {
+		p.i++
+		if err := p.number(); err != nil {
+			return err
+		}
+	}
+	if !p.done() && p.s[p.i] == '@' {
+		p.i++
+		if err := p.number(); err != nil {
+			return err
+		}
+		if p.done() || p.s[p.i] != ':' {
+			return p.errorf("spatial offset needs two numbers")
+		}
+		p.i++
+		if err := p.number(); err != nil {
+			return err
+		}
+	}
+
+	_, err := p.assertion()
+	return err
+}
+
+// Checks that cfi steps through the spine of the package document into one
+// of its itemrefs and returns the index of that item in the spine. Only
+// elements are counted by the steps, so rewriting the metadata of the package
+// document doesn't move the positions of CFIs.
+func (e *Epub) ResolveCFI(cfi *CFI) (int, error) {
+	return e.RootFile.resolveCFI(cfi)
+}
+
+func (f *RootFile) resolveCFI(cfi *CFI) (int, error) {
+	// Even steps count child elements starting at 2
+	child := func(children int, step CFIStep) (int, error) {
+		if step.Index%2 != 0 || step.Index < 2 || step.Index/2 > children {
+			return 0, fmt.Errorf("cfi step /%d doesn't point at an element", step.Index)
+		}
+		return step.Index/2 - 1, nil
+	}
+
+	pkg := f.Root()
+	if pkg == nil {
+		return 0, errors.New("malformed package document: no root element")
+	}
+	pkgChildren := pkg.ChildElements()
+	i, err := child(len(pkgChildren), cfi.Spine)
+	if err != nil {
+		return 0, err
+	}
+	spine := pkgChildren[i]
+	if spine.Tag != "spine" {
+		return 0, fmt.Errorf("cfi step /%d points at %s instead of the spine", cfi.Spine.Index, spine.Tag)
+	}
+
+	itemrefs := spine.ChildElements()
+	i, err = child(len(itemrefs), cfi.ItemRef)
+	if err != nil {
+		return 0, err
+	}
+	itemref := itemrefs[i]
+	if itemref.Tag != "itemref" {
+		return 0, fmt.Errorf("cfi step /%d points at %s instead of an itemref", cfi.ItemRef.Index, itemref.Tag)
+	}
+	if cfi.ItemRef.Assertion != "" && itemref.SelectAttrValue("id", "") != cfi.ItemRef.Assertion {
+		return 0, fmt.Errorf("cfi asserts itemref %q but points at %q", cfi.ItemRef.Assertion, itemref.SelectAttrValue("id", ""))
+	}
+
+	// Spine items are numbered among the itemrefs only
+	index := 0
+	for _, elem := range itemrefs[:i] {
+		if elem.Tag == "itemref" {
+			index++
+		}
+	}
+	return index, nil
+}
@@ -0,0 +1,95 @@
+package epub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCFI(t *testing.T) {
+	cfi, err := ParseCFI("epubcfi(/6/4[chap01ref]!/4[body01]/10[para05]/3:10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, CFIStep{Index: 6}, cfi.Spine)
+	assert.Equal(t, CFIStep{Index: 4, Assertion: "chap01ref"}, cfi.ItemRef)
+	assert.False(t, cfi.Range)
+
+	cfi, err = ParseCFI("epubcfi(/6/4[chap^]01]!/4/10,/2/1:1,/3:4)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "chap]01", cfi.ItemRef.Assertion)
+	assert.True(t, cfi.Range)
+
+	valid := []string{
+		"epubcfi(/6/2)",
+		"epubcfi(/6/14!/4/2/1:0)",
+		"epubcfi(/6/4!/4/2[a^,b]/1:3[xx,y])",
+		"epubcfi(/6/4!/4/2~23.5@10.2:30)",
+	}
+	for _, s := range valid {
+		_, err := ParseCFI(s)
+		assert.NoError(t, err, s)
+	}
+
+	invalid := []string{
+		"/6/4!/4/2",
+		"epubcfi()",
+		"epubcfi(/6)",
+		"epubcfi(/6!/4/2)",
+		"epubcfi(/6/4/4/2)",
+		"epubcfi(/6/4!!/4)",
+		"epubcfi(/6/4!/4:3/2)",
+		"epubcfi(/6/04!/4)",
+		"epubcfi(/6/4!/4[open)",
+		"epubcfi(/6/4!/4,/1:1)",
+		"epubcfi(/6/4!/4,,/1:2)",
+		"epubcfi(/6/4!/4/x)",
+	}
+	for _, s := range invalid {
+		_, err := ParseCFI(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestResolveCFI(t *testing.T) {
+	e, err := OpenEpub("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	resolve := func(s string) (int, error) {
+		cfi, err := ParseCFI(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e.ResolveCFI(cfi)
+	}
+
+	index, err := resolve("epubcfi(/6/6!/4/2/1:5)")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, index)
+
+	// The spine is the third element of the package document
+	_, err = resolve("epubcfi(/4/6!/4/2/1:5)")
+	assert.Error(t, err)
+	_, err = resolve("epubcfi(/6/5!/4/2/1:5)")
+	assert.Error(t, err)
+	_, err = resolve("epubcfi(/6/10000!/4/2/1:5)")
+	assert.Error(t, err)
+	_, err = resolve("epubcfi(/6/6[nope]!/4/2/1:5)")
+	assert.Error(t, err)
+
+	// Rewriting the metadata keeps CFIs pointing at the same spine item
+	paths, err := e.GetSpinePaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.RootFile.InsertMetadata(e.Metadata)
+	index, err = resolve("epubcfi(/6/6!/4/2/1:5)")
+	assert.NoError(t, err)
+	after, _ := e.GetSpinePaths()
+	assert.Equal(t, paths[2], after[index])
+}
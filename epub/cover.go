@@ -10,63 +10,145 @@ import (
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+
+	_ "golang.org/x/image/webp"
 )
 
-// Returns internal path to cover image
+// Returned when the rootfile does not reference a cover image
+var ErrNoCover = errors.New("cover image item not found in manifest")
+
+// Image types accepted as a cover and the extension used when adding them
+var coverExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Returns internal path to cover image. Manifest hrefs pointing outside of
+// the epub or to a file missing from it are rejected.
 func (e *Epub) GetCoverPath() (string, error) {
-	coverId := e.RootFile.getCoverId()
-	if coverId == "" {
-		return "", fmt.Errorf("cover id not found in root doc")
+	itemElem := e.RootFile.getCoverItem()
+	if itemElem == nil {
+		return "", ErrNoCover
+	}
+
+	coverPath, err := e.itemPath(itemElem.SelectAttrValue("href", ""))
+	if err != nil {
+		return "", err
 	}
+	if e.findFile(coverPath) == nil {
+		return "", fmt.Errorf("cover image not found in epub: %s", coverPath)
+	}
+
+	return coverPath, nil
+}
 
-	itemElem := e.RootFile.FindElement(fmt.Sprintf("//package/manifest/item[@id='%s']", coverId))
+// Returns the internal path of a manifest href, which is relative to the
+// rootfile and URL-escaped. Paths outside of the epub are rejected.
+func (e *Epub) itemPath(href string) (string, error) {
+	unescaped, err := url.PathUnescape(href)
+	if err != nil {
+		return "", fmt.Errorf("invalid href %q in manifest: %w", href, err)
+	}
+
+	itemPath := filepath.FromSlash(path.Join(path.Dir(filepath.ToSlash(e.RootFile.internalPath)), unescaped))
+	if !filepath.IsLocal(itemPath) {
+		return "", fmt.Errorf("invalid href %q in manifest: outside of the epub", href)
+	}
+
+	return itemPath, nil
+}
+
+// Returns the media type of the cover image as declared in the manifest,
+// falling back to guessing from the file extension
+func (e *Epub) GetCoverMediaType() (string, error) {
+	itemElem := e.RootFile.getCoverItem()
 	if itemElem == nil {
-		return "", errors.New("cover image item not found in manifest")
+		return "", ErrNoCover
 	}
 
-	imgRelativePath := itemElem.SelectAttrValue("href", "")
+	mediaType := itemElem.SelectAttrValue("media-type", "")
+	if mediaType == "" {
+		mediaType = mime.TypeByExtension(filepath.Ext(itemElem.SelectAttrValue("href", "")))
+	}
 
-	return filepath.Join(filepath.Dir(e.RootFile.internalPath), imgRelativePath), nil
+	return mediaType, nil
 }
 
 // Attempts to convert provided image data to required format before
-// setting epub field
+// setting epub field. If the epub has no cover a new manifest item is added
+// for the image as-is.
 func (e *Epub) SetCoverImage(cover []byte) error {
 
 	newMediaType := http.DetectContentType(cover)
-	if !strings.HasPrefix(newMediaType, "image/") {
+	if _, ok := coverExtensions[newMediaType]; !ok {
 		return fmt.Errorf("invalid media type %s", newMediaType)
 	}
 
-	destination, err := e.GetCoverPath()
+	img, _, err := image.Decode(bytes.NewReader(cover))
 	if err != nil {
 		return err
 	}
 
-	reqMediaType := filepath.Ext(destination)
-	img, _, err := image.Decode(bytes.NewReader(cover))
+	destination, err := e.GetCoverPath()
+	if errors.Is(err, ErrNoCover) {
+		itemElem, err := e.RootFile.addCoverItem(newMediaType)
+		if err != nil {
+			return err
+		}
+		e.coverPath, err = e.itemPath(itemElem.SelectAttrValue("href", ""))
+		if err != nil {
+			return err
+		}
+		e.coverImage = cover
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
+	reqMediaType := strings.ToLower(filepath.Ext(destination))
+
+	// No need to re-encode an image that already has the required format
+	if coverExtensions[newMediaType] == reqMediaType ||
+		newMediaType == "image/jpeg" && reqMediaType == ".jpeg" {
+		e.coverImage = cover
+		e.coverPath = destination
+		return nil
+	}
+
+	// Formats that can't be encoded, like webp, are replaced by the image
+	// as-is and the manifest item is pointed at it
+	if !slices.Contains([]string{".jpg", ".jpeg", ".png", ".gif"}, reqMediaType) {
+		e.coverPath, err = e.retypeCover(newMediaType)
+		if err != nil {
+			return err
+		}
+		e.staleCover = destination
+		e.coverImage = cover
+		return nil
+	}
+
 	var b bytes.Buffer
 	writer := bufio.NewWriter(&b)
 
 	err = nil
 	switch reqMediaType {
-	case ".jpg":
-	case ".jpeg":
+	case ".jpg", ".jpeg":
 		err = jpeg.Encode(writer, img, nil)
 	case ".png":
 		err = png.Encode(writer, img)
 	case ".gif":
 		err = gif.Encode(writer, img, nil)
-	default:
-		err = fmt.Errorf("image conversion to %s is not supported", reqMediaType)
 	}
 
 	writer.Flush()
@@ -76,9 +158,46 @@ func (e *Epub) SetCoverImage(cover []byte) error {
 	}
 
 	e.coverImage = b.Bytes()
+	e.coverPath = destination
 	return nil
 }
 
+// Changes the media type of the cover's manifest item and the extension of
+// its href to match, picking an href no other file uses. Returns the new
+// internal path of the cover.
+func (e *Epub) retypeCover(mediaType string) (string, error) {
+	itemElem := e.RootFile.getCoverItem()
+	href := itemElem.SelectAttrValue("href", "")
+	base := strings.TrimSuffix(href, path.Ext(href))
+	ext := coverExtensions[mediaType]
+
+	used := func(href string) bool {
+		for _, item := range itemElem.Parent().SelectElements("item") {
+			if item.SelectAttrValue("href", "") == href {
+				return true
+			}
+		}
+		return false
+	}
+
+	newHref := base + ext
+	for i := 1; ; i++ {
+		coverPath, err := e.itemPath(newHref)
+		if err != nil {
+			return "", err
+		}
+		if !used(newHref) && e.findFile(coverPath) == nil {
+			itemElem.CreateAttr("href", newHref)
+			itemElem.CreateAttr("media-type", mediaType)
+			return coverPath, nil
+		}
+		if i == 256 {
+			return "", fmt.Errorf("unable to find unused href for cover %s", href)
+		}
+		newHref = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
 // Extract cover image into destination directory
 // eg ExtractCoverImage("/library/author") may result in a file
 // `/library/author/cover_image_123456789.png`
@@ -106,23 +225,11 @@ func (e *Epub) ExtractCoverImage(destDir string) (string, error) {
 
 // Gets and returns *zip.File pointing to the coverFile path.
 func (e *Epub) GetCoverFile() (*zip.File, error) {
-	path, err := e.GetCoverPath()
+	coverPath, err := e.GetCoverPath()
 	if err != nil {
 		return nil, err
 	}
-	var file *zip.File
-	path = filepath.FromSlash(path)
-	for _, f := range e.fileHandle.File {
-		n := filepath.FromSlash(f.Name)
-		if n == path {
-			file = f
-			break
-		}
-	}
-
-	if file == nil {
-		return nil, fmt.Errorf("file not found: %s", path)
-	}
 
-	return file, nil
+	// GetCoverPath checked that the file exists
+	return e.findFile(coverPath), nil
 }
@@ -1,8 +1,14 @@
 package epub
 
 import (
+	"archive/zip"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestExtractCover(t *testing.T) {
@@ -61,3 +67,180 @@ func TestGetCoverFile(t *testing.T) {
 		t.Fatalf("Incorrect cover path. Want: `OEBPS\\8143055649100492814_2701-cover.png` Have: `%s`", covFile.Name)
 	}
 }
+
+func TestSetCoverImageNoCover(t *testing.T) {
+	tmpFp := "../test_data/TestEpub.epub"
+
+	og, err := os.ReadFile("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(tmpFp, og, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFp)
+
+	epub, err := OpenEpub(tmpFp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Strip all references to the existing cover
+	item := epub.RootFile.getCoverItem()
+	item.Parent().RemoveChild(item)
+	meta := epub.RootFile.FindElement("//meta[@name='cover']")
+	meta.Parent().RemoveChild(meta)
+
+	if _, err := epub.GetCoverPath(); err != ErrNoCover {
+		t.Fatalf("Expected ErrNoCover, have: %v", err)
+	}
+
+	newImage, err := os.ReadFile("../test_data/miniCoverImg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = epub.SetCoverImage(newImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = epub.WriteChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	epub.Close()
+
+	epub, err = OpenEpub(tmpFp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epub.Close()
+
+	covFile, err := epub.GetCoverFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if covFile.Name != "OEBPS/cover-image.png" {
+		t.Fatalf("Incorrect cover path. Want: `OEBPS/cover-image.png` Have: `%s`", covFile.Name)
+	}
+
+	cv, err := epub.ReadFile(covFile.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cv) != len(newImage) {
+		t.Fatalf("Mismatch cover image sizes. Want: %d Have: %d", len(newImage), len(cv))
+	}
+}
+
+func TestSetCoverImageInvalidHref(t *testing.T) {
+	epub, err := OpenEpub("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epub.Close()
+
+	newImage, err := os.ReadFile("../test_data/miniCoverImg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := epub.RootFile.getCoverItem()
+	for _, href := range []string{"../../../evil.png", "..%2F..%2F..%2Fevil.png", "missing.png"} {
+		item.CreateAttr("href", href)
+		assert.Error(t, epub.SetCoverImage(newImage), href)
+	}
+}
+
+func TestSetCoverImageWebp(t *testing.T) {
+	tmpFp := filepath.Join(t.TempDir(), "webp.epub")
+
+	// Copy an epub with its cover renamed as if it were a webp image
+	src, err := zip.OpenReader("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	out, err := os.Create(tmpFp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(out)
+	for _, f := range src.File {
+		if f.Name != "OEBPS/8143055649100492814_2701-cover.png" {
+			if err := w.Copy(f); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		fw, err := w.Create(strings.TrimSuffix(f.Name, ".png") + ".webp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(fw, fr)
+		fr.Close()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	epub, err := OpenEpub(tmpFp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := epub.RootFile.getCoverItem()
+	item.CreateAttr("href", "8143055649100492814_2701-cover.webp")
+	item.CreateAttr("media-type", "image/webp")
+
+	newImage, err := os.ReadFile("../test_data/miniCoverImg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := epub.SetCoverImage(newImage); err != nil {
+		t.Fatal(err)
+	}
+	if err := epub.WriteChanges(); err != nil {
+		t.Fatal(err)
+	}
+	epub.Close()
+
+	epub, err = OpenEpub(tmpFp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epub.Close()
+
+	covFile, err := epub.GetCoverFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "OEBPS/8143055649100492814_2701-cover.png", covFile.Name)
+
+	mediaType, err := epub.GetCoverMediaType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "image/png", mediaType)
+
+	cv, err := epub.ReadFile(covFile.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, newImage, cv)
+
+	_, err = epub.ReadFile("OEBPS/8143055649100492814_2701-cover.webp")
+	assert.Error(t, err)
+}
@@ -2,12 +2,14 @@ package epub
 
 import (
 	"archive/zip"
-	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
-	"mime/multipart"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,8 +26,14 @@ type Epub struct {
 	FileName   string
 	Metadata   *Metadata
 	fileHandle *zip.Reader
+	file       *os.File // Backs fileHandle
 	RootFile   *RootFile
+	Sha256     string // Hex digest of the archive, set by Parse and Checksum
 	coverImage []byte
+	coverPath  string // Internal path coverImage is written to
+	staleCover string // Internal path of a cover replaced by one of another format
+	tmpPath    string // Temp file holding an epub read by Parse until it is saved
+	stagedPath string // Temp file next to FilePath holding changes until they are committed
 }
 
 // Opens and parses epub from file on disk
@@ -33,6 +41,7 @@ func OpenEpub(path string) (*Epub, error) {
 	epub := &Epub{}
 	epub.FilePath = path
 	epub.FileDir = filepath.Dir(path)
+	epub.FileName = filepath.Base(path)
 
 	err := epub.Reload()
 	if err != nil {
@@ -43,51 +52,244 @@ func OpenEpub(path string) (*Epub, error) {
 }
 
 // Opens and parses epub from multi-part file from request and then saves it to disk
-// at config.library_path/author/title.epub
-func Import(file multipart.File) (*Epub, error) {
+// in config.library_path following config.library_layout
+func Import(file io.Reader) (*Epub, error) {
+	e, err := Parse(file)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create bytes buffer from file.
-	var buf bytes.Buffer
-	_, err := io.Copy(&buf, file)
+	err = e.Save()
 	if err != nil {
+		e.Close()
 		return nil, err
 	}
 
-	data := buf.Bytes()
+	return e, nil
+}
 
-	// Check magic bytes to ensure epub.
-	err = checkMagic(data)
+// Streams an epub into a temp file inside config.library_path and parses it
+// without saving it. Save moves it into place, Close discards it.
+func Parse(r io.Reader) (*Epub, error) {
+	dir := config.GetString("library_path")
+	err := os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 
-	e := &Epub{}
+	// Hidden so library scans skip it
+	file, err := os.CreateTemp(dir, ".import-*.epub.tmp")
+	if err != nil {
+		return nil, err
+	}
 
-	rdr := bytes.NewReader(data)
+	e := &Epub{file: file, tmpPath: file.Name()}
 
-	e.fileHandle, err = zip.NewReader(rdr, rdr.Size())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
 	if err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	// Check magic bytes to ensure epub.
+	err = checkMagic(file)
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	e.fileHandle, err = zip.NewReader(file, size)
+	if err != nil {
+		e.Close()
 		return nil, err
 	}
 
 	err = e.Load()
 	if err != nil {
+		e.Close()
 		return nil, err
 	}
 
-	// Write epub to disk at library/author/title.epub
-	targetDir := filepath.Join(config.GetString("library_path"), e.Metadata.Author)
-	targetDir = sanitizeDirName(targetDir)
+	e.Sha256 = hex.EncodeToString(hash.Sum(nil))
+
+	return e, nil
+}
+
+// Moves an epub read by Parse to its place in the library layout
+func (e *Epub) Save() error {
+	if e.tmpPath == "" {
+		return errors.New("epub has no unsaved data")
+	}
+
+	targetFile, err := e.libraryPath()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(e.tmpPath, targetFile)
+	if err != nil {
+		return err
+	}
+
+	e.tmpPath = ""
+	e.FilePath = targetFile
+	e.FileDir = filepath.Dir(targetFile)
+	e.FileName = filepath.Base(targetFile)
+
+	return nil
+}
+
+// Moves an epub read by Parse over the file at path, replacing it
+// atomically
+func (e *Epub) Overwrite(path string) error {
+	if e.tmpPath == "" {
+		return errors.New("epub has no unsaved data")
+	}
+
+	err := os.Rename(e.tmpPath, path)
+	if err != nil {
+		// path is on another file system, copy next to it first
+		err = e.copyOver(path)
+		if err != nil {
+			return err
+		}
+		os.Remove(e.tmpPath)
+	}
+
+	e.tmpPath = ""
+	e.FilePath = path
+	e.FileDir = filepath.Dir(path)
+	e.FileName = filepath.Base(path)
+
+	return nil
+}
+
+// Copies the archive into a temp file next to path, then renames it to path
+func (e *Epub) copyOver(path string) error {
+	info, err := e.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".*.epub.tmp")
+	if err != nil {
+		return err
+	}
+	tmpFile := file.Name()
+	defer os.Remove(tmpFile)
+	defer file.Close()
+
+	_, err = io.Copy(file, io.NewSectionReader(e.file, 0, info.Size()))
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, path)
+}
+
+// Returns the hex SHA-256 digest of the archive, hashing the file on disk
+// if it isn't known yet
+func (e *Epub) Checksum() (string, error) {
+	if e.Sha256 != "" {
+		return e.Sha256, nil
+	}
+
+	file, err := os.Open(e.FilePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	e.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return e.Sha256, nil
+}
+
+// Returns KOReader's hash of the archive, the MD5 digest of 1 KiB samples
+// taken at offsets growing fourfold from 1 KiB, plus the first 1 KiB. KOReader
+// identifies documents by it when syncing reading progress.
+func (e *Epub) PartialMD5() (string, error) {
+	// Epubs read by Parse aren't at FilePath until they are saved
+	file := e.file
+	if file == nil {
+		var err error
+		file, err = os.Open(e.FilePath)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+	}
+
+	const sampleSize = 1024
+	hash := md5.New()
+	sample := make([]byte, sampleSize)
+	for i := -1; i <= 10; i++ {
+		// KOReader's 32-bit shift by -2 wraps around to offset 0
+		offset := int64(0)
+		if i >= 0 {
+			offset = sampleSize << (2 * i)
+		}
+
+		n, err := file.ReadAt(sample, offset)
+		if n == 0 {
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			break
+		}
+		hash.Write(sample[:n])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Moves an epub opened from disk into the library following
+// config.library_layout
+func (e *Epub) MoveToLibrary() error {
+	targetFile, err := e.libraryPath()
+	if err != nil {
+		return err
+	}
+
+	err = MoveFile(e.FilePath, targetFile)
+	if err != nil {
+		return err
+	}
+
+	e.FilePath = targetFile
+	e.FileDir = filepath.Dir(targetFile)
+	e.FileName = filepath.Base(targetFile)
+
+	return nil
+}
 
-	e.FileDir = targetDir
+// Returns an unused path in the library for the epub following
+// config.library_layout, creating its directory
+func (e *Epub) libraryPath() (string, error) {
+	rel, err := LayoutPath(libraryLayout(), e.Metadata)
+	if err != nil {
+		return "", err
+	}
+
+	targetFile := filepath.Join(config.GetString("library_path"), rel)
+	targetDir := filepath.Dir(targetFile)
 
 	err = os.MkdirAll(targetDir, os.ModePerm)
 	if err != nil {
 		log.Printf("cannot create directories %v", err)
-		return nil, err
+		return "", err
 	}
 
-	targetFile := filepath.Join(targetDir, sanitizeFileName(e.Metadata.Title)) + ".epub"
 	// If a file exists with the desired name, start incrementing as filename_1
 	// until an unused filename is found
 	if fileExists(targetFile) {
@@ -100,20 +302,12 @@ func Import(file multipart.File) (*Epub, error) {
 				break
 			}
 			if i == 255 {
-				return nil, errors.New("unable to find unused filename")
+				return "", errors.New("unable to find unused filename")
 			}
 		}
 	}
 
-	e.FilePath = targetFile
-	err = os.WriteFile(targetFile, data, os.ModePerm)
-	if err != nil {
-		return nil, errors.New("unable to write to disk")
-	}
-	// Set the FileName
-	e.FileName = filepath.Base(e.FilePath)
-
-	return e, nil
+	return targetFile, nil
 }
 
 // Checks if first 4 bytes match epub magic bytes described here:
@@ -125,11 +319,13 @@ func checkMagicBytes(data [4]byte) bool {
 		data == [4]byte{0x50, 0x4B, 0x07, 0x08}
 }
 
-func checkMagic(data []byte) error {
+func checkMagic(r io.ReaderAt) error {
 
 	// Validate first by checking magic bytes, then attempting to parse the epub's metadata
 	var magic [4]byte
-	copy(magic[:], data[:4])
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return errors.New("magic byte not found")
+	}
 
 	if !checkMagicBytes(magic) {
 		return errors.New("magic byte not found")
@@ -144,18 +340,26 @@ func (e *Epub) Reload() error {
 	if e.FilePath == "" {
 		log.Print("epub filepath is empty, cannot reload from disk")
 	} else {
-		e.Close()
+		e.closeFile()
 
-		bts, err := os.ReadFile(e.FilePath)
+		file, err := os.Open(e.FilePath)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
 		if err != nil {
+			file.Close()
 			return err
 		}
-		rdr := bytes.NewReader(bts)
 
-		e.fileHandle, err = zip.NewReader(rdr, rdr.Size())
+		e.fileHandle, err = zip.NewReader(file, info.Size())
 		if err != nil {
+			file.Close()
 			return err
 		}
+		e.file = file
+		// The file may have changed since it was hashed
+		e.Sha256 = ""
 	}
 
 	return e.Load()
@@ -177,14 +381,29 @@ func (e *Epub) Load() error {
 	return nil
 }
 
-// Closes open file handles and renders epub invalid for writing
+// Closes open file handles and renders epub invalid for writing. An epub
+// read by Parse that wasn't saved is discarded.
 func (e *Epub) Close() {
-	if e.fileHandle != nil {
-		e.fileHandle = nil
+	e.closeFile()
+	if e.tmpPath != "" {
+		os.Remove(e.tmpPath)
+		e.tmpPath = ""
+	}
+	if e.stagedPath != "" {
+		os.Remove(e.stagedPath)
+		e.stagedPath = ""
 	}
 	e.Metadata = nil
 }
 
+func (e *Epub) closeFile() {
+	if e.file != nil {
+		e.file.Close()
+		e.file = nil
+	}
+	e.fileHandle = nil
+}
+
 // Parse metadata from rootfile into e.Metadata
 func (e *Epub) readMetadata() error {
 	e.Metadata = e.ExtractMetadata()
@@ -229,18 +448,21 @@ func (e *Epub) getRootFile() (*RootFile, error) {
 	return &RootFile{doc, rootfilePath}, err
 }
 
-// Reads file from zip into byte array
-func (e *Epub) ReadFile(path string) ([]byte, error) {
-	var file *zip.File
+// Returns the file of the archive at the internal path, or nil if there is
+// none
+func (e *Epub) findFile(path string) *zip.File {
 	path = filepath.FromSlash(path)
 	for _, f := range e.fileHandle.File {
-		n := filepath.FromSlash(f.Name)
-		if n == path {
-			file = f
-			break
+		if filepath.FromSlash(f.Name) == path {
+			return f
 		}
 	}
+	return nil
+}
 
+// Reads file from zip into byte array
+func (e *Epub) ReadFile(path string) ([]byte, error) {
+	file := e.findFile(path)
 	if file == nil {
 		return nil, fmt.Errorf("file not found: %s", path)
 	}
@@ -259,13 +481,17 @@ func (e *Epub) ReadFile(path string) ([]byte, error) {
 	return data, nil
 }
 
-// Unpacks epub to destination directory
+// Unpacks epub to destination directory. Entries that would be written
+// outside of it are rejected.
 func (e *Epub) unpack(destination string) error {
 	if err := os.MkdirAll(destination, 0755); err != nil {
 		return err
 	}
 
 	for _, file := range e.fileHandle.File {
+		if !filepath.IsLocal(file.Name) {
+			return fmt.Errorf("invalid path in epub: %s", file.Name)
+		}
 		outFilePath := filepath.Join(destination, file.Name)
 
 		if file.FileInfo().IsDir() {
@@ -281,36 +507,63 @@ func (e *Epub) unpack(destination string) error {
 			return err
 		}
 
-		fileReader, err := file.Open()
-		if err != nil {
+		if err := unpackFile(file, outFilePath); err != nil {
 			return err
 		}
-		defer fileReader.Close()
+	}
+	return nil
+}
 
-		targetFile, err := os.OpenFile(outFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-		if err != nil {
-			return err
-		}
-		defer targetFile.Close()
+// Copies a file of the archive to path
+func unpackFile(file *zip.File, path string) error {
+	fileReader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer fileReader.Close()
 
-		if _, err := io.Copy(targetFile, fileReader); err != nil {
-			return err
-		}
+	targetFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
+	if err != nil {
+		return err
 	}
-	return nil
+
+	if _, err := io.Copy(targetFile, fileReader); err != nil {
+		targetFile.Close()
+		return err
+	}
+	return targetFile.Close()
 }
 
 // Writes changes to metadata and cover image to epub file
+// The archive is rebuilt next to the original and only renamed over it once
+// it has been written completely, so a failed write leaves the original intact.
 func (e *Epub) WriteChanges() error {
-	tmpDir := filepath.Join(os.TempDir(), filepath.Base(strings.Split(e.FilePath, ".")[0]))
-	tmpFile := tmpDir + ".epub"
+	if err := e.StageChanges(); err != nil {
+		return err
+	}
+	return e.CommitChanges()
+}
 
-	e.unpack(tmpDir)
+// Rebuilds the archive with the changes to metadata and cover image in a temp
+// file next to the epub, to be moved over it by CommitChanges. Close discards
+// changes that weren't committed.
+func (e *Epub) StageChanges() error {
+	tmpDir, err := os.MkdirTemp("", "nubayrah-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
 
-	defer os.Remove(tmpDir)
+	err = e.unpack(tmpDir)
+	if err != nil {
+		return err
+	}
 
 	// RootFile + Metadata
-	e.RootFile.InsertMetadata(e.Metadata)
+	err = e.RootFile.InsertMetadata(e.Metadata)
+	if err != nil {
+		return err
+	}
 	rfStr, err := e.RootFile.WriteToString()
 	if err != nil {
 		return err
@@ -322,42 +575,110 @@ func (e *Epub) WriteChanges() error {
 		return err
 	}
 
-	// Cover image
+	// Cover image, its path was checked by SetCoverImage
 	if len(e.coverImage) != 0 {
-		coverPath, err := e.GetCoverPath()
-		if err != nil {
-			return err
+		if e.staleCover != "" {
+			err = os.Remove(filepath.Join(tmpDir, e.staleCover))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
 		}
 
-		err = os.WriteFile(filepath.Join(tmpDir, coverPath), e.coverImage, os.ModePerm)
+		err = os.WriteFile(filepath.Join(tmpDir, e.coverPath), e.coverImage, os.ModePerm)
 		if err != nil {
 			return err
 		}
 	}
 
-	file, err := os.Create(tmpFile)
+	// Create the new archive in the same directory so the rename is atomic
+	file, err := os.CreateTemp(filepath.Dir(e.FilePath), ".*.epub.tmp")
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	zipWriter := zip.NewWriter(file)
-	defer zipWriter.Close()
+	err = packDir(file, tmpDir)
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
 
-	fsys := os.DirFS(tmpDir)
+	if e.stagedPath != "" {
+		os.Remove(e.stagedPath)
+	}
+	e.stagedPath = file.Name()
+	return nil
+}
+
+// Moves the archive rebuilt by StageChanges over the epub
+func (e *Epub) CommitChanges() error {
+	if e.stagedPath == "" {
+		return errors.New("epub has no staged changes")
+	}
 
-	err = zipWriter.AddFS(fsys)
+	e.closeFile()
+	err := os.Rename(e.stagedPath, e.FilePath)
 	if err != nil {
 		return err
 	}
 
-	zipWriter.Close()
-	file.Close()
-	e.fileHandle = nil
-	err = os.Rename(tmpFile, e.FilePath)
+	e.stagedPath = ""
+	return nil
+}
+
+// Zips the contents of dir into w. The mimetype file is written first and
+// uncompressed as required by the OCF spec.
+func packDir(w io.Writer, dir string) error {
+	zipWriter := zip.NewWriter(w)
+
+	mimetype, err := os.ReadFile(filepath.Join(dir, "mimetype"))
+	if err == nil {
+		f, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(mimetype); err != nil {
+			return err
+		}
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == "mimetype" {
+			return nil
+		}
+
+		f, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+		if err != nil {
+			return err
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(f, src)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return zipWriter.Close()
 }
@@ -1,8 +1,13 @@
 package epub
 
 import (
+	"archive/zip"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/spf13/viper"
@@ -68,10 +73,13 @@ func TestReadMetadata(t *testing.T) {
 			"Whales -- Fiction",
 			"Whaling ships -- Fiction",
 		},
-		Isbn:         "",
-		Publisher:    "",
-		PubDate:      "2001-07-01",
-		Rights:       "Public domain in the USA.",
+		Isbn:      "",
+		Publisher: "",
+		PubDate:   "2001-07-01",
+		Rights:    "Public domain in the USA.",
+		Creators: []Creator{
+			{Name: "Herman Melville", FileAs: "Melville, Herman", Role: "aut"},
+		},
 		Contributors: []Contributor{},
 		Description:  "",
 		Uid:          "http://www.gutenberg.org/2701",
@@ -89,18 +97,21 @@ func TestReadMetadata(t *testing.T) {
 	}
 
 	mdataWant = &Metadata{
-		Title:        "The stone age in North America, vol. II",
-		TitleSort:    "",
-		Author:       "Warren K. Moorehead",
-		AuthorSort:   "Moorehead, Warren K. (Warren King)",
-		Language:     "en",
-		Series:       "The Stone Age In North America",
-		SeriesNum:    2,
-		Subjects:     []string{},
-		Isbn:         "",
-		Publisher:    "",
-		PubDate:      "2024-09-07",
-		Rights:       "Public domain in the USA.",
+		Title:      "The stone age in North America, vol. II",
+		TitleSort:  "",
+		Author:     "Warren K. Moorehead",
+		AuthorSort: "Moorehead, Warren K. (Warren King)",
+		Language:   "en",
+		Series:     "The Stone Age In North America",
+		SeriesNum:  2,
+		Subjects:   []string{},
+		Isbn:       "",
+		Publisher:  "",
+		PubDate:    "2024-09-07",
+		Rights:     "Public domain in the USA.",
+		Creators: []Creator{
+			{Name: "Warren K. Moorehead", FileAs: "Moorehead, Warren K. (Warren King)"},
+		},
 		Contributors: []Contributor{},
 		Description:  "",
 		Uid:          "http://www.gutenberg.org/74390",
@@ -134,6 +145,9 @@ func TestReadMetadata(t *testing.T) {
 		Publisher: "",
 		PubDate:   "2009-02-12",
 		Rights:    "Public domain in the USA.",
+		Creators: []Creator{
+			{Name: "Fyodor Dostoyevsky", FileAs: "Dostoyevsky, Fyodor", Role: "aut"},
+		},
 		Contributors: []Contributor{
 			{Name: "Constance Garnett", Role: "trl"},
 		},
@@ -167,6 +181,9 @@ func TestReadMetadata(t *testing.T) {
 		Publisher: "",
 		PubDate:   "2009-12-31",
 		Rights:    "Public domain in the USA.",
+		Creators: []Creator{
+			{Name: "John Ruskin", FileAs: "Ruskin, John", Role: "aut"},
+		},
 		Contributors: []Contributor{
 			{Name: "calibre (7.12.0) [https://calibre-ebook.com]", Role: "bkp"},
 		},
@@ -215,6 +232,11 @@ func TestWriteMetadata(t *testing.T) {
 		Publisher: "newPub",
 		PubDate:   "1999-12-31",
 		Rights:    "",
+		Creators: []Creator{
+			{Name: "newAuthor", FileAs: "authorNew", Role: "aut"},
+			{Name: "Second Author", FileAs: "Author, Second", Role: "ill"},
+			{Name: "Third Author"},
+		},
 		Contributors: []Contributor{
 			{Name: "Bob Ross", Role: "art"},
 		},
@@ -376,3 +398,198 @@ func TestImportDuplicate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// Tests that epubs read by Parse are only kept once saved
+func TestParse(t *testing.T) {
+	libRoot := filepath.Join("../test_data", "test_library_root")
+	viper.SetDefault("library_path", libRoot)
+	t.Cleanup(func() { os.RemoveAll(libRoot) })
+
+	tmpFiles := func() []string {
+		matches, err := filepath.Glob(filepath.Join(libRoot, ".import-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches
+	}
+
+	file, err := os.Open("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	e, err := Parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Moby Dick; Or, The Whale", e.Metadata.Title)
+	assert.Len(t, e.Sha256, 64)
+	assert.Len(t, tmpFiles(), 1)
+
+	// Discarded without saving
+	e.Close()
+	assert.Empty(t, tmpFiles())
+
+	// Not an epub
+	_, err = Parse(strings.NewReader("not an epub"))
+	assert.Error(t, err)
+	assert.Empty(t, tmpFiles())
+
+	// Saved
+	file.Seek(0, io.SeekStart)
+	e, err = Parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := e.Sha256
+
+	err = e.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+	assert.Empty(t, tmpFiles())
+
+	e, err = OpenEpub(filepath.Join(libRoot, "Herman Melville", "Moby Dick; Or, The Whale.epub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	have, err := e.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sum, have)
+}
+
+func TestPartialMD5(t *testing.T) {
+	dir := t.TempDir()
+
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	path := filepath.Join(dir, "sample.epub")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Samples at 0, 1024 and 4096, the one at 16384 is past the end
+	want := md5.New()
+	want.Write(data[0:1024])
+	want.Write(data[1024:2048])
+	want.Write(data[4096:])
+
+	e := &Epub{FilePath: path}
+	have, err := e.PartialMD5()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, hex.EncodeToString(want.Sum(nil)), have)
+
+	// Files shorter than a sample are hashed whole
+	if err := os.WriteFile(path, data[:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(data[:100])
+	have, err = e.PartialMD5()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, hex.EncodeToString(sum[:]), have)
+}
+
+func TestWriteChangesZipSlip(t *testing.T) {
+	dir := t.TempDir()
+	tmpFp := filepath.Join(dir, "slip.epub")
+
+	// Copy an epub and add an entry escaping the unpack directory
+	src, err := zip.OpenReader("../test_data/MobyDick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	out, err := os.Create(tmpFp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(out)
+	for _, f := range src.File {
+		if err := w.Copy(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	escaped := "../" + filepath.Base(dir) + "-slip.txt"
+	fw, err := w.Create(escaped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("outside"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	epub, err := OpenEpub(tmpFp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epub.Close()
+
+	assert.Error(t, epub.WriteChanges())
+	_, err = os.Stat(filepath.Join(os.TempDir(), filepath.Base(dir)+"-slip.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStageChanges(t *testing.T) {
+	tmpFp := filepath.Join(t.TempDir(), "staged.epub")
+
+	og, err := os.ReadFile("../test_data/TheBrothersKaramazov.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmpFp, og, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := func(title string) *Epub {
+		epub, err := OpenEpub(tmpFp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		epub.Metadata.Title = title
+		if err := epub.StageChanges(); err != nil {
+			t.Fatal(err)
+		}
+		return epub
+	}
+	title := func() string {
+		epub, err := OpenEpub(tmpFp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer epub.Close()
+		return epub.Metadata.Title
+	}
+
+	// Changes closed without being committed are discarded
+	stage("discarded").Close()
+	assert.NotEqual(t, "discarded", title())
+	entries, err := os.ReadDir(filepath.Dir(tmpFp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 1)
+
+	epub := stage("committed")
+	defer epub.Close()
+	assert.NotEqual(t, "committed", title())
+	if err := epub.CommitChanges(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "committed", title())
+	assert.Error(t, epub.CommitChanges())
+}
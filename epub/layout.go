@@ -0,0 +1,194 @@
+package epub
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	config "github.com/spf13/viper"
+)
+
+// Layout used when config.library_layout is not set
+const DefaultLayout = "{author}/{title}.epub"
+
+// Matches {field} and {field:width} placeholders in a layout
+var layoutPlaceholder = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+// Characters trimmed from path segments after substitution, so separators
+// around empty fields don't linger and segments can't become hidden files
+const layoutTrimChars = " -_.,"
+
+// Returns the value of a layout field for m. Width zero-pads numbers.
+func layoutField(m *Metadata, name string, width int) (string, error) {
+	switch name {
+	case "title":
+		return m.Title, nil
+	case "titleSort":
+		if m.TitleSort == "" {
+			return m.Title, nil
+		}
+		return m.TitleSort, nil
+	case "author":
+		return m.Author, nil
+	case "authorSort":
+		if m.AuthorSort == "" {
+			return m.Author, nil
+		}
+		return m.AuthorSort, nil
+	case "series":
+		return m.Series, nil
+	case "seriesNum":
+		if m.Series == "" || m.SeriesNum < 0 {
+			return "", nil
+		}
+		whole, frac, _ := strings.Cut(strconv.FormatFloat(m.SeriesNum, 'f', -1, 64), ".")
+		if len(whole) < width {
+			whole = strings.Repeat("0", width-len(whole)) + whole
+		}
+		if frac != "" {
+			return whole + "." + frac, nil
+		}
+		return whole, nil
+	case "language":
+		return m.Language, nil
+	case "publisher":
+		return m.Publisher, nil
+	case "pubDate":
+		return m.PubDate, nil
+	case "year":
+		year, _, _ := strings.Cut(m.PubDate, "-")
+		return year, nil
+	case "isbn":
+		return m.Isbn, nil
+	default:
+		return "", fmt.Errorf("unknown layout field %q", name)
+	}
+}
+
+// Builds the path of a book relative to the library from a layout such as
+// {authorSort}/{series}/{seriesNum:02} - {title}.epub
+// Directory segments left empty by missing fields are dropped and an empty
+// file name falls back to the title.
+func LayoutPath(layout string, m *Metadata) (string, error) {
+	layout = strings.TrimSuffix(layout, ".epub")
+
+	segments := strings.Split(filepath.ToSlash(layout), "/")
+	parts := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		var fieldErr error
+		value := layoutPlaceholder.ReplaceAllStringFunc(segment, func(match string) string {
+			groups := layoutPlaceholder.FindStringSubmatch(match)
+			width, _ := strconv.Atoi(groups[2])
+			v, err := layoutField(m, groups[1], width)
+			if err != nil {
+				fieldErr = err
+			}
+			// Field values must not introduce directories
+			return sanitizeFileName(strings.ReplaceAll(v, "\\", "_"))
+		})
+		if fieldErr != nil {
+			return "", fieldErr
+		}
+
+		value = strings.Trim(value, layoutTrimChars)
+		if i == len(segments)-1 {
+			if value == "" {
+				value = strings.Trim(sanitizeFileName(m.Title), layoutTrimChars)
+			}
+			parts = append(parts, sanitizeFileName(value)+".epub")
+		} else if value != "" {
+			parts = append(parts, sanitizeDirName(value))
+		}
+	}
+
+	return filepath.Join(parts...), nil
+}
+
+// Checks that a layout only uses known fields
+func ValidateLayout(layout string) error {
+	_, err := LayoutPath(layout, &Metadata{Title: "title"})
+	return err
+}
+
+// Returns config.library_layout, or DefaultLayout if it is not set
+func libraryLayout() string {
+	if layout := config.GetString("library_layout"); layout != "" {
+		return layout
+	}
+	return DefaultLayout
+}
+
+// Reports whether path is target or one of its numbered variants target_N.epub
+func isLayoutVariant(path string, target string) bool {
+	if path == target {
+		return true
+	}
+
+	base := strings.TrimSuffix(target, ".epub") + "_"
+	if !strings.HasPrefix(path, base) || !strings.HasSuffix(path, ".epub") {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, base), ".epub"))
+	return err == nil
+}
+
+// Moves the epub to where the library layout puts it based on its current
+// metadata, removing directories left empty. Books stored outside of
+// config.library_path are left in place. Returns whether the epub was moved.
+func (e *Epub) Relocate() (bool, error) {
+	root, err := filepath.Abs(config.GetString("library_path"))
+	if err != nil {
+		return false, err
+	}
+
+	current, err := filepath.Abs(e.FilePath)
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(root, current)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false, nil
+	}
+
+	layoutRel, err := LayoutPath(libraryLayout(), e.Metadata)
+	if err != nil {
+		return false, err
+	}
+
+	if isLayoutVariant(current, filepath.Join(root, layoutRel)) {
+		return false, nil
+	}
+
+	oldDir := e.FileDir
+	err = e.MoveToLibrary()
+	if err != nil {
+		return false, err
+	}
+
+	removeEmptyDirs(oldDir, root)
+	return true, nil
+}
+
+// Removes dir and its parents up to, but not including, root as long as
+// they are empty
+func removeEmptyDirs(dir string, root string) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		// Fails for directories that aren't empty
+		if err := os.Remove(dir); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return
+			}
+		}
+		dir = filepath.Dir(dir)
+	}
+}
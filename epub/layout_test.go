@@ -0,0 +1,47 @@
+package epub
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayoutPath(t *testing.T) {
+	mdata := &Metadata{
+		Title:      "The Two Towers",
+		Author:     "J. R. R. Tolkien",
+		AuthorSort: "Tolkien, J. R. R.",
+		Series:     "The Lord of the Rings",
+		SeriesNum:  2,
+		PubDate:    "1954-11-11",
+	}
+
+	tests := []struct {
+		layout string
+		mdata  *Metadata
+		want   string
+	}{
+		{DefaultLayout, mdata, "J. R. R. Tolkien/The Two Towers.epub"},
+		{"{authorSort}/{series}/{seriesNum:02} - {title}.epub", mdata,
+			"Tolkien, J. R. R/The Lord of the Rings/02 - The Two Towers.epub"},
+		{"{year}/{title}", mdata, "1954/The Two Towers.epub"},
+		// Missing series drops the directory and separator
+		{"{author}/{series}/{seriesNum:02} - {title}.epub", &Metadata{Title: "Moby Dick", Author: "Herman Melville", SeriesNum: -1},
+			"Herman Melville/Moby Dick.epub"},
+		// Field values can't add directories or escape the library
+		{"{author}/{title}.epub", &Metadata{Title: "AC/DC", Author: ".."}, "AC_DC.epub"},
+		{"{series}.epub", &Metadata{Title: "Untitled"}, "Untitled.epub"},
+	}
+
+	for _, test := range tests {
+		have, err := LayoutPath(test.layout, test.mdata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, filepath.FromSlash(test.want), have, test.layout)
+	}
+
+	_, err := LayoutPath("{author}/{nope}.epub", mdata)
+	assert.Error(t, err)
+}
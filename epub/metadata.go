@@ -1,5 +1,13 @@
 package epub
 
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
 type Metadata struct {
 	Title        string        `json:"title"`
 	TitleSort    string        `json:"titleSort"`
@@ -13,13 +21,94 @@ type Metadata struct {
 	Publisher    string        `json:"publisher"`
 	PubDate      string        `json:"pubDate"` // iso8601 format
 	Rights       string        `json:"rights"`
+	Creators     []Creator     `json:"creators" gorm:"serializer:json" ` // Every dc:creator, the first is Author
 	Contributors []Contributor `json:"contributors" gorm:"serializer:json" `
 	Description  string        `json:"description"`
 	// The following fields are not user-editable
 	Uid string `json:"uid"`
 }
 
+type Creator struct {
+	Name   string `json:"name"`
+	FileAs string `json:"fileAs"`
+	Role   string `json:"role"` // MARC relator such as aut, ill or trl
+}
+
 type Contributor struct {
 	Name string `json:"name"`
 	Role string `json:"role"`
 }
+
+// Accepted layouts for PubDate, from most to least precise
+var pubDateLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+// Checks that metadata can be written into a rootfile
+func (m *Metadata) Validate() error {
+	if strings.TrimSpace(m.Title) == "" {
+		return errors.New("title must not be empty")
+	}
+
+	if strings.TrimSpace(m.Author) == "" {
+		return errors.New("author must not be empty")
+	}
+
+	// -1 is used when a book has no position in its series
+	if m.SeriesNum < 0 && m.SeriesNum != -1 {
+		return fmt.Errorf("invalid seriesNum %v", m.SeriesNum)
+	}
+
+	if m.PubDate != "" && !validPubDate(m.PubDate) {
+		return fmt.Errorf("pubDate %q is not an iso8601 date", m.PubDate)
+	}
+
+	for _, s := range m.Subjects {
+		if strings.TrimSpace(s) == "" {
+			return errors.New("subjects must not be empty")
+		}
+	}
+
+	for _, c := range m.Creators {
+		if strings.TrimSpace(c.Name) == "" {
+			return errors.New("creator name must not be empty")
+		}
+	}
+
+	for _, c := range m.Contributors {
+		if strings.TrimSpace(c.Name) == "" {
+			return errors.New("contributor name must not be empty")
+		}
+	}
+
+	return nil
+}
+
+// Returns the creators of the book with Author and AuthorSort as the first,
+// for metadata read before creators were
+func (m *Metadata) AllCreators() []Creator {
+	if len(m.Creators) == 0 {
+		return []Creator{{Name: m.Author, FileAs: m.AuthorSort}}
+	}
+
+	creators := slices.Clone(m.Creators)
+	creators[0].Name, creators[0].FileAs = m.Author, m.AuthorSort
+	return creators
+}
+
+// Makes Author and AuthorSort agree with the first of Creators after m was
+// edited from old. Edited creators take precedence over the author.
+func (m *Metadata) SyncCreators(old *Metadata) {
+	if len(m.Creators) > 0 && !slices.Equal(m.Creators, old.Creators) {
+		m.Author, m.AuthorSort = m.Creators[0].Name, m.Creators[0].FileAs
+		return
+	}
+	m.Creators = m.AllCreators()
+}
+
+func validPubDate(date string) bool {
+	for _, layout := range pubDateLayouts {
+		if _, err := time.Parse(layout, date); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -8,7 +8,9 @@ package epub
 import (
 	"errors"
 	"fmt"
-	"math"
+	"net/url"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -26,6 +28,7 @@ func (e *Epub) ExtractMetadata() *Metadata {
 
 	mdata.Title, mdata.TitleSort = e.RootFile.getTitle()
 	mdata.Author, mdata.AuthorSort = e.RootFile.getAuthor()
+	mdata.Creators = e.RootFile.getCreators()
 	mdata.Language = e.RootFile.getLanguage()
 	mdata.Series, mdata.SeriesNum = e.RootFile.getSeries()
 	mdata.Subjects = e.RootFile.getSubjects()
@@ -49,7 +52,10 @@ func (f *RootFile) InsertMetadata(mdata *Metadata) error {
 		return errors.New("malformed package document: package element not found")
 	}
 
-	coverId := f.getCoverId()
+	coverId := ""
+	if itemElem := f.getCoverItem(); itemElem != nil {
+		coverId = itemElem.SelectAttrValue("id", "")
+	}
 
 	for _, child := range pkgElem.ChildElements() {
 		if child.Tag == "metadata" {
@@ -71,14 +77,27 @@ func (f *RootFile) InsertMetadata(mdata *Metadata) error {
 		metaElem.SetText(mdata.TitleSort)
 	}
 
-	authElem := mdataElem.CreateElement("dc:creator")
-	authElem.CreateAttr("id", "author")
-	authElem.SetText(mdata.Author)
-	if mdata.AuthorSort != "" {
-		metaElem := mdataElem.CreateElement("meta")
-		metaElem.CreateAttr("refines", "#author")
-		metaElem.CreateAttr("property", "file-as")
-		metaElem.SetText(mdata.AuthorSort)
+	for i, c := range mdata.AllCreators() {
+		id := "author"
+		if i > 0 {
+			id = fmt.Sprintf("author_%d", i)
+		}
+		authElem := mdataElem.CreateElement("dc:creator")
+		authElem.CreateAttr("id", id)
+		authElem.SetText(c.Name)
+		if c.FileAs != "" {
+			metaElem := mdataElem.CreateElement("meta")
+			metaElem.CreateAttr("refines", fmt.Sprintf("#%s", id))
+			metaElem.CreateAttr("property", "file-as")
+			metaElem.SetText(c.FileAs)
+		}
+		if c.Role != "" {
+			metaElem := mdataElem.CreateElement("meta")
+			metaElem.CreateAttr("refines", fmt.Sprintf("#%s", id))
+			metaElem.CreateAttr("property", "role")
+			metaElem.CreateAttr("scheme", "marc:relators")
+			metaElem.SetText(c.Role)
+		}
 	}
 
 	mdataElem.CreateElement("dc:language").SetText(mdata.Language)
@@ -89,7 +108,8 @@ func (f *RootFile) InsertMetadata(mdata *Metadata) error {
 		seriesElem.CreateAttr("id", "series")
 		seriesElem.SetText(mdata.Series)
 
-		if !math.IsNaN(mdata.SeriesNum) {
+		// A negative seriesNum means the book has no position in the series
+		if mdata.SeriesNum >= 0 {
 			seriesNumElem := mdataElem.CreateElement("meta")
 			seriesNumElem.CreateAttr("refines", "#series")
 			seriesNumElem.CreateAttr("property", "group-position")
@@ -176,37 +196,44 @@ func (f *RootFile) getTitle() (title string, titleSort string) {
 	return
 }
 
-// Reads author and authorSort from xml doc
+// Reads author and authorSort from xml doc, the first of the creators
 func (f *RootFile) getAuthor() (author string, authorSort string) {
 	author = "Unknown Author"
-	metaElem := f.FindElement("//dc:creator")
-	if metaElem == nil {
-		return
-	}
-	author = metaElem.Text()
-	authorSort = metaElem.SelectAttrValue("opf:file-as", "")
-	if authorSort != "" {
+	creators := f.getCreators()
+	if len(creators) == 0 {
 		return
 	}
+	return creators[0].Name, creators[0].FileAs
+}
 
-	id := metaElem.SelectAttrValue("id", "")
-	if id == "" {
-		return
-	}
-	metaElem = f.FindElementFiltered(
-		"//meta",
-		filter{
-			name:  "property",
-			value: "file-as",
-		},
-		filter{
-			name:  "refines",
-			value: fmt.Sprintf("#%s", id),
-		})
-	if metaElem != nil {
-		authorSort = metaElem.Text()
+// Reads every creator in document order along with their file-as and role
+// from either EPUB 2 attributes or EPUB 3 refinements
+func (f *RootFile) getCreators() []Creator {
+	elems := f.FindElements("//dc:creator")
+	creators := make([]Creator, len(elems))
+	for i, elem := range elems {
+		creators[i].Name = elem.Text()
+		creators[i].FileAs = elem.SelectAttrValue("opf:file-as", "")
+		creators[i].Role = elem.SelectAttrValue("opf:role", "")
+
+		id := elem.SelectAttrValue("id", "")
+		if id == "" {
+			continue
+		}
+		refines := filter{name: "refines", value: fmt.Sprintf("#%s", id)}
+		if creators[i].FileAs == "" {
+			if metaElem := f.FindElementFiltered("//meta", filter{name: "property", value: "file-as"}, refines); metaElem != nil {
+				creators[i].FileAs = metaElem.Text()
+			}
+		}
+		if creators[i].Role == "" {
+			if metaElem := f.FindElementFiltered("//meta", filter{name: "property", value: "role"}, refines); metaElem != nil {
+				creators[i].Role = metaElem.Text()
+			}
+		}
 	}
-	return
+
+	return creators
 }
 
 // Reads series, seriesNum from xml doc
@@ -344,6 +371,90 @@ func (f *RootFile) getCoverId() string {
 	return elem.SelectAttrValue("content", "")
 }
 
+// Finds the manifest item of the cover image, either from the EPUB 2
+// <meta name="cover"> reference or the EPUB 3 cover-image property
+func (f *RootFile) getCoverItem() *etree.Element {
+	if coverId := f.getCoverId(); coverId != "" {
+		elem := f.FindElement(fmt.Sprintf("//package/manifest/item[@id='%s']", coverId))
+		if elem != nil {
+			return elem
+		}
+	}
+	return f.FindElement("//package/manifest/item[@properties='cover-image']")
+}
+
+// Adds a manifest item for a new cover image of the given media type and
+// references it from the metadata. Returns the new item.
+func (f *RootFile) addCoverItem(mediaType string) (*etree.Element, error) {
+	pkgElem := f.FindElement("//package")
+	if pkgElem == nil {
+		return nil, errors.New("malformed package document: package element not found")
+	}
+
+	manifestElem := pkgElem.FindElement("manifest")
+	if manifestElem == nil {
+		return nil, errors.New("malformed package document: manifest element not found")
+	}
+
+	// Find an id and href that aren't used by another item
+	ext := coverExtensions[mediaType]
+	id := "cover-image"
+	for i := 1; manifestElem.FindElement(fmt.Sprintf("item[@id='%s']", id)) != nil ||
+		manifestElem.FindElement(fmt.Sprintf("item[@href='%s%s']", id, ext)) != nil; i++ {
+		id = fmt.Sprintf("cover-image_%d", i)
+	}
+
+	itemElem := manifestElem.CreateElement("item")
+	itemElem.CreateAttr("id", id)
+	itemElem.CreateAttr("href", id+ext)
+	itemElem.CreateAttr("media-type", mediaType)
+	if strings.HasPrefix(pkgElem.SelectAttrValue("version", ""), "3") {
+		itemElem.CreateAttr("properties", "cover-image")
+	}
+
+	// EPUB 2 readers only find the cover through <meta name="cover">
+	metaElem := f.FindElement("//meta[@name='cover']")
+	if metaElem == nil {
+		mdataElem := pkgElem.FindElement("metadata")
+		if mdataElem == nil {
+			return nil, errors.New("malformed package document: metadata element not found")
+		}
+		metaElem = mdataElem.CreateElement("meta")
+		metaElem.CreateAttr("name", "cover")
+	}
+	metaElem.CreateAttr("content", id)
+
+	return itemElem, nil
+}
+
+// Returns the internal paths of the documents listed in the spine, in
+// reading order
+func (f *RootFile) getSpinePaths() ([]string, error) {
+	spineElem := f.FindElement("//package/spine")
+	if spineElem == nil {
+		return nil, errors.New("malformed package document: spine element not found")
+	}
+
+	baseDir := path.Dir(filepath.ToSlash(f.internalPath))
+	itemrefs := spineElem.SelectElements("itemref")
+	paths := make([]string, 0, len(itemrefs))
+	for _, itemref := range itemrefs {
+		idref := itemref.SelectAttrValue("idref", "")
+		itemElem := f.FindElement(fmt.Sprintf("//package/manifest/item[@id='%s']", idref))
+		if itemElem == nil {
+			return nil, fmt.Errorf("spine item %q not found in manifest", idref)
+		}
+
+		href, err := url.PathUnescape(itemElem.SelectAttrValue("href", ""))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path.Join(baseDir, href))
+	}
+
+	return paths, nil
+}
+
 // Gets text value of node or an empty string
 func (f *RootFile) getNodeText(name string) string {
 	elem := f.FindElement(fmt.Sprintf("//%s", name))
@@ -0,0 +1,72 @@
+package epub
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Elements whose content is never displayed as text
+var nonTextElements = map[string]bool{
+	"head":     true,
+	"script":   true,
+	"style":    true,
+	"svg":      true,
+	"template": true,
+}
+
+// Returns the internal paths of the content documents in reading order
+func (e *Epub) GetSpinePaths() ([]string, error) {
+	return e.RootFile.getSpinePaths()
+}
+
+// Extracts the plain text of all content documents in reading order.
+// Documents that are missing from the archive are skipped.
+func (e *Epub) ExtractText() (string, error) {
+	paths, err := e.GetSpinePaths()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, p := range paths {
+		data, err := e.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		extractDocumentText(&sb, data)
+	}
+
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// Writes the text nodes of an (x)html document to sb, separated by spaces
+func extractDocumentText(sb *strings.Builder, data []byte) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	skipDepth := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if skipDepth > 0 || nonTextElements[string(name)] {
+				skipDepth++
+			}
+		case html.EndTagToken:
+			if skipDepth > 0 {
+				skipDepth--
+			}
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			text := strings.Join(strings.Fields(string(tokenizer.Text())), " ")
+			if text != "" {
+				sb.WriteString(text)
+				sb.WriteByte(' ')
+			}
+		}
+	}
+}
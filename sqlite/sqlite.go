@@ -2,7 +2,10 @@ package sqlite
 
 import (
 	"log"
+	"nubayrah/api/annotation"
 	"nubayrah/api/book"
+	"nubayrah/api/user"
+	"nubayrah/api/webhook"
 	"path/filepath"
 
 	config "github.com/spf13/viper"
@@ -21,7 +24,24 @@ func OpenDatabase(path string) (*gorm.DB, error) {
 	}
 
 	// Run Automigration
-	DB.AutoMigrate(&book.Book{})
+	DB.AutoMigrate(&book.Book{}, &book.Job{}, &book.SyncProgress{}, &book.ReadingState{}, &book.ReadingEntry{},
+		&book.Collection{}, &book.CollectionBook{}, &book.Author{}, &book.AuthorName{}, &book.BookAuthor{},
+		&annotation.Annotation{}, &webhook.Webhook{}, &webhook.Delivery{}, &user.User{}, &user.Session{}, &user.Token{})
+
+	// Full-text search tables and triggers aren't handled by AutoMigrate
+	err = book.MigrateSearchIndex(DB)
+	if err != nil {
+		return DB, err
+	}
+	err = book.MigratePurge(DB)
+	if err != nil {
+		return DB, err
+	}
+	err = annotation.Migrate(DB)
+	if err != nil {
+		return DB, err
+	}
+	err = book.MigrateAuthors(DB)
 
 	return DB, err
 }